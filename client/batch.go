@@ -0,0 +1,370 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBatchClosed is returned for operations queued in a closed batch.
+var ErrBatchClosed = errors.New("the batch is closed")
+
+type BatchConfig struct {
+	// MaxSize is the number of queued operations triggering a flush
+	MaxSize int
+	// FlushInterval is how often queued operations are flushed, whatever
+	// their number. Zero disables periodic flushes.
+	FlushInterval time.Duration
+	// MaxConcurrency is the maximum number of pipelines sent at the same
+	// time, to different nodes. Queuing operations blocks while MaxSize
+	// times MaxConcurrency operations are pending.
+	MaxConcurrency int
+}
+
+func DefaultBatchConfig() BatchConfig {
+	return BatchConfig{
+		MaxSize:        1000,
+		FlushInterval:  10 * time.Millisecond,
+		MaxConcurrency: 16,
+	}
+}
+
+// Future is the result of an operation queued in a batch.
+type Future struct {
+	Key string
+
+	done   chan struct{}
+	result string
+	err    error
+}
+
+// Done is closed once the result of the operation is known.
+func (future *Future) Done() <-chan struct{} {
+	return future.done
+}
+
+// Wait waits for the result of the operation. Fetched values are returned,
+// other operations return an empty result.
+func (future *Future) Wait(ctx context.Context) (string, error) {
+	select {
+	case <-future.done:
+		return future.result, future.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (future *Future) resolve(result string, err error) {
+	future.result = result
+	future.err = err
+	close(future.done)
+}
+
+type operation struct {
+	request    string
+	idempotent bool
+	future     *Future
+}
+
+// Batch queues operations, and sends them in bulk: the queued operations are
+// grouped by the node owning their key, and each group is pipelined on a
+// single connection. A node is sent one pipeline at a time.
+//
+// Operations on the same key are sent in the order they were queued, as
+// long as the topology of the cluster does not change.
+type Batch struct {
+	client *ClusterClient
+	config BatchConfig
+
+	mutex  sync.Mutex
+	queue  []*operation
+	closed bool
+
+	// operations waiting for the pipeline in flight to their node to be
+	// done, by node address
+	pending map[string][]*operation
+
+	// one token per pipeline that can be sent
+	slots chan struct{}
+	// one token per operation that can be pending
+	room     chan struct{}
+	inFlight sync.WaitGroup
+
+	stop chan struct{}
+}
+
+func NewBatch(client *ClusterClient, config BatchConfig) *Batch {
+	if config.MaxConcurrency < 1 {
+		config.MaxConcurrency = 1
+	}
+
+	if config.MaxSize < 1 {
+		config.MaxSize = 1
+	}
+
+	batch := &Batch{
+		client:  client,
+		config:  config,
+		pending: make(map[string][]*operation),
+		slots:   make(chan struct{}, config.MaxConcurrency),
+		room:    make(chan struct{}, config.MaxSize*config.MaxConcurrency),
+		stop:    make(chan struct{}),
+	}
+
+	for i := 0; i < config.MaxConcurrency; i++ {
+		batch.slots <- struct{}{}
+	}
+
+	if config.FlushInterval != 0 {
+		batch.startFlushRoutine(config.FlushInterval)
+	}
+
+	return batch
+}
+
+func (batch *Batch) Get(key string) *Future {
+	return batch.add(key, "fetch "+key, true)
+}
+
+func (batch *Batch) Set(key, value string) *Future {
+	return batch.add(key, fmt.Sprintf("store %s %s", key, value), false)
+}
+
+func (batch *Batch) SetWithTTL(key, value string, lifetime time.Duration) *Future {
+	return batch.add(key, fmt.Sprintf("storex %s %s %s", key, lifetime, value), false)
+}
+
+func (batch *Batch) Delete(key string) *Future {
+	return batch.add(key, "del "+key, true)
+}
+
+// Flush sends the queued operations, and waits for the results of every
+// operation sent so far.
+func (batch *Batch) Flush(ctx context.Context) error {
+	batch.mutex.Lock()
+	batch.dispatch()
+	batch.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		batch.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close flushes the queued operations and stops the batch. Operations
+// queued afterwards fail with ErrBatchClosed.
+func (batch *Batch) Close(ctx context.Context) error {
+	batch.mutex.Lock()
+	if !batch.closed {
+		batch.closed = true
+		close(batch.stop)
+	}
+	batch.mutex.Unlock()
+
+	return batch.Flush(ctx)
+}
+
+func (batch *Batch) startFlushRoutine(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				batch.mutex.Lock()
+				batch.dispatch()
+				batch.mutex.Unlock()
+			case <-batch.stop:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (batch *Batch) add(key, request string, idempotent bool) *Future {
+	future := &Future{Key: key, done: make(chan struct{})}
+
+	if strings.ContainsAny(key, " \n") || strings.Contains(request, "\n") {
+		future.resolve("", errors.New(fmt.Sprintf("invalid operation on key %q: keys can not contain spaces nor new lines, values can not contain new lines", key)))
+		return future
+	}
+
+	// waiting for room without the lock, for the pipelines to make some
+	batch.room <- struct{}{}
+
+	batch.mutex.Lock()
+	defer batch.mutex.Unlock()
+
+	if batch.closed {
+		<-batch.room
+		future.resolve("", ErrBatchClosed)
+		return future
+	}
+
+	batch.queue = append(batch.queue, &operation{request: request, idempotent: idempotent, future: future})
+
+	if len(batch.queue) >= batch.config.MaxSize {
+		batch.dispatch()
+	}
+
+	return future
+}
+
+// dispatch hands the queued operations to the senders of their node,
+// starting the ones that are not running. It must be called with the lock
+// held, which keeps the operations in order.
+func (batch *Batch) dispatch() {
+	for _, op := range batch.queue {
+		address := batch.client.owner(op.future.Key)
+
+		pending, sending := batch.pending[address]
+		batch.pending[address] = append(pending, op)
+
+		if !sending {
+			batch.inFlight.Add(1)
+			go batch.send(address)
+		}
+	}
+
+	batch.queue = nil
+}
+
+// send pipelines the operations pending for a node, until there are none
+// left. Pipelines are sent one after the other, for the operations on the
+// same key not to overtake each other.
+func (batch *Batch) send(address string) {
+	defer batch.inFlight.Done()
+
+	for {
+		batch.mutex.Lock()
+		ops := batch.pending[address]
+		if len(ops) == 0 {
+			delete(batch.pending, address)
+			batch.mutex.Unlock()
+			return
+		}
+		// still present while sending, for dispatch to know
+		batch.pending[address] = nil
+		batch.mutex.Unlock()
+
+		<-batch.slots
+		batch.pipeline(address, ops)
+		batch.slots <- struct{}{}
+
+		for range ops {
+			<-batch.room
+		}
+	}
+}
+
+// pipeline writes the requests of the given operations on a single
+// connection, while reading their results.
+func (batch *Batch) pipeline(address string, ops []*operation) {
+	client := batch.client.client
+
+	ctx, cancel := client.withTimeout(context.Background())
+	defer cancel()
+
+	conn, err := client.connect(ctx, address)
+	if err != nil {
+		// nothing was sent: the owner might have changed
+		batch.fallback(ops)
+		return
+	}
+
+	// nodes closing the connections after a request can not be sent
+	// pipelines
+	if !conn.keepAlive {
+		client.release(conn, false)
+		batch.fallback(ops)
+		return
+	}
+
+	conn.stopWatching = watchContext(ctx, conn)
+
+	// the results are read while the requests are being written, or both
+	// sides could end up blocked on full buffers
+	written := make(chan error, 1)
+	go func() {
+		writer := bufio.NewWriter(conn)
+		for _, op := range ops {
+			if _, err := writer.WriteString(op.request + "\n"); err != nil {
+				written <- err
+				return
+			}
+		}
+
+		written <- writer.Flush()
+	}()
+
+	var stale []*operation
+	var failure error
+
+	for i, op := range ops {
+		result, err := client.parseResult(conn.reader)
+
+		// a reused connection might have been closed by the server while
+		// idle, in which case none of the requests was executed
+		if i == 0 && conn.reused && errors.Cause(err) == io.EOF {
+			conn.stopWatching()
+			client.release(conn, false)
+			<-written
+			batch.fallback(ops)
+			return
+		}
+
+		if _, isServerErr := err.(*ServerError); err != nil && !isServerErr {
+			failure = errors.Wrap(err, fmt.Sprintf("could not read the result of the operation on key %q", op.future.Key))
+			for _, op := range ops[i:] {
+				op.future.resolve("", failure)
+			}
+			break
+		}
+
+		if err != nil && staleTopology(err) {
+			stale = append(stale, op)
+			continue
+		}
+
+		op.future.resolve(result, err)
+	}
+
+	conn.stopWatching()
+
+	if failure == nil {
+		// every request was answered, hence written
+		<-written
+		client.release(conn, true)
+	} else {
+		// closing the connection unblocks the pending writes
+		client.release(conn, false)
+		<-written
+	}
+
+	if len(stale) != 0 {
+		batch.fallback(stale)
+	}
+}
+
+// fallback sends the given operations one by one, letting the client find
+// their owner.
+func (batch *Batch) fallback(ops []*operation) {
+	for _, op := range ops {
+		result, err := batch.client.exec(context.Background(), op.future.Key, op.request, op.idempotent)
+		op.future.resolve(result, err)
+	}
+}
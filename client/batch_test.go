@@ -0,0 +1,196 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeNode is a single node cluster, storing its values in memory.
+type fakeNode struct {
+	listener    net.Listener
+	connections int32
+
+	mutex  sync.Mutex
+	values map[string]string
+}
+
+func startFakeNode(t *testing.T) *fakeNode {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	node := &fakeNode{listener: listener, values: make(map[string]string)}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&node.connections, 1)
+
+			go node.serve(conn)
+		}
+	}()
+
+	return node
+}
+
+func (node *fakeNode) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	for {
+		request, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		result := node.execute(strings.Fields(request))
+		fmt.Fprintf(writer, "+%d\n%s", len(result), result)
+
+		if reader.Buffered() == 0 {
+			writer.Flush()
+		}
+	}
+}
+
+func (node *fakeNode) execute(fields []string) string {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	switch fields[0] {
+	case "cluster":
+		return node.listener.Addr().String() + " id=1"
+	case "store":
+		node.values[fields[1]] = strings.Join(fields[2:], " ")
+	case "del":
+		delete(node.values, fields[1])
+	case "fetch":
+		return node.values[fields[1]]
+	}
+
+	return ""
+}
+
+func TestOperationsAreSentInBatches(t *testing.T) {
+	node := startFakeNode(t)
+	defer node.listener.Close()
+
+	config := DefaultConfig()
+	config.Seeds = []string{node.listener.Addr().String()}
+	client, err := NewClusterClient(config)
+	require.NoError(t, err)
+	defer client.Close()
+
+	batchConfig := DefaultBatchConfig()
+	batchConfig.MaxSize = 100
+	batchConfig.FlushInterval = 0
+	batchConfig.MaxConcurrency = 2
+	batch := NewBatch(client, batchConfig)
+
+	var writes, reads []*Future
+	for i := 0; i < 1000; i++ {
+		writes = append(writes, batch.Set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value %d", i)))
+		reads = append(reads, batch.Get(fmt.Sprintf("key-%d", i)))
+	}
+	deleted := batch.Delete("key-0")
+
+	require.NoError(t, batch.Close(context.Background()))
+
+	for i := range writes {
+		_, err := writes[i].Wait(context.Background())
+		require.NoError(t, err)
+
+		value, err := reads[i].Wait(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("value %d", i), value, "Operations on the same key should be sent in order")
+	}
+
+	_, err = deleted.Wait(context.Background())
+	require.NoError(t, err)
+	require.Len(t, node.values, 999)
+
+	// one connection to discover the cluster, the other ones for the pipelines
+	require.True(t, atomic.LoadInt32(&node.connections) <= 1+int32(batchConfig.MaxConcurrency))
+}
+
+func TestOverwritesAreAppliedInOrder(t *testing.T) {
+	node := startFakeNode(t)
+	defer node.listener.Close()
+
+	config := DefaultConfig()
+	config.Seeds = []string{node.listener.Addr().String()}
+	client, err := NewClusterClient(config)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// many small pipelines, that could overtake each other
+	batchConfig := DefaultBatchConfig()
+	batchConfig.MaxSize = 5
+	batchConfig.FlushInterval = 0
+	batchConfig.MaxConcurrency = 8
+	batch := NewBatch(client, batchConfig)
+
+	for i := 0; i < 500; i++ {
+		batch.Set("some-key", fmt.Sprintf("value-%d", i))
+	}
+	last := batch.Get("some-key")
+
+	require.NoError(t, batch.Close(context.Background()))
+
+	value, err := last.Wait(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "value-499", value)
+}
+
+func TestBatchesCanBeFlushedPeriodically(t *testing.T) {
+	node := startFakeNode(t)
+	defer node.listener.Close()
+
+	config := DefaultConfig()
+	config.Seeds = []string{node.listener.Addr().String()}
+	client, err := NewClusterClient(config)
+	require.NoError(t, err)
+	defer client.Close()
+
+	batch := NewBatch(client, DefaultBatchConfig())
+	defer batch.Close(context.Background())
+
+	// waiting without flushing
+	_, err = batch.Set("some-key", "some-value").Wait(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "some-value", node.values["some-key"])
+}
+
+func TestInvalidOperationsAreRejected(t *testing.T) {
+	node := startFakeNode(t)
+	defer node.listener.Close()
+
+	config := DefaultConfig()
+	config.Seeds = []string{node.listener.Addr().String()}
+	client, err := NewClusterClient(config)
+	require.NoError(t, err)
+	defer client.Close()
+
+	batch := NewBatch(client, DefaultBatchConfig())
+
+	_, err = batch.Set("some-key", "some\nvalue").Wait(context.Background())
+	require.Error(t, err)
+
+	_, err = batch.Get("some key").Wait(context.Background())
+	require.Error(t, err)
+
+	require.NoError(t, batch.Close(context.Background()))
+
+	_, err = batch.Get("some-key").Wait(context.Background())
+	require.Equal(t, ErrBatchClosed, err)
+}
@@ -2,91 +2,495 @@ package client
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"github.com/pkg/errors"
 	"io"
+	"math/rand"
 	"net"
 	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	// ProtocolVersion is the latest version of the protocol spoken by the
+	// client.
+	ProtocolVersion = 1
+
+	// DefaultMaxResultSize is the size of the largest result read when none
+	// is configured.
+	DefaultMaxResultSize = 64 << 20
+
+	maxLengthDigits = 19
+)
+
+type Config struct {
+	// Seeds are the addresses ("host:port") of the nodes to send requests
+	// to. When one of them can not be reached, the next one is tried.
+	Seeds []string
+
+	DialTimeout time.Duration
+	// RequestTimeout bounds requests (retries included) whose context has
+	// no deadline. Zero means no timeout.
+	RequestTimeout time.Duration
+
+	Pool PoolConfig
+
+	// MaxResultSize is the size of the largest result read in memory.
+	// Streamed results are not limited.
+	MaxResultSize int
+
+	// idempotent requests are retried up to MaxRetries times, with an
+	// exponential and jittered backoff between two attempts
+	MaxRetries      int
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+
+	// TopologyRefreshInterval is how often a ClusterClient (or a NearCache)
+	// fetches the topology of the cluster. Zero disables periodic refreshes.
+	TopologyRefreshInterval time.Duration
+
+	// NearCacheSize is the maximum number of values kept by a NearCache
+	NearCacheSize int
+	// InvalidationTimeout is how long a NearCache waits for news of a node
+	// before considering that it lost the invalidations it pushes. It should
+	// be longer than the nodes' InvalidationHeartbeat.
+	InvalidationTimeout time.Duration
+}
+
 type Client struct {
+	// Host and Port are used by clients that were not created with
+	// NewClient: such clients open a connection per request, and neither
+	// time out nor retry.
 	Host string
 	Port int
+
+	config Config
+	pool   *pool
 }
 
-func (client Client) Get(key string) (string, error) {
-	result, err := client.Exec("fetch "+key)
+// ServerError is an error returned by the server in response to a request.
+type ServerError struct {
+	Message string
+}
+
+func (err *ServerError) Error() string {
+	return err.Message
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Seeds: []string{"127.0.0.1:4224"},
+
+		DialTimeout:    time.Second,
+		RequestTimeout: 5 * time.Second,
+
+		Pool: PoolConfig{
+			MaxIdle:     8,
+			MaxActive:   64,
+			IdleTimeout: 30 * time.Second,
+		},
+
+		MaxResultSize: DefaultMaxResultSize,
+
+		MaxRetries:      2,
+		RetryBackoff:    20 * time.Millisecond,
+		MaxRetryBackoff: time.Second,
+
+		TopologyRefreshInterval: 30 * time.Second,
+
+		NearCacheSize:       10000,
+		InvalidationTimeout: 15 * time.Second,
+	}
+}
+
+func NewClient(config Config) *Client {
+	return &Client{
+		config: config,
+		pool:   newPool(config.Pool, config.DialTimeout),
+	}
+}
+
+// ServerInfo is what the server tells about the cluster during the hello
+// handshake.
+type ServerInfo struct {
+	// Version of the protocol to use
+	Version int
+	// Features supported by every node of the cluster
+	Features []string
+}
+
+// Hello negotiates the version of the protocol with the server, and asks
+// which features the cluster supports.
+func (client Client) Hello() (ServerInfo, error) {
+	var info ServerInfo
+
+	result, err := client.exec(context.Background(), fmt.Sprintf("hello %d", ProtocolVersion), true)
 	if err != nil {
-		return "", err
+		return info, err
+	}
+
+	for _, field := range strings.Fields(result) {
+		name, value := field, ""
+		if separator := strings.Index(field, "="); separator != -1 {
+			name, value = field[:separator], field[separator+1:]
+		}
+
+		switch name {
+		case "version":
+			if info.Version, err = strconv.Atoi(value); err != nil {
+				return info, errors.Wrap(err, "invalid protocol version")
+			}
+		case "features":
+			if value != "" {
+				info.Features = strings.Split(value, ",")
+			}
+		}
 	}
 
-	return result, nil
+	return info, nil
+}
+
+// Supports tells if every node of the cluster supports the given feature.
+func (info ServerInfo) Supports(feature string) bool {
+	for _, candidate := range info.Features {
+		if candidate == feature {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (client Client) Get(key string) (string, error) {
+	return client.GetContext(context.Background(), key)
+}
+
+func (client Client) GetContext(ctx context.Context, key string) (string, error) {
+	return client.exec(ctx, "fetch "+key, true)
 }
 
 func (client Client) Set(key, value string) error {
-	_, err := client.Exec(fmt.Sprintf("store %s %s", key, value))
+	return client.SetContext(context.Background(), key, value)
+}
+
+func (client Client) SetContext(ctx context.Context, key, value string) error {
+	_, err := client.exec(ctx, fmt.Sprintf("store %s %s", key, value), false)
 
 	return err
 }
 
 func (client Client) SetWithTTL(key, value string, lifetime time.Duration) error {
-	_, err := client.Exec(fmt.Sprintf("storex %s %s %s", key, lifetime, value))
+	return client.SetWithTTLContext(context.Background(), key, value, lifetime)
+}
+
+func (client Client) SetWithTTLContext(ctx context.Context, key, value string, lifetime time.Duration) error {
+	_, err := client.exec(ctx, fmt.Sprintf("storex %s %s %s", key, lifetime, value), false)
 
 	return err
 }
 
 func (client Client) Delete(key string) error {
-	_, err := client.Exec("del "+key)
+	return client.DeleteContext(context.Background(), key)
+}
+
+func (client Client) DeleteContext(ctx context.Context, key string) error {
+	_, err := client.exec(ctx, "del "+key, true)
 
 	return err
 }
 
 func (client Client) Exec(request string) (string, error) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", client.Host, client.Port))
-	if err != nil {
-		return "", err
+	return client.ExecContext(context.Background(), request)
+}
+
+// ExecContext sends a raw request. As nothing is known about it, it is
+// never retried.
+func (client Client) ExecContext(ctx context.Context, request string) (string, error) {
+	return client.exec(ctx, request, false)
+}
+
+// Close closes the pooled connections.
+func (client Client) Close() {
+	if client.pool != nil {
+		client.pool.Close()
 	}
-	defer conn.Close()
+}
 
-	_, err = fmt.Fprintf(conn, "%s\n", request)
-	if err != nil {
-		return "", err
+func (client Client) seeds() []string {
+	if len(client.config.Seeds) != 0 {
+		return client.config.Seeds
 	}
 
-	return client.parseResult(conn)
+	return []string{net.JoinHostPort(client.Host, strconv.Itoa(client.Port))}
 }
 
-func (client Client) parseResult(resultReader io.Reader) (string, error) {
-	reader := bufio.NewReader(resultReader)
-	status, err := reader.ReadByte()
-	if err != nil {
-		return "", errors.Wrap(err, "could not parse result status")
+func (client Client) exec(ctx context.Context, request string, idempotent bool) (string, error) {
+	return client.execOn(ctx, client.seeds(), request, idempotent)
+}
+
+// execOn sends a request to the first of the given addresses that answers,
+// and returns its result.
+func (client Client) execOn(ctx context.Context, addresses []string, request string, idempotent bool) (string, error) {
+	ctx, cancel := client.withTimeout(ctx)
+	defer cancel()
+
+	var result string
+
+	err := client.roundTrip(ctx, addresses, request, idempotent, func(conn *conn) (bool, error) {
+		var err error
+		result, err = client.parseResult(conn.reader)
+
+		return false, err
+	})
+
+	return result, err
+}
+
+// withTimeout applies the request timeout to contexts without deadline.
+func (client Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, hasDeadline := ctx.Deadline(); hasDeadline || client.config.RequestTimeout == 0 {
+		return ctx, func() {}
 	}
 
-	messageLength, err := reader.ReadBytes('\n')
+	return context.WithTimeout(ctx, client.config.RequestTimeout)
+}
+
+// responseHandler reads the response to a request. It returns true if it
+// took ownership of the connection, in which case it has to release it.
+type responseHandler func(conn *conn) (bool, error)
+
+// roundTrip sends a request to the first of the given addresses that
+// answers. Idempotent requests are retried, the other ones are only sent to
+// another address if they could not be sent at all.
+func (client Client) roundTrip(ctx context.Context, addresses []string, request string, idempotent bool, handler responseHandler) error {
+	attempts := 1
+	if idempotent {
+		attempts += client.config.MaxRetries
+	}
+
+	backoff := client.config.RetryBackoff
+	var err error
+
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt != 0 {
+			if err := sleep(ctx, jitter(backoff)); err != nil {
+				return err
+			}
+
+			backoff *= 2
+			if client.config.MaxRetryBackoff != 0 && backoff > client.config.MaxRetryBackoff {
+				backoff = client.config.MaxRetryBackoff
+			}
+		}
+
+		for _, address := range addresses {
+			var sent bool
+
+			sent, err = client.send(ctx, address, request, handler)
+			if err == nil {
+				return nil
+			}
+
+			if _, isServerErr := err.(*ServerError); isServerErr {
+				return err
+			}
+
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			// the request might have been executed
+			if sent && !idempotent {
+				return err
+			}
+		}
+	}
+
+	return err
+}
+
+// send sends a request to the given address and hands the connection to the
+// handler to read the response. It also tells if the request could have
+// reached the server.
+func (client Client) send(ctx context.Context, address, request string, handler responseHandler) (bool, error) {
+	for {
+		conn, err := client.connect(ctx, address)
+		if err != nil {
+			return false, err
+		}
+
+		conn.stopWatching = watchContext(ctx, conn)
+
+		owned := false
+		_, err = io.WriteString(conn, request+"\n")
+		if err == nil {
+			owned, err = handler(conn)
+		}
+
+		if owned {
+			return true, err
+		}
+
+		conn.stopWatching()
+
+		_, isServerErr := err.(*ServerError)
+		client.release(conn, err == nil || isServerErr)
+
+		// a reused connection might have been closed by the server while
+		// idle, in which case the request was not executed: it can be sent
+		// again on another connection
+		if conn.reused && err != nil && errors.Cause(err) == io.EOF && ctx.Err() == nil {
+			continue
+		}
+
+		return true, err
+	}
+}
+
+func (client Client) connect(ctx context.Context, address string) (*conn, error) {
+	if client.pool != nil {
+		return client.pool.get(ctx, address)
+	}
+
+	dialer := net.Dialer{Timeout: client.config.DialTimeout}
+
+	netConn, err := dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
-		return "", errors.Wrap(err, "could not parse message length")
+		return nil, err
+	}
+
+	return &conn{Conn: netConn, reader: bufio.NewReader(netConn)}, nil
+}
+
+func (client Client) release(conn *conn, healthy bool) {
+	if client.pool != nil {
+		client.pool.put(conn, healthy)
+		return
+	}
+
+	conn.Close()
+}
+
+// watchContext makes the I/O on the connection honor the deadline and the
+// cancellation of the context, until the returned function is called.
+func watchContext(ctx context.Context, conn net.Conn) func() {
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+
+	go func() {
+		defer close(exited)
+
+		select {
+		case <-ctx.Done():
+			// unblocks the pending reads and writes
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// jitter returns a random duration between half and all of the given one.
+func jitter(backoff time.Duration) time.Duration {
+	if backoff <= 0 {
+		return 0
 	}
 
-	length, err := strconv.Atoi(string(messageLength[:len(messageLength)-1]))
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+func sleep(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (client Client) maxResultSize() int {
+	if client.config.MaxResultSize != 0 {
+		return client.config.MaxResultSize
+	}
+
+	return DefaultMaxResultSize
+}
+
+// parseResult reads a whole result. Results larger than the maximum size are
+// rejected before being read.
+func (client Client) parseResult(reader *bufio.Reader) (string, error) {
+	success, length, err := readHeader(reader)
 	if err != nil {
-		return "", errors.Wrap(err, "expected message length to be an int")
+		return "", err
+	}
+
+	if length > client.maxResultSize() {
+		return "", errors.New(fmt.Sprintf("result of %d bytes exceeds the maximum size of %d bytes", length, client.maxResultSize()))
 	}
 
 	buffer := make([]byte, length)
-	read, err := reader.Read(buffer)
+	if _, err := io.ReadFull(reader, buffer); err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("could not read %d bytes of result", length))
+	}
+
+	if !success {
+		return "", &ServerError{Message: string(buffer)}
+	}
+
+	return string(buffer), nil
+}
+
+// readHeader reads the header of a result ("+<length>\n" or "-<length>\n").
+func readHeader(reader *bufio.Reader) (bool, int, error) {
+	status, err := reader.ReadByte()
 	if err != nil {
-		return "", errors.Wrap(err, "error while reading result")
+		return false, 0, errors.Wrap(err, "could not parse result status")
 	}
 
-	if read < length {
-		return "", errors.Wrap(err, fmt.Sprintf("expected to read %d bytes from result, read %d", length, read))
+	if status != '+' && status != '-' {
+		return false, 0, errors.New(fmt.Sprintf("invalid result status %q", status))
 	}
 
-	if status == '+' {
-		return string(buffer), nil
-	} else {
-		return "", errors.New(string(buffer))
+	// the length of any result fits in a few bytes: do not let a broken
+	// server make us buffer an endless line
+	var lengthStr []byte
+	for {
+		char, err := reader.ReadByte()
+		if err != nil {
+			return false, 0, errors.Wrap(err, "could not parse message length")
+		}
+
+		if char == '\n' {
+			break
+		}
+
+		if len(lengthStr) == maxLengthDigits {
+			return false, 0, errors.New("message length is too long")
+		}
+
+		lengthStr = append(lengthStr, char)
 	}
-}
\ No newline at end of file
+
+	length, err := strconv.Atoi(string(lengthStr))
+	if err != nil || length < 0 {
+		return false, 0, errors.New(fmt.Sprintf("invalid message length %q", lengthStr))
+	}
+
+	return status == '+', length, nil
+}
@@ -0,0 +1,359 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func oneByteAtATime(input string) *bufio.Reader {
+	return bufio.NewReader(iotest.OneByteReader(strings.NewReader(input)))
+}
+
+func TestResultsAreFullyRead(t *testing.T) {
+	value := strings.Repeat("some-value", 100000)
+
+	result, err := Client{}.parseResult(oneByteAtATime(fmt.Sprintf("+%d\n%s", len(value), value)))
+
+	require.NoError(t, err)
+	require.Equal(t, value, result)
+}
+
+func TestErrorsAreFullyRead(t *testing.T) {
+	_, err := Client{}.parseResult(oneByteAtATime("-13\nkey not found"))
+
+	require.Error(t, err)
+	require.Equal(t, &ServerError{Message: "key not found"}, err)
+}
+
+func TestInvalidResultsAreRejected(t *testing.T) {
+	inputs := []string{
+		"",
+		"+",
+		"*3\nfoo",
+		"+abc\nfoo",
+		"+-1\n",
+		"+99999999999999999999999\nfoo",
+		"+10\ntruncated",
+		"-10\ntruncated",
+	}
+
+	for _, input := range inputs {
+		_, err := Client{}.parseResult(oneByteAtATime(input))
+
+		require.Error(t, err, "input: %q", input)
+
+		_, isServerErr := err.(*ServerError)
+		require.False(t, isServerErr, "invalid results are not server errors (input: %q)", input)
+	}
+}
+
+func TestResultsLargerThanTheLimitAreRejected(t *testing.T) {
+	client := Client{config: Config{MaxResultSize: 4}}
+
+	_, err := client.parseResult(oneByteAtATime("+5\nvalue"))
+	require.Error(t, err)
+
+	result, err := client.parseResult(oneByteAtATime("+4\nfour"))
+	require.NoError(t, err)
+	require.Equal(t, "four", result)
+}
+
+func TestValuesCanBeStreamed(t *testing.T) {
+	value := strings.Repeat("some-value", 100000)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	var connections int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&connections, 1)
+
+			go func() {
+				defer conn.Close()
+
+				reader := bufio.NewReader(conn)
+				for {
+					if _, err := reader.ReadString('\n'); err != nil {
+						return
+					}
+
+					fmt.Fprintf(conn, "+%d\n%s", len(value), value)
+				}
+			}()
+		}
+	}()
+
+	config := DefaultConfig()
+	config.Seeds = []string{listener.Addr().String()}
+	client := NewClient(config)
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		stream, err := client.GetStream(context.Background(), "some-key")
+		require.NoError(t, err)
+
+		streamed, err := ioutil.ReadAll(stream)
+		require.NoError(t, err)
+		require.Equal(t, value, string(streamed))
+		require.NoError(t, stream.Close())
+	}
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&connections), "Fully read streams should give their connection back")
+
+	// streams that are not fully read can not give their connection back
+	stream, err := client.GetStream(context.Background(), "some-key")
+	require.NoError(t, err)
+	require.NoError(t, stream.Close())
+
+	result, err := client.Get("some-key")
+	require.NoError(t, err)
+	require.Equal(t, value, result)
+	require.Equal(t, int32(2), atomic.LoadInt32(&connections))
+}
+
+const (
+	helloResult    = "version=1 features="
+	unknownCommand = "Unknown command"
+)
+
+// fakeServer answers the requests with its handler, which gets the number of
+// the request. Connections are closed without answer when it returns false,
+// and after each answer when hangUp is set. Legacy servers reject hellos, and
+// hang up after each answer.
+type fakeServer struct {
+	listener    net.Listener
+	connections int32
+	requests    int32
+	hangUp      bool
+	legacy      bool
+
+	handler func(n int32, request string) (string, bool)
+}
+
+func startFakeServer(t *testing.T, handler func(n int32, request string) (string, bool)) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &fakeServer{listener: listener, handler: handler}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&server.connections, 1)
+
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (server *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for {
+		request, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		request = strings.TrimSpace(request)
+
+		if strings.HasPrefix(request, "hello ") {
+			if server.legacy {
+				fmt.Fprintf(conn, "-%d\n%s", len(unknownCommand), unknownCommand)
+				return
+			}
+
+			fmt.Fprintf(conn, "+%d\n%s", len(helloResult), helloResult)
+			continue
+		}
+
+		result, ok := server.handler(atomic.AddInt32(&server.requests, 1), request)
+		if !ok {
+			return
+		}
+
+		fmt.Fprintf(conn, "+%d\n%s", len(result), result)
+
+		if server.hangUp || server.legacy {
+			return
+		}
+	}
+}
+
+func (server *fakeServer) client(config Config) *Client {
+	config.Seeds = append(config.Seeds, server.listener.Addr().String())
+
+	return NewClient(config)
+}
+
+func echo(n int32, request string) (string, bool) {
+	return request, true
+}
+
+func TestRequestsHonorTheDeadlineOfTheirContext(t *testing.T) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	server := startFakeServer(t, func(n int32, request string) (string, bool) {
+		<-unblock
+		return "", true
+	})
+	defer server.listener.Close()
+
+	config := DefaultConfig()
+	config.Seeds = nil
+	client := server.client(config)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := client.GetContext(ctx, "some-key")
+
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.True(t, time.Since(start) < time.Second, "The request should not outlive its context")
+}
+
+func TestRequestsCanBeCancelled(t *testing.T) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	server := startFakeServer(t, func(n int32, request string) (string, bool) {
+		<-unblock
+		return "", true
+	})
+	defer server.listener.Close()
+
+	config := DefaultConfig()
+	config.Seeds = nil
+	client := server.client(config)
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, err := client.GetContext(ctx, "some-key")
+
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestTheRequestTimeoutAppliesWithoutDeadline(t *testing.T) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	server := startFakeServer(t, func(n int32, request string) (string, bool) {
+		<-unblock
+		return "", true
+	})
+	defer server.listener.Close()
+
+	config := DefaultConfig()
+	config.Seeds = nil
+	config.RequestTimeout = 50 * time.Millisecond
+	client := server.client(config)
+	defer client.Close()
+
+	_, err := client.Get("some-key")
+
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestIdempotentRequestsAreRetried(t *testing.T) {
+	// the first two requests are dropped
+	server := startFakeServer(t, func(n int32, request string) (string, bool) {
+		return request, n > 2
+	})
+	defer server.listener.Close()
+
+	config := DefaultConfig()
+	config.Seeds = nil
+	config.MaxRetries = 2
+	config.RetryBackoff = 20 * time.Millisecond
+	client := server.client(config)
+	defer client.Close()
+
+	start := time.Now()
+	result, err := client.Get("some-key")
+
+	require.NoError(t, err)
+	require.Equal(t, "fetch some-key", result)
+	require.Equal(t, int32(3), atomic.LoadInt32(&server.requests))
+	// at least half of each backoff: 10ms, then 20ms
+	require.True(t, time.Since(start) >= 30*time.Millisecond, "Retries should back off")
+}
+
+func TestOtherRequestsAreNotRetriedOnceSent(t *testing.T) {
+	server := startFakeServer(t, func(n int32, request string) (string, bool) {
+		return "", false
+	})
+	defer server.listener.Close()
+
+	config := DefaultConfig()
+	config.Seeds = nil
+	client := server.client(config)
+	defer client.Close()
+
+	require.Error(t, client.Set("some-key", "some-value"))
+	require.Equal(t, int32(1), atomic.LoadInt32(&server.requests), "The request might have been executed")
+}
+
+func TestBackoffsAreJittered(t *testing.T) {
+	backoff := 100 * time.Millisecond
+	seen := make(map[time.Duration]bool)
+
+	for i := 0; i < 1000; i++ {
+		jittered := jitter(backoff)
+
+		require.True(t, jittered >= backoff/2 && jittered <= backoff, "jittered backoff: %s", jittered)
+		seen[jittered] = true
+	}
+
+	require.True(t, len(seen) > 1, "Backoffs should be randomized")
+	require.Zero(t, jitter(0))
+}
+
+func TestUnreachableSeedsAreSkipped(t *testing.T) {
+	server := startFakeServer(t, echo)
+	defer server.listener.Close()
+
+	// nothing listens there anymore
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed.Close()
+
+	config := DefaultConfig()
+	config.Seeds = []string{closed.Addr().String()}
+	client := server.client(config)
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		result, err := client.Get("some-key")
+		require.NoError(t, err)
+		require.Equal(t, "fetch some-key", result)
+	}
+
+	// even non-idempotent requests, as they were not sent
+	require.NoError(t, client.Set("some-key", "some-value"))
+}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/K-Phoen/gostore"
+	"github.com/pkg/errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClusterClient is a cluster-aware client: it knows the topology of the
+// cluster and sends each command straight to the node owning its key,
+// instead of letting a node relay it.
+type ClusterClient struct {
+	client *Client
+
+	mutex  sync.RWMutex
+	router *gostore.Router
+	nodes  []gostore.Node
+
+	stop chan struct{}
+}
+
+// NewClusterClient discovers the cluster from the seeds of the given
+// configuration.
+func NewClusterClient(config Config) (*ClusterClient, error) {
+	client := &ClusterClient{
+		client: NewClient(config),
+		stop:   make(chan struct{}),
+	}
+
+	if err := client.Refresh(); err != nil {
+		client.client.Close()
+		return nil, err
+	}
+
+	if config.TopologyRefreshInterval != 0 {
+		client.startRefreshRoutine(config.TopologyRefreshInterval)
+	}
+
+	return client, nil
+}
+
+func (client *ClusterClient) Get(key string) (string, error) {
+	return client.GetContext(context.Background(), key)
+}
+
+func (client *ClusterClient) GetContext(ctx context.Context, key string) (string, error) {
+	return client.exec(ctx, key, "fetch "+key, true)
+}
+
+func (client *ClusterClient) Set(key, value string) error {
+	return client.SetContext(context.Background(), key, value)
+}
+
+func (client *ClusterClient) SetContext(ctx context.Context, key, value string) error {
+	_, err := client.exec(ctx, key, fmt.Sprintf("store %s %s", key, value), false)
+
+	return err
+}
+
+func (client *ClusterClient) SetWithTTL(key, value string, lifetime time.Duration) error {
+	return client.SetWithTTLContext(context.Background(), key, value, lifetime)
+}
+
+func (client *ClusterClient) SetWithTTLContext(ctx context.Context, key, value string, lifetime time.Duration) error {
+	_, err := client.exec(ctx, key, fmt.Sprintf("storex %s %s %s", key, lifetime, value), false)
+
+	return err
+}
+
+func (client *ClusterClient) Delete(key string) error {
+	return client.DeleteContext(context.Background(), key)
+}
+
+func (client *ClusterClient) DeleteContext(ctx context.Context, key string) error {
+	_, err := client.exec(ctx, key, "del "+key, true)
+
+	return err
+}
+
+// Nodes returns the members of the cluster, as last fetched.
+func (client *ClusterClient) Nodes() []gostore.Node {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+
+	return client.nodes
+}
+
+// Refresh fetches the topology of the cluster from one of the known nodes,
+// or from the seeds if none of them answers.
+func (client *ClusterClient) Refresh() error {
+	var addresses []string
+	for _, node := range client.Nodes() {
+		addresses = append(addresses, node.Address())
+	}
+	addresses = append(addresses, client.client.seeds()...)
+
+	list, err := client.client.execOn(context.Background(), addresses, "cluster nodes", true)
+	if err != nil {
+		return errors.Wrap(err, "could not fetch the topology of the cluster")
+	}
+
+	nodes, err := gostore.ParseNodeList(list)
+	if err != nil {
+		return errors.Wrap(err, "could not fetch the topology of the cluster")
+	}
+
+	if len(nodes) == 0 {
+		return errors.New("could not fetch the topology of the cluster: no members")
+	}
+
+	router := gostore.NewRouter()
+	for _, node := range nodes {
+		router.AddNode(node)
+	}
+
+	client.mutex.Lock()
+	client.router = &router
+	client.nodes = nodes
+	client.mutex.Unlock()
+
+	return nil
+}
+
+// Close stops refreshing the topology and closes the pooled connections.
+func (client *ClusterClient) Close() {
+	close(client.stop)
+	client.client.Close()
+}
+
+func (client *ClusterClient) startRefreshRoutine(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				client.Refresh()
+			case <-client.stop:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// exec sends a request to the node owning the given key. When the topology
+// we know is outdated, it is refreshed and the request is sent once more.
+func (client *ClusterClient) exec(ctx context.Context, key, request string, idempotent bool) (string, error) {
+	result, err := client.client.execOn(ctx, []string{client.owner(key)}, request, idempotent)
+	if err == nil || !staleTopology(err) {
+		return result, err
+	}
+
+	if refreshErr := client.Refresh(); refreshErr != nil {
+		return "", err
+	}
+
+	return client.client.execOn(ctx, []string{client.owner(key)}, request, idempotent)
+}
+
+func (client *ClusterClient) owner(key string) string {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+
+	return client.router.ResponsibleNode(key).Address()
+}
+
+// staleTopology tells if an error means that the topology we know is
+// outdated: the owner we computed is gone, or disagrees with us.
+func staleTopology(err error) bool {
+	if _, isNetErr := errors.Cause(err).(net.Error); isNetErr {
+		return true
+	}
+
+	return strings.HasPrefix(err.Error(), gostore.TopologyChangedMessage)
+}
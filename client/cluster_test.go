@@ -0,0 +1,280 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/K-Phoen/gostore"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCluster is made of nodes sharing a topology, which they use to reject
+// the requests for keys they do not own like real nodes do.
+type fakeCluster struct {
+	mutex sync.Mutex
+	nodes []*fakeMember
+	// number of nodes of the topology, which can be changed
+	size int
+}
+
+type fakeMember struct {
+	cluster  *fakeCluster
+	id       string
+	listener net.Listener
+
+	values   map[string]string
+	requests int
+}
+
+func startFakeCluster(t *testing.T, nodes int) *fakeCluster {
+	cluster := &fakeCluster{size: nodes}
+
+	for i := 0; i < nodes; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		member := &fakeMember{
+			cluster:  cluster,
+			id:       fmt.Sprintf("node-%d", i),
+			listener: listener,
+			values:   make(map[string]string),
+		}
+		cluster.nodes = append(cluster.nodes, member)
+
+		go member.accept()
+	}
+
+	return cluster
+}
+
+func (cluster *fakeCluster) Close() {
+	for _, member := range cluster.nodes {
+		member.listener.Close()
+	}
+}
+
+func (cluster *fakeCluster) resize(size int) {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+
+	cluster.size = size
+}
+
+// topology lists the first nodes of the cluster. It must be called with the
+// lock held.
+func (cluster *fakeCluster) topology(size int) string {
+	var list strings.Builder
+	for _, member := range cluster.nodes[:size] {
+		fmt.Fprintf(&list, "%s id=%s state=active\n", member.listener.Addr(), member.id)
+	}
+
+	return list.String()
+}
+
+// owner returns the member owning a key in a topology of the given size.
+func (cluster *fakeCluster) owner(t *testing.T, key string, size int) *fakeMember {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+
+	owner, err := cluster.ownerIn(key, size)
+	require.NoError(t, err)
+
+	return owner
+}
+
+// ownerIn must be called with the lock held.
+func (cluster *fakeCluster) ownerIn(key string, size int) (*fakeMember, error) {
+	nodes, err := gostore.ParseNodeList(cluster.topology(size))
+	if err != nil {
+		return nil, err
+	}
+
+	router := gostore.NewRouter()
+	for _, node := range nodes {
+		router.AddNode(node)
+	}
+
+	return cluster.member(router.ResponsibleNode(key).ID()), nil
+}
+
+// member must be called with the lock held.
+func (cluster *fakeCluster) member(id string) *fakeMember {
+	for _, member := range cluster.nodes {
+		if member.id == id {
+			return member
+		}
+	}
+
+	return nil
+}
+
+func (member *fakeMember) value(key string) (string, bool) {
+	member.cluster.mutex.Lock()
+	defer member.cluster.mutex.Unlock()
+
+	value, exists := member.values[key]
+
+	return value, exists
+}
+
+func (member *fakeMember) stats() (keys int, requests int) {
+	member.cluster.mutex.Lock()
+	defer member.cluster.mutex.Unlock()
+
+	return len(member.values), member.requests
+}
+
+func (member *fakeMember) accept() {
+	for {
+		conn, err := member.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go member.serve(conn)
+	}
+}
+
+func (member *fakeMember) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		request, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		result, failed := member.execute(strings.Fields(request))
+		if failed {
+			fmt.Fprintf(conn, "-%d\n%s", len(result), result)
+		} else {
+			fmt.Fprintf(conn, "+%d\n%s", len(result), result)
+		}
+	}
+}
+
+func (member *fakeMember) execute(fields []string) (string, bool) {
+	cluster := member.cluster
+
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+
+	switch fields[0] {
+	case "hello":
+		return helloResult, false
+	case "cluster":
+		return cluster.topology(cluster.size), false
+	}
+
+	member.requests++
+
+	if owner, err := cluster.ownerIn(fields[1], cluster.size); err != nil || owner != member {
+		return gostore.TopologyChangedMessage, true
+	}
+
+	switch fields[0] {
+	case "store":
+		member.values[fields[1]] = strings.Join(fields[2:], " ")
+	case "del":
+		delete(member.values, fields[1])
+	case "fetch":
+		return member.values[fields[1]], false
+	}
+
+	return "", false
+}
+
+func newTestClusterClient(t *testing.T, cluster *fakeCluster, refreshInterval time.Duration) *ClusterClient {
+	config := DefaultConfig()
+	config.Seeds = []string{cluster.nodes[0].listener.Addr().String()}
+	config.TopologyRefreshInterval = refreshInterval
+
+	client, err := NewClusterClient(config)
+	require.NoError(t, err)
+
+	return client
+}
+
+func TestCommandsAreSentToTheOwnerOfTheirKey(t *testing.T) {
+	cluster := startFakeCluster(t, 3)
+	defer cluster.Close()
+
+	client := newTestClusterClient(t, cluster, 0)
+	defer client.Close()
+
+	require.Len(t, client.Nodes(), 3)
+
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("some-key-%d", i)
+
+		require.NoError(t, client.Set(key, "some-value"))
+
+		value, err := client.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, "some-value", value)
+
+		_, stored := cluster.owner(t, key, 3).value(key)
+		require.True(t, stored, "The key should be stored by its owner")
+	}
+
+	for _, member := range cluster.nodes {
+		keys, requests := member.stats()
+		require.Equal(t, 2*keys, requests, "Nodes should only be sent the requests for their keys")
+	}
+}
+
+func TestTheTopologyIsRefreshedPeriodically(t *testing.T) {
+	cluster := startFakeCluster(t, 3)
+	defer cluster.Close()
+	cluster.resize(2)
+
+	client := newTestClusterClient(t, cluster, 10*time.Millisecond)
+	defer client.Close()
+
+	require.Len(t, client.Nodes(), 2)
+
+	cluster.resize(3)
+
+	for i := 0; i < 100 && len(client.Nodes()) != 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.Len(t, client.Nodes(), 3, "A new node should be discovered")
+}
+
+func TestRequestsRejectedByFormerOwnersAreRedirected(t *testing.T) {
+	cluster := startFakeCluster(t, 3)
+	defer cluster.Close()
+	cluster.resize(2)
+
+	client := newTestClusterClient(t, cluster, 0)
+	defer client.Close()
+
+	// a key that moves to the new node
+	var key string
+	for i := 0; key == ""; i++ {
+		candidate := fmt.Sprintf("some-key-%d", i)
+		if cluster.owner(t, candidate, 3) == cluster.nodes[2] {
+			key = candidate
+		}
+	}
+
+	cluster.resize(3)
+
+	require.NoError(t, client.Set(key, "some-value"))
+	require.Len(t, client.Nodes(), 3, "The topology should be refreshed")
+	value, _ := cluster.nodes[2].value(key)
+	require.Equal(t, "some-value", value, "The request should be sent to the new owner")
+
+	former := cluster.owner(t, key, 2)
+	_, requests := former.stats()
+	require.Equal(t, 1, requests, "The former owner should have rejected the request")
+	_, stored := former.value(key)
+	require.False(t, stored)
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// Codec converts typed values to what is stored, and back.
+type Codec[T any] interface {
+	Encode(value T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// JSONCodec stores values as JSON documents.
+type JSONCodec[T any] struct{}
+
+func (codec JSONCodec[T]) Encode(value T) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (codec JSONCodec[T]) Decode(data []byte) (T, error) {
+	var value T
+	err := json.Unmarshal(data, &value)
+
+	return value, err
+}
+
+// GobCodec stores values encoded with gob. As the protocol is line-based,
+// the encoded values are base64-encoded.
+type GobCodec[T any] struct{}
+
+func (codec GobCodec[T]) Encode(value T) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(value); err != nil {
+		return nil, err
+	}
+
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(buffer.Len()))
+	base64.StdEncoding.Encode(encoded, buffer.Bytes())
+
+	return encoded, nil
+}
+
+func (codec GobCodec[T]) Decode(data []byte) (T, error) {
+	var value T
+
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(decoded, data)
+	if err != nil {
+		return value, err
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(decoded[:n])).Decode(&value)
+
+	return value, err
+}
+
+// BytesCodec stores raw bytes, as-is. As the protocol is line-based, values
+// can not contain new lines.
+type BytesCodec struct{}
+
+func (codec BytesCodec) Encode(value []byte) ([]byte, error) {
+	return value, nil
+}
+
+func (codec BytesCodec) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
@@ -0,0 +1,407 @@
+package client
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"github.com/K-Phoen/gostore"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// resubscribeDelay is how long to wait before subscribing again to the
+// invalidations of a node, after losing them.
+const resubscribeDelay = time.Second
+
+// NearCacheStats is a snapshot of the activity of a near cache.
+type NearCacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Invalidations uint64
+	Evictions     uint64
+	// Flushes counts how many times the whole cache was dropped because
+	// invalidations might have been lost
+	Flushes uint64
+
+	Size int
+}
+
+// NearCache keeps the most recently read values in memory, in front of a
+// store. Every node of the cluster pushes the keys that change (written,
+// deleted or expired) over a long-lived connection, which keeps the cache
+// coherent: values are only served from memory while all the nodes are
+// known to push their invalidations.
+type NearCache struct {
+	// accessed atomically, kept first to be 64-bit aligned
+	hits          uint64
+	misses        uint64
+	invalidations uint64
+	evictions     uint64
+	flushes       uint64
+
+	store  Store
+	client *Client
+	config Config
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	// in-flight fetches: values fetched while their key changed are stale
+	fetches       map[string]*fetch
+	subscriptions map[string]*subscription
+
+	stop chan struct{}
+}
+
+type cacheEntry struct {
+	key   string
+	value string
+}
+
+type fetch struct {
+	waiters int
+	stale   bool
+}
+
+// subscription receives the invalidations of a node.
+type subscription struct {
+	address string
+
+	// set once the node acknowledged the subscription, guarded by the
+	// cache's mutex
+	ready bool
+	conn  net.Conn
+
+	stop chan struct{}
+}
+
+// NewNearCache puts a near cache in front of the given store. The nodes of
+// the cluster are discovered from the seeds of the configuration.
+func NewNearCache(store Store, config Config) (*NearCache, error) {
+	cache := &NearCache{
+		store:  store,
+		client: NewClient(config),
+		config: config,
+
+		entries:       make(map[string]*list.Element),
+		lru:           list.New(),
+		fetches:       make(map[string]*fetch),
+		subscriptions: make(map[string]*subscription),
+
+		stop: make(chan struct{}),
+	}
+
+	info, err := cache.client.Hello()
+	if err != nil {
+		cache.client.Close()
+		return nil, err
+	}
+
+	if !info.Supports("invalidations") {
+		cache.client.Close()
+		return nil, errors.New("the cluster does not push invalidations")
+	}
+
+	if err := cache.Refresh(); err != nil {
+		cache.client.Close()
+		return nil, err
+	}
+
+	if config.TopologyRefreshInterval != 0 {
+		cache.startRefreshRoutine(config.TopologyRefreshInterval)
+	}
+
+	return cache, nil
+}
+
+func (cache *NearCache) GetContext(ctx context.Context, key string) (string, error) {
+	cache.mutex.Lock()
+
+	if element, exists := cache.entries[key]; exists && cache.ready() {
+		cache.lru.MoveToFront(element)
+		cache.mutex.Unlock()
+		atomic.AddUint64(&cache.hits, 1)
+
+		return element.Value.(*cacheEntry).value, nil
+	}
+
+	pending, exists := cache.fetches[key]
+	if !exists {
+		pending = &fetch{}
+		cache.fetches[key] = pending
+	}
+	pending.waiters++
+
+	cache.mutex.Unlock()
+	atomic.AddUint64(&cache.misses, 1)
+
+	value, err := cache.store.GetContext(ctx, key)
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	pending.waiters--
+	if pending.waiters == 0 {
+		delete(cache.fetches, key)
+	}
+
+	// missing keys are fetched as empty values
+	if err == nil && value != "" && !pending.stale && cache.ready() {
+		cache.put(key, value)
+	}
+
+	return value, err
+}
+
+func (cache *NearCache) SetContext(ctx context.Context, key, value string) error {
+	err := cache.store.SetContext(ctx, key, value)
+	cache.invalidate(key)
+
+	return err
+}
+
+func (cache *NearCache) SetWithTTLContext(ctx context.Context, key, value string, lifetime time.Duration) error {
+	err := cache.store.SetWithTTLContext(ctx, key, value, lifetime)
+	cache.invalidate(key)
+
+	return err
+}
+
+func (cache *NearCache) DeleteContext(ctx context.Context, key string) error {
+	err := cache.store.DeleteContext(ctx, key)
+	cache.invalidate(key)
+
+	return err
+}
+
+func (cache *NearCache) Stats() NearCacheStats {
+	cache.mutex.Lock()
+	size := cache.lru.Len()
+	cache.mutex.Unlock()
+
+	return NearCacheStats{
+		Hits:          atomic.LoadUint64(&cache.hits),
+		Misses:        atomic.LoadUint64(&cache.misses),
+		Invalidations: atomic.LoadUint64(&cache.invalidations),
+		Evictions:     atomic.LoadUint64(&cache.evictions),
+		Flushes:       atomic.LoadUint64(&cache.flushes),
+		Size:          size,
+	}
+}
+
+// Refresh fetches the members of the cluster, and subscribes to the
+// invalidations of the ones it did not know about.
+func (cache *NearCache) Refresh() error {
+	list, err := cache.client.exec(context.Background(), "cluster nodes", true)
+	if err != nil {
+		return errors.Wrap(err, "could not fetch the topology of the cluster")
+	}
+
+	nodes, err := gostore.ParseNodeList(list)
+	if err != nil {
+		return errors.Wrap(err, "could not fetch the topology of the cluster")
+	}
+
+	members := make(map[string]bool)
+	for _, node := range nodes {
+		members[node.Address()] = true
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	for address, sub := range cache.subscriptions {
+		if !members[address] {
+			sub.close()
+			delete(cache.subscriptions, address)
+		}
+	}
+
+	for address := range members {
+		if _, exists := cache.subscriptions[address]; !exists {
+			sub := &subscription{address: address, stop: make(chan struct{})}
+			cache.subscriptions[address] = sub
+
+			go cache.subscribe(sub)
+		}
+	}
+
+	return nil
+}
+
+// Close stops the subscriptions and closes the pooled connections.
+func (cache *NearCache) Close() {
+	close(cache.stop)
+
+	cache.mutex.Lock()
+	for address, sub := range cache.subscriptions {
+		sub.close()
+		delete(cache.subscriptions, address)
+	}
+	cache.mutex.Unlock()
+
+	cache.client.Close()
+}
+
+func (cache *NearCache) startRefreshRoutine(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				cache.Refresh()
+			case <-cache.stop:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// subscribe receives the invalidations pushed by a node until the
+// subscription is closed, reconnecting when the connection is lost.
+func (cache *NearCache) subscribe(sub *subscription) {
+	for {
+		cache.receiveInvalidations(sub)
+
+		cache.mutex.Lock()
+		sub.ready = false
+		cache.mutex.Unlock()
+
+		select {
+		case <-sub.stop:
+			return
+		case <-time.After(resubscribeDelay):
+		}
+	}
+}
+
+// receiveInvalidations returns when the connection to the node is lost.
+func (cache *NearCache) receiveInvalidations(sub *subscription) {
+	conn, err := net.DialTimeout("tcp", sub.address, cache.config.DialTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	cache.mutex.Lock()
+	select {
+	case <-sub.stop:
+		cache.mutex.Unlock()
+		return
+	default:
+		sub.conn = conn
+	}
+	cache.mutex.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(cache.config.DialTimeout))
+	if _, err := io.WriteString(conn, "node invalidations\n"); err != nil {
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(cache.config.InvalidationTimeout))
+
+		key, err := cache.client.parseResult(reader)
+		if err != nil {
+			return
+		}
+
+		// the first result acknowledges the subscription, empty ones are
+		// heartbeats
+		cache.mutex.Lock()
+		if !sub.ready {
+			sub.ready = true
+			// whatever changed on the node while we were not listening to
+			// it is unknown
+			cache.flush()
+		}
+		cache.mutex.Unlock()
+
+		if key != "" {
+			cache.invalidate(key)
+		}
+	}
+}
+
+func (sub *subscription) close() {
+	close(sub.stop)
+
+	if sub.conn != nil {
+		sub.conn.Close()
+	}
+}
+
+func (cache *NearCache) invalidate(key string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if element, exists := cache.entries[key]; exists {
+		cache.lru.Remove(element)
+		delete(cache.entries, key)
+		atomic.AddUint64(&cache.invalidations, 1)
+	}
+
+	if pending, exists := cache.fetches[key]; exists {
+		pending.stale = true
+	}
+}
+
+// ready tells if every node pushes its invalidations. It must be called with
+// the lock held.
+func (cache *NearCache) ready() bool {
+	if len(cache.subscriptions) == 0 {
+		return false
+	}
+
+	for _, sub := range cache.subscriptions {
+		if !sub.ready {
+			return false
+		}
+	}
+
+	return true
+}
+
+// put must be called with the lock held.
+func (cache *NearCache) put(key, value string) {
+	if element, exists := cache.entries[key]; exists {
+		element.Value.(*cacheEntry).value = value
+		cache.lru.MoveToFront(element)
+		return
+	}
+
+	cache.entries[key] = cache.lru.PushFront(&cacheEntry{key: key, value: value})
+
+	for cache.lru.Len() > cache.config.NearCacheSize {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cacheEntry).key)
+		atomic.AddUint64(&cache.evictions, 1)
+	}
+}
+
+// flush must be called with the lock held.
+func (cache *NearCache) flush() {
+	for _, pending := range cache.fetches {
+		pending.stale = true
+	}
+
+	if cache.lru.Len() == 0 {
+		return
+	}
+
+	cache.entries = make(map[string]*list.Element)
+	cache.lru.Init()
+
+	atomic.AddUint64(&cache.flushes, 1)
+}
+
+var _ Store = &NearCache{}
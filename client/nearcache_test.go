@@ -0,0 +1,109 @@
+package client
+
+import (
+	"container/list"
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// subscribedCache builds a near cache whose node already pushes its
+// invalidations.
+func subscribedCache(store Store, size int) *NearCache {
+	config := DefaultConfig()
+	config.NearCacheSize = size
+
+	return &NearCache{
+		store:  store,
+		config: config,
+
+		entries:       make(map[string]*list.Element),
+		lru:           list.New(),
+		fetches:       make(map[string]*fetch),
+		subscriptions: map[string]*subscription{"node": {address: "node", ready: true}},
+
+		stop: make(chan struct{}),
+	}
+}
+
+func TestValuesAreServedFromTheNearCache(t *testing.T) {
+	ctx := context.Background()
+	store := memoryStore{"some-key": "some-value"}
+	cache := subscribedCache(store, 10)
+
+	value, err := cache.GetContext(ctx, "some-key")
+	require.NoError(t, err)
+	require.Equal(t, "some-value", value)
+
+	// changed behind the cache's back: served from memory
+	store["some-key"] = "other-value"
+
+	value, err = cache.GetContext(ctx, "some-key")
+	require.NoError(t, err)
+	require.Equal(t, "some-value", value)
+
+	cache.invalidate("some-key")
+
+	value, err = cache.GetContext(ctx, "some-key")
+	require.NoError(t, err)
+	require.Equal(t, "other-value", value)
+
+	require.Equal(t, NearCacheStats{Hits: 1, Misses: 2, Invalidations: 1, Size: 1}, cache.Stats())
+}
+
+func TestWritesInvalidateTheNearCache(t *testing.T) {
+	ctx := context.Background()
+	cache := subscribedCache(memoryStore{}, 10)
+
+	require.NoError(t, cache.SetContext(ctx, "some-key", "some-value"))
+	_, err := cache.GetContext(ctx, "some-key")
+	require.NoError(t, err)
+
+	require.NoError(t, cache.SetContext(ctx, "some-key", "other-value"))
+	value, err := cache.GetContext(ctx, "some-key")
+	require.NoError(t, err)
+	require.Equal(t, "other-value", value)
+
+	require.NoError(t, cache.DeleteContext(ctx, "some-key"))
+	value, err = cache.GetContext(ctx, "some-key")
+	require.NoError(t, err)
+	require.Empty(t, value)
+	require.Zero(t, cache.Stats().Size, "Missing keys should not be cached")
+}
+
+func TestNothingIsCachedUntilEveryNodePushesItsInvalidations(t *testing.T) {
+	ctx := context.Background()
+	cache := subscribedCache(memoryStore{"some-key": "some-value"}, 10)
+	cache.subscriptions["other-node"] = &subscription{address: "other-node"}
+
+	_, err := cache.GetContext(ctx, "some-key")
+	require.NoError(t, err)
+	require.Zero(t, cache.Stats().Size)
+}
+
+func TestLeastRecentlyUsedValuesAreEvicted(t *testing.T) {
+	ctx := context.Background()
+	cache := subscribedCache(memoryStore{"a": "1", "b": "2", "c": "3"}, 2)
+
+	for _, key := range []string{"a", "b", "a", "c"} {
+		_, err := cache.GetContext(ctx, key)
+		require.NoError(t, err)
+	}
+
+	require.Contains(t, cache.entries, "a")
+	require.NotContains(t, cache.entries, "b")
+	require.Contains(t, cache.entries, "c")
+	require.Equal(t, uint64(1), cache.Stats().Evictions)
+}
+
+func TestFlushingTheNearCacheDropsInFlightFetches(t *testing.T) {
+	cache := subscribedCache(memoryStore{}, 10)
+	cache.put("some-key", "some-value")
+	cache.fetches["other-key"] = &fetch{waiters: 1}
+
+	cache.flush()
+
+	require.Zero(t, cache.Stats().Size)
+	require.Equal(t, uint64(1), cache.Stats().Flushes)
+	require.True(t, cache.fetches["other-key"].stale)
+}
@@ -0,0 +1,262 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+type PoolConfig struct {
+	// maximum number of connections kept open, per node, between two requests
+	MaxIdle int
+	// maximum number of connections used at the same time, per node (zero
+	// for no limit)
+	MaxActive int
+	// idle connections are closed after this long, it should be shorter than
+	// the nodes' IdleTimeout
+	IdleTimeout time.Duration
+}
+
+type conn struct {
+	net.Conn
+
+	reader   *bufio.Reader
+	host     *hostPool
+	lastUsed time.Time
+	// reused connections were idle before being used
+	reused bool
+	// the server keeps the connection open between requests
+	keepAlive bool
+	// stops applying the context of the current request to the connection
+	stopWatching func()
+}
+
+type hostPool struct {
+	// one token per connection that can still be used, nil if unlimited
+	slots chan struct{}
+
+	mutex sync.Mutex
+	idle  []*conn
+	// the node does not know the hello command, and closes the connections
+	// after a single request
+	legacy bool
+}
+
+// pool keeps connections to the nodes open between two requests.
+type pool struct {
+	config      PoolConfig
+	dialTimeout time.Duration
+
+	mutex  sync.Mutex
+	hosts  map[string]*hostPool
+	closed bool
+}
+
+func newPool(config PoolConfig, dialTimeout time.Duration) *pool {
+	return &pool{
+		config:      config,
+		dialTimeout: dialTimeout,
+		hosts:       make(map[string]*hostPool),
+	}
+}
+
+func (pool *pool) host(address string) *hostPool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	host, exists := pool.hosts[address]
+	if !exists {
+		host = &hostPool{}
+
+		if pool.config.MaxActive > 0 {
+			host.slots = make(chan struct{}, pool.config.MaxActive)
+			for i := 0; i < pool.config.MaxActive; i++ {
+				host.slots <- struct{}{}
+			}
+		}
+
+		pool.hosts[address] = host
+	}
+
+	return host
+}
+
+// get returns a connection to the given address, either reused from the
+// idle ones or freshly dialed. It must be given back with put.
+func (pool *pool) get(ctx context.Context, address string) (*conn, error) {
+	host := pool.host(address)
+
+	if host.slots != nil {
+		select {
+		case <-host.slots:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if idle := host.popIdle(pool.config.IdleTimeout); idle != nil {
+		idle.reused = true
+		return idle, nil
+	}
+
+	conn, err := pool.dial(ctx, host, address)
+	if err != nil {
+		host.release()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// dial opens a connection to the given address. Nodes only keep open the
+// connections opened with a hello: the nodes that do not know it are sent a
+// single request per connection.
+func (pool *pool) dial(ctx context.Context, host *hostPool, address string) (*conn, error) {
+	dialer := net.Dialer{Timeout: pool.dialTimeout}
+
+	netConn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &conn{
+		Conn:   netConn,
+		reader: bufio.NewReader(netConn),
+		host:   host,
+	}
+
+	if host.isLegacy() {
+		return conn, nil
+	}
+
+	err = conn.hello(ctx)
+	if _, isServerErr := err.(*ServerError); isServerErr {
+		// the node closed the connection after rejecting the hello
+		conn.Close()
+		host.setLegacy()
+
+		return pool.dial(ctx, host, address)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.keepAlive = true
+
+	return conn, nil
+}
+
+// put gives a connection back to the pool. Connections that are not healthy
+// are closed instead of being reused.
+func (pool *pool) put(conn *conn, healthy bool) {
+	pool.mutex.Lock()
+	closed := pool.closed
+	pool.mutex.Unlock()
+
+	if !healthy || !conn.keepAlive || closed || !conn.host.pushIdle(conn, pool.config.MaxIdle) {
+		conn.Close()
+	}
+
+	conn.host.release()
+}
+
+func (pool *pool) Close() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.closed = true
+
+	for _, host := range pool.hosts {
+		host.mutex.Lock()
+		for _, idle := range host.idle {
+			idle.Close()
+		}
+		host.idle = nil
+		host.mutex.Unlock()
+	}
+}
+
+// hello asks the node to keep the connection open between requests.
+func (conn *conn) hello(ctx context.Context) error {
+	stopWatching := watchContext(ctx, conn)
+	defer stopWatching()
+
+	if _, err := fmt.Fprintf(conn, "hello %d\n", ProtocolVersion); err != nil {
+		return err
+	}
+
+	success, length, err := readHeader(conn.reader)
+	if err != nil {
+		return err
+	}
+
+	if success {
+		_, err = io.CopyN(ioutil.Discard, conn.reader, int64(length))
+		return err
+	}
+
+	message, err := ioutil.ReadAll(io.LimitReader(conn.reader, int64(length)))
+	if err != nil {
+		return err
+	}
+
+	return &ServerError{Message: string(message)}
+}
+
+func (host *hostPool) isLegacy() bool {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+
+	return host.legacy
+}
+
+func (host *hostPool) setLegacy() {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+
+	host.legacy = true
+}
+
+func (host *hostPool) release() {
+	if host.slots != nil {
+		host.slots <- struct{}{}
+	}
+}
+
+func (host *hostPool) popIdle(idleTimeout time.Duration) *conn {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+
+	for len(host.idle) != 0 {
+		idle := host.idle[len(host.idle)-1]
+		host.idle = host.idle[:len(host.idle)-1]
+
+		if idleTimeout == 0 || time.Since(idle.lastUsed) < idleTimeout {
+			return idle
+		}
+
+		idle.Close()
+	}
+
+	return nil
+}
+
+func (host *hostPool) pushIdle(conn *conn, maxIdle int) bool {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+
+	if len(host.idle) >= maxIdle {
+		return false
+	}
+
+	conn.lastUsed = time.Now()
+	host.idle = append(host.idle, conn)
+
+	return true
+}
@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPooledConnectionsAreReused(t *testing.T) {
+	server := startFakeServer(t, echo)
+	defer server.listener.Close()
+
+	config := DefaultConfig()
+	config.Seeds = nil
+	client := server.client(config)
+	defer client.Close()
+
+	for i := 0; i < 10; i++ {
+		_, err := client.Get("some-key")
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&server.connections))
+}
+
+func TestIdleConnectionsAreEvicted(t *testing.T) {
+	server := startFakeServer(t, echo)
+	defer server.listener.Close()
+
+	config := DefaultConfig()
+	config.Seeds = nil
+	config.Pool.IdleTimeout = 20 * time.Millisecond
+	client := server.client(config)
+	defer client.Close()
+
+	_, err := client.Get("some-key")
+	require.NoError(t, err)
+
+	time.Sleep(40 * time.Millisecond)
+
+	_, err = client.Get("some-key")
+	require.NoError(t, err)
+
+	require.Equal(t, int32(2), atomic.LoadInt32(&server.connections), "Connections idle for too long should not be reused")
+}
+
+func TestConnectionsClosedByTheServerWhileIdleAreReplaced(t *testing.T) {
+	server := startFakeServer(t, echo)
+	defer server.listener.Close()
+	// the server closes the connections once idle
+	server.hangUp = true
+
+	config := DefaultConfig()
+	config.Seeds = nil
+	client := server.client(config)
+	defer client.Close()
+
+	require.NoError(t, client.Set("some-key", "some-value"))
+
+	// not idempotent, but it was not executed
+	require.NoError(t, client.Set("some-key", "some-value"))
+	require.Equal(t, int32(2), atomic.LoadInt32(&server.requests))
+	require.Equal(t, int32(2), atomic.LoadInt32(&server.connections))
+}
+
+func TestTheNumberOfIdleConnectionsIsBounded(t *testing.T) {
+	server := startFakeServer(t, echo)
+	defer server.listener.Close()
+
+	pool := newPool(PoolConfig{MaxIdle: 1, MaxActive: 2}, time.Second)
+	defer pool.Close()
+
+	address := server.listener.Addr().String()
+
+	first, err := pool.get(context.Background(), address)
+	require.NoError(t, err)
+	second, err := pool.get(context.Background(), address)
+	require.NoError(t, err)
+
+	// both slots are used
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = pool.get(ctx, address)
+	require.Equal(t, context.DeadlineExceeded, err, "The number of active connections should be bounded")
+
+	pool.put(first, true)
+	pool.put(second, true)
+
+	host := pool.host(address)
+	require.Len(t, host.idle, 1)
+
+	reused, err := pool.get(context.Background(), address)
+	require.NoError(t, err)
+	require.True(t, reused.reused)
+	require.Equal(t, first, reused)
+
+	// unhealthy connections are not kept
+	pool.put(reused, false)
+	require.Empty(t, host.idle)
+}
+
+func TestNodesThatDoNotKnowTheHelloAreSentARequestPerConnection(t *testing.T) {
+	server := startFakeServer(t, echo)
+	defer server.listener.Close()
+	server.legacy = true
+
+	config := DefaultConfig()
+	config.Seeds = nil
+	client := server.client(config)
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		result, err := client.Get("some-key")
+		require.NoError(t, err)
+		require.Equal(t, "fetch some-key", result)
+	}
+
+	require.Equal(t, int32(3), atomic.LoadInt32(&server.requests))
+	// the hello is only tried once
+	require.Equal(t, int32(4), atomic.LoadInt32(&server.connections))
+}
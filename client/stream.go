@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"io"
+)
+
+// resultStream reads a result straight from the connection it is received
+// on. The connection goes back to the pool once the result is fully read and
+// the stream closed.
+type resultStream struct {
+	reader *io.LimitedReader
+
+	client Client
+	conn   *conn
+	cancel context.CancelFunc
+	closed bool
+}
+
+// GetStream fetches a value without buffering it: the returned reader reads
+// it from the network. It must be closed, and the whole read is bounded by
+// the deadline of the context (or the request timeout).
+func (client Client) GetStream(ctx context.Context, key string) (io.ReadCloser, error) {
+	ctx, cancel := client.withTimeout(ctx)
+
+	var stream *resultStream
+
+	err := client.roundTrip(ctx, client.seeds(), "fetch "+key, true, func(conn *conn) (bool, error) {
+		success, length, err := readHeader(conn.reader)
+		if err != nil {
+			return false, err
+		}
+
+		// errors are short: they are read at once
+		if !success {
+			message := make([]byte, length)
+			if _, err := io.ReadFull(conn.reader, message); err != nil {
+				return false, err
+			}
+
+			return false, &ServerError{Message: string(message)}
+		}
+
+		stream = &resultStream{
+			reader: &io.LimitedReader{R: conn.reader, N: int64(length)},
+			client: client,
+			conn:   conn,
+			cancel: cancel,
+		}
+
+		return true, nil
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+func (stream *resultStream) Read(buffer []byte) (int, error) {
+	return stream.reader.Read(buffer)
+}
+
+// Close releases the connection. Unless the result was fully read, the
+// connection is closed: what is left of the result can not be told apart
+// from the next one.
+func (stream *resultStream) Close() error {
+	if stream.closed {
+		return nil
+	}
+	stream.closed = true
+
+	stream.conn.stopWatching()
+	stream.client.release(stream.conn, stream.reader.N == 0)
+	stream.cancel()
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// ErrNotFound is returned by Typed when a key has no value.
+var ErrNotFound = errors.New("key not found")
+
+// Store is implemented by Client and ClusterClient.
+type Store interface {
+	GetContext(ctx context.Context, key string) (string, error)
+	SetContext(ctx context.Context, key, value string) error
+	SetWithTTLContext(ctx context.Context, key, value string, lifetime time.Duration) error
+	DeleteContext(ctx context.Context, key string) error
+}
+
+var _ Store = Client{}
+var _ Store = &ClusterClient{}
+
+// EncodeError is returned when a value could not be encoded.
+type EncodeError struct {
+	Key string
+	Err error
+}
+
+// DecodeError is returned when a stored value could not be decoded.
+type DecodeError struct {
+	Key string
+	Err error
+}
+
+func (err *EncodeError) Error() string {
+	return fmt.Sprintf("could not encode value of key %q: %s", err.Key, err.Err)
+}
+
+func (err *DecodeError) Error() string {
+	return fmt.Sprintf("could not decode value of key %q: %s", err.Key, err.Err)
+}
+
+// Typed stores values of type T, converted using a codec.
+type Typed[T any] struct {
+	store Store
+	codec Codec[T]
+}
+
+func NewTyped[T any](store Store, codec Codec[T]) *Typed[T] {
+	return &Typed[T]{
+		store: store,
+		codec: codec,
+	}
+}
+
+// Get returns the value of the given key, or ErrNotFound.
+func (typed *Typed[T]) Get(ctx context.Context, key string) (T, error) {
+	var value T
+
+	data, err := typed.store.GetContext(ctx, key)
+	if err != nil {
+		return value, err
+	}
+
+	// empty values can not be stored: missing keys are fetched as such
+	if data == "" {
+		return value, ErrNotFound
+	}
+
+	value, err = typed.codec.Decode([]byte(data))
+	if err != nil {
+		return value, &DecodeError{Key: key, Err: err}
+	}
+
+	return value, nil
+}
+
+// Set stores the value of the given key. A zero lifetime means that the key
+// never expires.
+func (typed *Typed[T]) Set(ctx context.Context, key string, value T, lifetime time.Duration) error {
+	data, err := typed.codec.Encode(value)
+	if err != nil {
+		return &EncodeError{Key: key, Err: err}
+	}
+
+	if len(data) == 0 {
+		return &EncodeError{Key: key, Err: errors.New("empty values can not be stored")}
+	}
+
+	if bytes.IndexByte(data, '\n') != -1 {
+		return &EncodeError{Key: key, Err: errors.New("values can not contain new lines")}
+	}
+
+	if lifetime == 0 {
+		return typed.store.SetContext(ctx, key, string(data))
+	}
+
+	return typed.store.SetWithTTLContext(ctx, key, string(data), lifetime)
+}
+
+func (typed *Typed[T]) Delete(ctx context.Context, key string) error {
+	return typed.store.DeleteContext(ctx, key)
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+type memoryStore map[string]string
+
+func (store memoryStore) GetContext(ctx context.Context, key string) (string, error) {
+	return store[key], nil
+}
+
+func (store memoryStore) SetContext(ctx context.Context, key, value string) error {
+	store[key] = value
+	return nil
+}
+
+func (store memoryStore) SetWithTTLContext(ctx context.Context, key, value string, lifetime time.Duration) error {
+	store[key] = value
+	return nil
+}
+
+func (store memoryStore) DeleteContext(ctx context.Context, key string) error {
+	delete(store, key)
+	return nil
+}
+
+type user struct {
+	Name  string
+	Email string
+	Tags  []string
+}
+
+func TestTypedValuesCanBeStoredAndFetched(t *testing.T) {
+	ctx := context.Background()
+	value := user{Name: "Some User", Email: "user@example.com", Tags: []string{"a", "b\nc"}}
+
+	for _, codec := range []Codec[user]{JSONCodec[user]{}, GobCodec[user]{}} {
+		store := memoryStore{}
+		users := NewTyped[user](store, codec)
+
+		require.NoError(t, users.Set(ctx, "some-user", value, 0))
+
+		fetched, err := users.Get(ctx, "some-user")
+		require.NoError(t, err)
+		require.Equal(t, value, fetched)
+
+		require.NoError(t, users.Delete(ctx, "some-user"))
+
+		_, err = users.Get(ctx, "some-user")
+		require.Equal(t, ErrNotFound, err)
+	}
+}
+
+func TestRawBytesCanBeStored(t *testing.T) {
+	ctx := context.Background()
+	store := memoryStore{}
+	values := NewTyped[[]byte](store, BytesCodec{})
+
+	require.NoError(t, values.Set(ctx, "some-key", []byte("some value"), time.Minute))
+	require.Equal(t, "some value", store["some-key"])
+
+	fetched, err := values.Get(ctx, "some-key")
+	require.NoError(t, err)
+	require.Equal(t, []byte("some value"), fetched)
+
+	err = values.Set(ctx, "some-key", []byte("some\nvalue"), 0)
+	require.IsType(t, &EncodeError{}, err, "Values that can not be sent should be rejected")
+
+	err = values.Set(ctx, "some-key", nil, 0)
+	require.IsType(t, &EncodeError{}, err, "Empty values can not be stored")
+}
+
+func TestDecodingFailuresAreReported(t *testing.T) {
+	ctx := context.Background()
+	store := memoryStore{"some-user": "not json"}
+
+	_, err := NewTyped[user](store, JSONCodec[user]{}).Get(ctx, "some-user")
+	require.IsType(t, &DecodeError{}, err)
+	require.Equal(t, "some-user", err.(*DecodeError).Key)
+
+	_, err = NewTyped[user](store, GobCodec[user]{}).Get(ctx, "some-user")
+	require.IsType(t, &DecodeError{}, err)
+}
+
+func TestEncodingFailuresAreReported(t *testing.T) {
+	ctx := context.Background()
+
+	err := NewTyped[chan int](memoryStore{}, JSONCodec[chan int]{}).Set(ctx, "some-key", make(chan int), 0)
+	require.IsType(t, &EncodeError{}, err)
+}
@@ -1,61 +1,133 @@
 package gostore
 
 import (
-	"fmt"
 	"github.com/hashicorp/memberlist"
 	"github.com/sirupsen/logrus"
 	"log"
-	"math/rand"
 	"net"
-	"os"
 	"strconv"
+	"sync"
 	"time"
 )
 
 type Node interface {
+	ID() string
 	Address() string
+	// LegacyAddress is the address nodes predating ID routing place the keys
+	// of the node with.
+	LegacyAddress() string
+	Meta() NodeMeta
 	SameAs(other Node) bool
 }
 
 type NodeRef struct {
+	id   string
 	host string
 	port uint16
+	meta NodeMeta
+
+	// older nodes derive it from the gossip address of the node, empty when
+	// unknown
+	legacyAddress string
 }
 
 type memberlistDelegate struct {
+	logger *logrus.Logger
 	router *Router
+
+	// signaled (without blocking) whenever the topology changes
+	changes chan struct{}
+
+	meta      NodeMeta
+	metaMutex sync.RWMutex
+
+	// the other members, as decoded when they joined or were updated: the
+	// metadata of memberlist nodes can not be read safely outside of the
+	// notifications
+	members      map[string]NodeRef
+	membersMutex sync.RWMutex
 }
 
 type Cluster struct {
-	logger     *logrus.Logger
+	logger *logrus.Logger
+	id     string
+	// address of the local member, as seen by memberlist
+	localAddr     string
+	legacyAddress string
+
 	memberList *memberlist.Memberlist
+	delegate   *memberlistDelegate
 	router     Router
+	changes    chan struct{}
+}
+
+func (node NodeRef) ID() string {
+	return node.id
 }
 
 func (node NodeRef) Address() string {
 	return net.JoinHostPort(node.host, strconv.Itoa(int(node.port)))
 }
 
+func (node NodeRef) LegacyAddress() string {
+	if node.legacyAddress != "" {
+		return node.legacyAddress
+	}
+
+	return node.Address()
+}
+
+func (node NodeRef) Meta() NodeMeta {
+	return node.meta
+}
+
 func (node NodeRef) SameAs(other Node) bool {
-	return node.Address() == other.Address()
+	return node.ID() == other.ID()
 }
 
 func (node NodeRef) String() string {
 	return node.Address()
 }
 
-func (cluster *Cluster) createMemberList(port int) {
-	hostNumber := rand.New(rand.NewSource(time.Now().UnixNano())).Int()
-	hostName, _ := os.Hostname()
+func (cluster *Cluster) createMemberList(id string, serverConfig Config) {
+	meta := NodeMeta{
+		Host:    serverConfig.AdvertiseHost,
+		Port:    serverConfig.Port,
+		Version: Version,
+		Engine:  storageEngine(serverConfig),
+		State:   StateActive,
+		Weight:  serverConfig.Weight,
+		Zone:    serverConfig.Zone,
 
-	delegate := &memberlistDelegate{router: &cluster.router}
+		Protocol: ProtocolVersion,
+		Features: localFeatures,
+	}
+	if serverConfig.AdvertisePort != 0 {
+		meta.Port = serverConfig.AdvertisePort
+	}
+
+	delegate := &memberlistDelegate{
+		logger:  cluster.logger,
+		router:  &cluster.router,
+		changes: cluster.changes,
+		meta:    meta,
+		members: make(map[string]NodeRef),
+	}
+	cluster.delegate = delegate
 
 	config := memberlist.DefaultLocalConfig()
-	config.Name = fmt.Sprintf("%s-%X", hostName, hostNumber)
-	config.BindPort = port
-	config.AdvertisePort = port
+	config.Name = id
+	config.BindPort = serverConfig.gossipPort()
+	config.AdvertisePort = serverConfig.gossipPort()
 	config.Logger = log.New(cluster.logger.Writer(), "", 0)
 	config.Events = delegate
+	config.Delegate = delegate
+
+	// memberlist only accepts IPs: hostnames are still advertised for the
+	// data plane through the metadata
+	if ip := net.ParseIP(serverConfig.AdvertiseHost); ip != nil {
+		config.AdvertiseAddr = ip.String()
+	}
 
 	list, err := memberlist.Create(config)
 	if err != nil {
@@ -63,53 +135,321 @@ func (cluster *Cluster) createMemberList(port int) {
 	}
 
 	cluster.memberList = list
+	// the address of a member never changes
+	local := list.LocalNode()
+	cluster.localAddr = local.Addr.String()
+	cluster.legacyAddress = legacyAddress(local)
 }
 
 // NotifyJoin is invoked when a node is detected to have joined.
 // The Node argument must not be modified.
 func (delegate *memberlistDelegate) NotifyJoin(node *memberlist.Node) {
-	delegate.router.AddNode(NodeRef{host: node.Addr.String(), port: node.Port - 1})
+	ref, err := nodeFromMember(node)
+	if err != nil {
+		delegate.logger.Warnf("Ignoring node %q: %s", node.Name, err)
+		return
+	}
+
+	delegate.addMember(ref)
+	delegate.route(ref)
 }
 
 // NotifyLeave is invoked when a node is detected to have left.
 // The Node argument must not be modified.
 func (delegate *memberlistDelegate) NotifyLeave(node *memberlist.Node) {
-	delegate.router.RemoveNode(NodeRef{host: node.Addr.String(), port: node.Port - 1})
+	delegate.membersMutex.Lock()
+	delete(delegate.members, node.Name)
+	delegate.membersMutex.Unlock()
+
+	epoch := delegate.router.Epoch()
+	delegate.router.RemoveNode(NodeRef{id: node.Name})
+
+	if delegate.router.Epoch() != epoch {
+		delegate.topologyChanged()
+	}
 }
 
 // NotifyUpdate is invoked when a node is detected to have
 // updated, usually involving the meta data. The Node argument
 // must not be modified.
 func (delegate *memberlistDelegate) NotifyUpdate(node *memberlist.Node) {
+	ref, err := nodeFromMember(node)
+	if err != nil {
+		delegate.logger.Warnf("Ignoring update of node %q: %s", node.Name, err)
+		return
+	}
+
+	delegate.addMember(ref)
+	delegate.route(ref)
+}
+
+// route updates a node in the router, and signals the change if it moves
+// keys: updates of metadata the placement does not depend on are not.
+func (delegate *memberlistDelegate) route(ref NodeRef) {
+	epoch := delegate.router.Epoch()
+	delegate.router.AddNode(ref)
+
+	if delegate.router.Epoch() != epoch {
+		delegate.topologyChanged()
+	}
+}
+
+func (delegate *memberlistDelegate) addMember(ref NodeRef) {
+	delegate.membersMutex.Lock()
+	delegate.members[ref.id] = ref
+	delegate.membersMutex.Unlock()
+}
+
+func (delegate *memberlistDelegate) member(id string) (NodeRef, bool) {
+	delegate.membersMutex.RLock()
+	defer delegate.membersMutex.RUnlock()
+
+	ref, exists := delegate.members[id]
+
+	return ref, exists
+}
+
+func (delegate *memberlistDelegate) topologyChanged() {
+	select {
+	case delegate.changes <- struct{}{}:
+	default:
+		// a change is already pending
+	}
+}
+
+// NodeMeta is used to retrieve meta-data about the current node
+// when broadcasting an alive message. It's length is limited to
+// the given byte size.
+func (delegate *memberlistDelegate) NodeMeta(limit int) []byte {
+	delegate.metaMutex.RLock()
+	encoded, err := delegate.meta.encode()
+	delegate.metaMutex.RUnlock()
+
+	if err != nil {
+		delegate.logger.Errorf("Could not encode node metadata: %s", err)
+		return nil
+	}
+
+	if len(encoded) > limit {
+		delegate.logger.Errorf("Node metadata is too large (%d bytes, limit is %d)", len(encoded), limit)
+		return nil
+	}
+
+	return encoded
+}
+
+func (delegate *memberlistDelegate) localMeta() NodeMeta {
+	delegate.metaMutex.RLock()
+	defer delegate.metaMutex.RUnlock()
+
+	return delegate.meta
+}
+
+func (delegate *memberlistDelegate) updateMeta(update func(meta *NodeMeta)) {
+	delegate.metaMutex.Lock()
+	update(&delegate.meta)
+	delegate.metaMutex.Unlock()
+}
+
+// NotifyMsg is called when a user-data message is received.
+func (delegate *memberlistDelegate) NotifyMsg([]byte) {
 	// nothing to do
 }
 
-func (cluster Cluster) LocalNode() Node {
-	local := cluster.memberList.LocalNode()
+// GetBroadcasts is called when user data messages can be broadcast.
+func (delegate *memberlistDelegate) GetBroadcasts(overhead, limit int) [][]byte {
+	return nil
+}
 
-	return NodeRef{host: local.Addr.String(), port: local.Port - 1}
+// LocalState is used for a TCP Push/Pull.
+func (delegate *memberlistDelegate) LocalState(join bool) []byte {
+	return nil
 }
 
-func (cluster Cluster) Members() []Node {
+// MergeRemoteState is invoked after a TCP Push/Pull.
+func (delegate *memberlistDelegate) MergeRemoteState(buf []byte, join bool) {
+	// nothing to do
+}
+
+// nodeFromMember builds a reference to the data plane of a member, as
+// advertised in its metadata. It must only be called from the notifications
+// of memberlist, which update the metadata of its nodes.
+func nodeFromMember(member *memberlist.Node) (NodeRef, error) {
+	if len(member.Meta) == 0 {
+		return legacyNodeFromMember(member), nil
+	}
+
+	meta, err := decodeNodeMeta(member.Meta)
+	if err != nil {
+		return NodeRef{}, err
+	}
+
+	host := meta.Host
+	if host == "" {
+		host = member.Addr.String()
+	}
+
+	return NodeRef{id: member.Name, host: host, port: uint16(meta.Port), meta: meta, legacyAddress: legacyAddress(member)}, nil
+}
+
+// legacyNodeFromMember builds a reference to a member predating gossiped
+// metadata: those served their data plane on the port preceding their gossip
+// port, and only speak the text protocol.
+func legacyNodeFromMember(member *memberlist.Node) NodeRef {
+	meta := NodeMeta{
+		Port:  int(member.Port) - 1,
+		State: StateActive,
+	}
+
+	return NodeRef{id: member.Name, host: member.Addr.String(), port: uint16(meta.Port), meta: meta, legacyAddress: legacyAddress(member)}
+}
+
+// legacyAddress is the address nodes predating gossiped metadata know a
+// member by, and place its keys with.
+func legacyAddress(member *memberlist.Node) string {
+	return net.JoinHostPort(member.Addr.String(), strconv.Itoa(int(member.Port)-1))
+}
+
+func (cluster *Cluster) LocalNode() Node {
+	return cluster.localNode()
+}
+
+func (cluster *Cluster) localNode() NodeRef {
+	meta := cluster.delegate.localMeta()
+
+	host := meta.Host
+	if host == "" {
+		host = cluster.localAddr
+	}
+
+	return NodeRef{id: cluster.id, host: host, port: uint16(meta.Port), meta: meta, legacyAddress: cluster.legacyAddress}
+}
+
+func (cluster *Cluster) Members() []Node {
 	var nodes []Node
 
 	for _, member := range cluster.memberList.Members() {
-		nodes = append(nodes, NodeRef{host: member.Addr.String(), port: member.Port - 1})
+		// the name of a member is the only field that is never updated
+		if member.Name == cluster.id {
+			nodes = append(nodes, cluster.LocalNode())
+			continue
+		}
+
+		if node, exists := cluster.delegate.member(member.Name); exists {
+			nodes = append(nodes, node)
+		}
 	}
 
 	return nodes
 }
 
-func (cluster Cluster) ResponsibleNode(key string) Node {
+// Features returns the features supported by every member of the cluster:
+// as long as an older node is a member, the features it lacks are not used.
+func (cluster *Cluster) Features() []Feature {
+	features := localFeatures
+
+	for _, member := range cluster.Members() {
+		features = intersectFeatures(features, member.Meta().Features)
+	}
+
+	return features
+}
+
+// FromLegacyNode tells if a connection comes from a member predating relayed
+// commands, which can not tell relayed commands apart from the ones of
+// clients. Such members are only expected during rolling upgrades.
+func (cluster *Cluster) FromLegacyNode(remote net.Addr) bool {
+	remoteHost, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return false
+	}
+
+	for _, member := range cluster.Members() {
+		if member.Meta().supports(FeatureRelayMarker) {
+			continue
+		}
+
+		host, _, err := net.SplitHostPort(member.LegacyAddress())
+		if err == nil && net.ParseIP(host).Equal(net.ParseIP(remoteHost)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ResponsibleNode returns the node that owns the given key: the one writes
+// go to and reads are served from.
+func (cluster *Cluster) ResponsibleNode(key string) Node {
 	return cluster.router.ResponsibleNode(key)
 }
 
+// PreviousNode returns the node that owned the given key before the nodes
+// currently joining or draining the cluster started doing so, and that might
+// thus still hold it.
+func (cluster *Cluster) PreviousNode(key string) Node {
+	return cluster.router.PreviousNode(key)
+}
+
+// Epoch identifies the topology of the cluster as seen by this node. Nodes
+// with the same epoch agree on who is responsible for which key.
+func (cluster *Cluster) Epoch() uint64 {
+	return cluster.router.Epoch()
+}
+
+// Changes is signaled whenever a node joins, leaves or is updated. Changes
+// happening while the previous one is not consumed yet are coalesced.
+func (cluster *Cluster) Changes() <-chan struct{} {
+	return cluster.changes
+}
+
+func (cluster *Cluster) State() NodeState {
+	return cluster.delegate.localMeta().State
+}
+
+// SetState changes the state of the local node and gossips it to the rest
+// of the cluster.
+func (cluster *Cluster) SetState(state NodeState) error {
+	return cluster.updateLocalNode(func(meta *NodeMeta) {
+		meta.State = state
+	})
+}
+
+// SetHandedOff gossips that the local node handed off the keys it is not
+// responsible for in the topology identified by the given epoch.
+func (cluster *Cluster) SetHandedOff(epoch uint64) error {
+	return cluster.updateLocalNode(func(meta *NodeMeta) {
+		meta.HandedOff = epoch
+	})
+}
+
+func (cluster *Cluster) updateLocalNode(update func(meta *NodeMeta)) error {
+	cluster.delegate.updateMeta(update)
+
+	err := cluster.memberList.UpdateNode(5 * time.Second)
+
+	// do not wait for the change to be gossiped back to us
+	cluster.delegate.route(cluster.localNode())
+
+	return err
+}
+
 func (cluster *Cluster) Join(member string) error {
 	_, err := cluster.memberList.Join([]string{member})
 
 	return err
 }
 
+// Leave gracefully leaves the cluster: the other nodes are told that we left
+// instead of having to detect our failure.
+func (cluster *Cluster) Leave() error {
+	if err := cluster.SetState(StateLeft); err != nil {
+		return err
+	}
+
+	return cluster.memberList.Leave(5 * time.Second)
+}
+
 func (cluster *Cluster) Shutdown() error {
 	if cluster.memberList == nil {
 		return nil
@@ -118,13 +458,15 @@ func (cluster *Cluster) Shutdown() error {
 	return cluster.memberList.Shutdown()
 }
 
-func NewCluster(logger *logrus.Logger, port int) *Cluster {
+func NewCluster(logger *logrus.Logger, id string, config Config) *Cluster {
 	cluster := &Cluster{
-		logger: logger,
-		router: NewRouter(),
+		logger:  logger,
+		id:      id,
+		router:  NewRouter(),
+		changes: make(chan struct{}, 1),
 	}
 
-	cluster.createMemberList(port)
+	cluster.createMemberList(id, config)
 
 	return cluster
 }
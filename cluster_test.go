@@ -1,11 +1,13 @@
 package gostore
 
 import (
+	"github.com/hashicorp/memberlist"
 	"github.com/sirupsen/logrus"
 	logging "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/suite"
-	"strings"
+	"net"
 	"testing"
+	"time"
 )
 
 type clusterTestSuite struct {
@@ -30,23 +32,47 @@ func TestClusterTestSuite(t *testing.T) {
 func (suite *clusterTestSuite) TestASingleNodeClusterCanBeCreated() {
 	require := suite.Require()
 
-	// if the server runs on the port 4224, the cluster management will use the port 4225
-	cluster := NewCluster(suite.logger, 4225)
+	config := DefaultConfig()
+	config.Port = 4224
+	config.GossipPort = 4225
+
+	cluster := NewCluster(suite.logger, "node-a", config)
 	defer cluster.Shutdown()
 
 	require.Len(cluster.Members(), 1, "A new cluster has only one member")
 
-	localAddress := cluster.LocalNode().Address()
-	localPort := strings.Split(localAddress, ":")
+	_, localPort, err := net.SplitHostPort(cluster.LocalNode().Address())
+	require.NoError(err)
+
+	require.Equal("4224", localPort, "It returns the service's port, not the management one")
+	require.Equal("node-a", cluster.LocalNode().ID(), "The node is identified by the given ID")
+}
+
+func (suite *clusterTestSuite) TestTheGossipPortFollowsTheDataPortByDefault() {
+	require := suite.Require()
+
+	config := DefaultConfig()
+	config.Port = 5000
 
-	require.Equal("4224", localPort[1], "It returns the service's port, not the management one")
+	require.Equal(5001, config.gossipPort())
+
+	config.GossipPort = 6000
+
+	require.Equal(6000, config.gossipPort())
 }
 
 func (suite *clusterTestSuite) TestAMultiNodesClusterCanBeCreated() {
 	require := suite.Require()
 
-	clusterA := NewCluster(suite.logger, 4224)
-	clusterB := NewCluster(suite.logger, 5225)
+	configA := DefaultConfig()
+	configA.Port = 4224
+	configA.GossipPort = 4225
+	configB := DefaultConfig()
+	configB.Port = 5224
+	configB.GossipPort = 5225
+
+	clusterA := NewCluster(suite.logger, "node-a", configA)
+	clusterB := NewCluster(suite.logger, "node-b", configB)
 	defer clusterA.Shutdown()
 	defer clusterB.Shutdown()
 
@@ -59,3 +85,145 @@ func (suite *clusterTestSuite) TestAMultiNodesClusterCanBeCreated() {
 	require.Len(clusterA.Members(), 2)
 	require.Len(clusterB.Members(), 2)
 }
+
+func (suite *clusterTestSuite) TestTheAdvertisedAddressIsGossiped() {
+	require := suite.Require()
+
+	configA := DefaultConfig()
+	configA.Port = 4224
+	configA.GossipPort = 7946
+	configA.AdvertiseHost = "127.0.0.1"
+	configA.AdvertisePort = 14224
+	configB := DefaultConfig()
+	configB.Port = 5224
+	configB.GossipPort = 5225
+
+	clusterA := NewCluster(suite.logger, "node-a", configA)
+	clusterB := NewCluster(suite.logger, "node-b", configB)
+	defer clusterA.Shutdown()
+	defer clusterB.Shutdown()
+
+	require.Equal("127.0.0.1:14224", clusterA.LocalNode().Address())
+
+	err := clusterB.Join("127.0.0.1:7946")
+	require.NoError(err, "clusterB should be able to join clusterA")
+
+	var remote Node
+	for _, member := range clusterB.Members() {
+		if member.ID() == "node-a" {
+			remote = member
+		}
+	}
+
+	require.NotNil(remote, "node-a should be known by clusterB")
+	require.Equal("127.0.0.1:14224", remote.Address(), "The data plane address is not derived from the gossip port")
+}
+
+func (suite *clusterTestSuite) TestNodeMetadataIsGossiped() {
+	require := suite.Require()
+
+	configA := DefaultConfig()
+	configA.Port = 4224
+	configA.GossipPort = 4225
+	configA.Zone = "eu-west-1a"
+	configA.Weight = 2
+	configB := DefaultConfig()
+	configB.Port = 5224
+	configB.GossipPort = 5225
+
+	clusterA := NewCluster(suite.logger, "node-a", configA)
+	clusterB := NewCluster(suite.logger, "node-b", configB)
+	defer clusterA.Shutdown()
+	defer clusterB.Shutdown()
+
+	err := clusterB.Join("127.0.0.1:4225")
+	require.NoError(err, "clusterB should be able to join clusterA")
+
+	remoteMeta := func() NodeMeta {
+		for _, member := range clusterB.Members() {
+			if member.ID() == "node-a" {
+				return member.Meta()
+			}
+		}
+
+		return NodeMeta{}
+	}
+
+	require.Equal(NodeMeta{
+		Port:    4224,
+		Version: Version,
+		Engine:  "memory",
+		State:   StateActive,
+		Weight:  2,
+		Zone:    "eu-west-1a",
+
+		Protocol: ProtocolVersion,
+		Features: localFeatures,
+	}, remoteMeta())
+
+	err = clusterA.SetState(StateMaintenance)
+	require.NoError(err)
+
+	for i := 0; i < 100 && remoteMeta().State != StateMaintenance; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.Equal(StateMaintenance, remoteMeta().State, "State changes should be gossiped")
+}
+
+func (suite *clusterTestSuite) TestMembersWithoutMetadataAreReachedTheLegacyWay() {
+	require := suite.Require()
+
+	member := &memberlist.Node{Name: "old-node", Addr: net.ParseIP("10.0.0.1"), Port: 4225}
+
+	node, err := nodeFromMember(member)
+	require.NoError(err)
+
+	require.Equal("old-node", node.ID())
+	require.Equal("10.0.0.1:4224", node.Address(), "The data port precedes the gossip port")
+	require.Equal("10.0.0.1:4224", node.LegacyAddress())
+	require.Equal(StateActive, node.Meta().State, "Legacy nodes hold keys")
+	require.False(node.Meta().supports(FeatureRPC), "Legacy nodes only speak the text protocol")
+}
+
+func (suite *clusterTestSuite) TestMembersWithInvalidMetadataAreRejected() {
+	member := &memberlist.Node{Name: "broken-node", Addr: net.ParseIP("10.0.0.1"), Port: 4225, Meta: []byte("not json")}
+
+	_, err := nodeFromMember(member)
+	suite.Require().Error(err)
+}
+
+func (suite *clusterTestSuite) TestOnlyPlacementChangesAreSignaled() {
+	require := suite.Require()
+
+	router := NewRouter()
+	delegate := &memberlistDelegate{
+		logger:  suite.logger,
+		router:  &router,
+		changes: make(chan struct{}, 1),
+		members: make(map[string]NodeRef),
+	}
+
+	changed := func() bool {
+		select {
+		case <-delegate.changes:
+			return true
+		default:
+			return false
+		}
+	}
+
+	node := NodeRef{id: "node-a", host: "10.0.0.1", port: 4224, meta: NodeMeta{State: StateJoining, Version: "1.0.0"}}
+
+	delegate.route(node)
+	require.True(changed(), "A new node should be signaled")
+
+	node.meta.Version = "1.1.0"
+	node.meta.HandedOff = 42
+	delegate.route(node)
+	require.False(changed(), "Metadata that does not move keys should not be signaled")
+
+	node.meta.State = StateActive
+	delegate.route(node)
+	require.True(changed(), "State changes should be signaled")
+}
@@ -1,44 +1,53 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/K-Phoen/gostore/client"
-	"sync"
+	"net"
+	"os"
+	"strconv"
 )
 
 func main() {
 	var host string
 	var port int
+	var count int
 
 	flag.StringVar(&host, "host", "0.0.0.0", "Host")
 	flag.IntVar(&port, "port", 4224, "Port")
+	flag.IntVar(&count, "count", 1000, "Number of keys to store")
 
 	flag.Parse()
 
-	gostore := client.Client{
-		Host: host,
-		Port: port,
+	config := client.DefaultConfig()
+	config.Seeds = []string{net.JoinHostPort(host, strconv.Itoa(port))}
+
+	gostore, err := client.NewClusterClient(config)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
 	}
+	defer gostore.Close()
 
-	count := 1000
-	var wg sync.WaitGroup
+	batch := client.NewBatch(gostore, client.DefaultBatchConfig())
 
+	var futures []*client.Future
 	for i := 1; i <= count; i++ {
-		if i%10 == 0 {
-			fmt.Printf("Sending request %d/%d\n", i, count)
-		}
+		futures = append(futures, batch.Set(fmt.Sprintf("some-key-%d", i), "some-value"))
+	}
 
-		wg.Add(1)
-		go func(i int) {
-			err := gostore.Set(fmt.Sprintf("some-key-%d", i), "some-value")
-			if err != nil {
-				fmt.Printf("Error: %s\n", err)
-			}
+	if err := batch.Close(context.Background()); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
 
-			wg.Done()
-		}(i)
+	for _, future := range futures {
+		if _, err := future.Wait(context.Background()); err != nil {
+			fmt.Printf("Error storing %s: %s\n", future.Key, err)
+		}
 	}
 
-	wg.Wait()
+	fmt.Printf("Sent %d requests\n", count)
 }
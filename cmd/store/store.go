@@ -4,6 +4,9 @@ import (
 	"flag"
 	"github.com/K-Phoen/gostore"
 	"github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
@@ -13,9 +16,33 @@ func main() {
 
 	flag.StringVar(&cluster, "cluster", "", "Cluster to join")
 
+	flag.StringVar(&config.NodeID, "node-id", config.NodeID, "Node ID (generated and persisted in the storage path if empty)")
 	flag.StringVar(&config.Host, "host", config.Host, "Host to listen to")
 	flag.IntVar(&config.Port, "port", config.Port, "Port to listen to")
-	flag.StringVar(&config.StoragePath, "storage", config.StoragePath, "Storage path (\"memory\" to use in-memory storage)")
+	flag.IntVar(&config.GossipPort, "gossip-port", config.GossipPort, "Port used by the cluster membership protocol (defaults to the port following -port)")
+	flag.StringVar(&config.AdvertiseHost, "advertise-host", config.AdvertiseHost, "Host advertised to the other nodes (defaults to the detected IP)")
+	flag.IntVar(&config.AdvertisePort, "advertise-port", config.AdvertisePort, "Port advertised to the other nodes (defaults to the listening port)")
+	flag.IntVar(&config.Weight, "weight", config.Weight, "Weight of the node, gossiped to the cluster")
+	flag.StringVar(&config.Zone, "zone", config.Zone, "Zone the node runs in, gossiped to the cluster")
+	flag.StringVar(&config.StoragePath, "storage", config.StoragePath, "Storage engine URI, such as \"memory://?maxmemory=2g\" or \"badger:///var/lib/gostore?sync=true\" (\"memory\" and plain paths are short for the in-memory storage and badger directories)")
+
+	flag.Int64Var(&config.MaxMemory, "max-memory", config.MaxMemory, "Approximate number of bytes the in-memory storage can use (0 for no limit)")
+	flag.StringVar(&config.MaxMemoryPolicy, "max-memory-policy", config.MaxMemoryPolicy, "Keys to evict once max-memory is reached: allkeys-lru, allkeys-lfu, allkeys-random, volatile-lru, volatile-lfu, volatile-random or noeviction")
+
+	flag.StringVar(&config.AppendOnlyPath, "appendonly", config.AppendOnlyPath, "File the writes of the in-memory storage are logged to and replayed from (not persisted if empty)")
+	flag.StringVar(&config.AppendOnlyFsync, "appendfsync", config.AppendOnlyFsync, "When the append-only file is synced to the disk: always, everysec or no")
+
+	flag.StringVar(&config.SnapshotPath, "snapshot", config.SnapshotPath, "File snapshots of the in-memory storage are written to and loaded from (no snapshots if empty)")
+	flag.DurationVar(&config.SnapshotInterval, "snapshot-interval", config.SnapshotInterval, "How often a snapshot is written (0 to only write them with the \"node snapshot\" command)")
+
+	flag.BoolVar(&config.Badger.SyncWrites, "badger-sync-writes", config.Badger.SyncWrites, "Sync every write of the disk storage before acknowledging it")
+	flag.Int64Var(&config.Badger.MaxTableSize, "badger-max-table-size", config.Badger.MaxTableSize, "Maximum size of a table of the disk storage (0 for badger's default)")
+	flag.IntVar(&config.Badger.NumMemtables, "badger-memtables", config.Badger.NumMemtables, "Number of tables of the disk storage kept in memory (0 for badger's default)")
+	flag.BoolVar(&config.Badger.LoadTablesToRAM, "badger-tables-in-ram", config.Badger.LoadTablesToRAM, "Load the tables of the disk storage in memory instead of mapping them")
+	flag.IntVar(&config.Badger.ValueThreshold, "badger-value-threshold", config.Badger.ValueThreshold, "Size of the values kept in the LSM tree of the disk storage (0 for badger's default)")
+	flag.Int64Var(&config.Badger.ValueLogFileSize, "badger-value-log-file-size", config.Badger.ValueLogFileSize, "Maximum size of a value log file of the disk storage (0 for badger's default)")
+	flag.DurationVar(&config.Badger.GCInterval, "badger-gc-interval", config.Badger.GCInterval, "How often the value log of the disk storage is garbage collected (0 to disable)")
+	flag.Float64Var(&config.Badger.GCDiscardRatio, "badger-gc-discard-ratio", config.Badger.GCDiscardRatio, "Share of a value log file that must be reclaimable for it to be rewritten")
 
 	flag.Parse()
 
@@ -34,6 +61,10 @@ func main() {
 		server.JoinCluster(cluster)
 	}
 
-	forever := make(chan bool)
-	<-forever
+	// stopping the server flushes the storage
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	server.Stop()
 }
@@ -4,18 +4,29 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"github.com/K-Phoen/gostore/engine"
+	"github.com/K-Phoen/gostore/internal/rpc"
 	"github.com/pkg/errors"
 	"io"
+	"net"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// TopologyChangedMessage prefixes the errors returned to clients when a
+// command could not be routed because the nodes disagree on the topology of
+// the cluster. Retrying is safe.
+const TopologyChangedMessage = "topology changed, retry"
+
 type Command interface {
 	fmt.Stringer
 
 	execute(server *Server) (Result, error)
 	distributed() bool
 	hashingKey() string
+	// idempotent commands can safely be retried
+	idempotent() bool
 }
 
 type Result interface {
@@ -26,6 +37,13 @@ type VoidResult struct{}
 
 type PayloadResult struct {
 	data string
+	// expiration of the value fetched by another node, in milliseconds
+	// since the epoch (zero for none)
+	expiration uint64
+}
+
+type ErrorResult struct {
+	err error
 }
 
 type distributedCmd struct {
@@ -66,6 +84,71 @@ type NodeStatsCmd struct {
 	localCmd
 }
 
+// NodeFetchCmd reads a key from the local store of the node, regardless of
+// which node is responsible for it.
+type NodeFetchCmd struct {
+	localCmd
+
+	key string
+}
+
+// NodeDelCmd deletes a key from the local store of the node, regardless of
+// which node is responsible for it.
+type NodeDelCmd struct {
+	localCmd
+
+	key string
+}
+
+// NodeHandoffCmd stores a key handed off by another node, unless the node
+// already has a (more recent) value for it.
+type NodeHandoffCmd struct {
+	localCmd
+
+	key   string
+	value string
+
+	// zero for keys that do not expire
+	lifetime time.Duration
+}
+
+// NodeSnapshotCmd writes a snapshot of the storage engine of the node.
+type NodeSnapshotCmd struct {
+	localCmd
+}
+
+type NodeDrainCmd struct {
+	localCmd
+}
+
+// NodeInvalidationsCmd subscribes a client connection to the keys that
+// change on the node. It takes the connection over: see
+// Server.streamInvalidations.
+type NodeInvalidationsCmd struct {
+	localCmd
+}
+
+// RelayedCmd wraps a command forwarded by another node, along with the
+// topology epoch the sender routed it with. Relayed commands are never
+// forwarded again.
+type RelayedCmd struct {
+	localCmd
+
+	epoch uint64
+	cmd   Command
+}
+
+// HelloCmd opens a client connection: it negotiates the version of the
+// protocol and tells the client which features the whole cluster supports.
+// The connection is then kept open between commands.
+type HelloCmd struct {
+	localCmd
+
+	version uint16
+	// when given, only these features are considered
+	features []Feature
+}
+
 type ClusterListNodesCmd struct {
 	localCmd
 }
@@ -88,10 +171,54 @@ func (r PayloadResult) String() string {
 	return fmt.Sprintf("+%d\n%s", len(r.data), r.data)
 }
 
+func (r ErrorResult) String() string {
+	return fmt.Sprintf("-%d\n%s", len(r.err.Error()), r.err)
+}
+
+// readResult reads a single result from the given reader, and returns it
+// exactly as it was sent.
+func readResult(reader *bufio.Reader) (string, error) {
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		return "", errors.Wrap(err, "could not read result header")
+	}
+
+	if len(header) < 3 || (header[0] != '+' && header[0] != '-') {
+		return "", errors.New(fmt.Sprintf("invalid result header %q", header))
+	}
+
+	length, err := strconv.Atoi(header[1 : len(header)-1])
+	if err != nil || length < 0 || length > rpc.MaxFrameSize {
+		return "", errors.New(fmt.Sprintf("invalid result length in header %q", header))
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return "", errors.Wrap(err, "could not read result payload")
+	}
+
+	return header + string(payload), nil
+}
+
+// parseResult converts a result read by readResult back to a Result.
+func parseResult(raw string) Result {
+	payload := raw[strings.IndexByte(raw, '\n')+1:]
+
+	if raw[0] == '-' {
+		return ErrorResult{err: errors.New(payload)}
+	}
+
+	return PayloadResult{data: payload}
+}
+
 func (cmd distributedCmd) distributed() bool {
 	return true
 }
 
+func (cmd distributedCmd) idempotent() bool {
+	return false
+}
+
 func (cmd localCmd) distributed() bool {
 	return false
 }
@@ -100,6 +227,10 @@ func (cmd localCmd) hashingKey() string {
 	return ""
 }
 
+func (cmd localCmd) idempotent() bool {
+	return false
+}
+
 func NewStoreCmd(arguments string) (*StoreCmd, error) {
 	key, rest, err := extractUntil(arguments, " ")
 	if err != nil {
@@ -188,13 +319,37 @@ func NewFetchCmd(arguments string) (*FetchCmd, error) {
 }
 
 func (cmd *FetchCmd) execute(server *Server) (Result, error) {
-	val, _, _ := server.store.Get(cmd.key)
+	val, expiration, err := server.store.Get(cmd.key)
+
+	// the value might be cached by the client until it expires
+	if err == nil && expiration != 0 {
+		server.invalidations.expireAt(cmd.key, time.UnixMilli(int64(expiration)))
+	}
+
+	// the key might not have been handed off to us yet
+	if err == engine.KeyNotFound {
+		if previous, ok := server.previousOwner(cmd.key); ok {
+			return server.fetchFromPreviousOwner(cmd.key, previous)
+		}
+	}
 
 	return PayloadResult{
 		data: val,
 	}, nil
 }
 
+// fetchFromPreviousOwner reads a key that was not handed off yet. Its
+// expiration is registered here too, as clients cache the values they fetch
+// from us.
+func (server *Server) fetchFromPreviousOwner(key string, previous Node) (Result, error) {
+	result, err := server.relay(&NodeFetchCmd{key: key}, previous)
+	if payload, ok := result.(PayloadResult); err == nil && ok && payload.expiration != 0 {
+		server.invalidations.expireAt(key, time.UnixMilli(int64(payload.expiration)))
+	}
+
+	return result, err
+}
+
 func (cmd FetchCmd) hashingKey() string {
 	return cmd.key
 }
@@ -203,6 +358,10 @@ func (cmd FetchCmd) String() string {
 	return fmt.Sprintf("fetch %s", cmd.key)
 }
 
+func (cmd FetchCmd) idempotent() bool {
+	return true
+}
+
 func NewDelCmd(arguments string) (*DelCmd, error) {
 	if len(arguments) == 0 {
 		return nil, errors.New("No key given")
@@ -219,6 +378,13 @@ func (cmd *DelCmd) execute(server *Server) (Result, error) {
 		return nil, errors.Wrap(err, "could not delete value")
 	}
 
+	// make sure the key does not come back from a node handing it off to us
+	if previous, ok := server.previousOwner(cmd.key); ok {
+		if _, err := server.relay(&NodeDelCmd{key: cmd.key}, previous); err != nil {
+			return nil, errors.Wrap(err, "could not delete value from previous owner")
+		}
+	}
+
 	return VoidResult{}, nil
 }
 
@@ -230,6 +396,10 @@ func (cmd DelCmd) String() string {
 	return fmt.Sprintf("del %s", cmd.key)
 }
 
+func (cmd DelCmd) idempotent() bool {
+	return true
+}
+
 func NewClusterListNodesCmd() (*ClusterListNodesCmd, error) {
 	return &ClusterListNodesCmd{}, nil
 }
@@ -238,7 +408,7 @@ func (cmd *ClusterListNodesCmd) execute(server *Server) (Result, error) {
 	var buffer bytes.Buffer
 
 	for _, member := range server.cluster.Members() {
-		buffer.WriteString(fmt.Sprintf("%s\n", member.Address()))
+		buffer.WriteString(fmt.Sprintf("%s id=%s %s legacy-address=%s\n", member.Address(), member.ID(), member.Meta(), member.LegacyAddress()))
 	}
 
 	return PayloadResult{data: buffer.String()}, nil
@@ -248,18 +418,319 @@ func (cmd ClusterListNodesCmd) String() string {
 	return "cluster nodes"
 }
 
+// ParseNodeList parses the result of the "cluster nodes" command, for
+// clients routing keys themselves.
+func ParseNodeList(list string) ([]Node, error) {
+	var nodes []Node
+
+	for _, line := range strings.Split(list, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) < 2 || !strings.HasPrefix(fields[1], "id=") {
+			return nil, errors.New(fmt.Sprintf("invalid node description %q", line))
+		}
+
+		host, portStr, err := net.SplitHostPort(fields[0])
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("invalid node address in %q", line))
+		}
+
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("invalid node port in %q", line))
+		}
+
+		// the address older nodes place keys with is not part of the metadata
+		var legacyAddress string
+		var metaFields []string
+		for _, field := range fields[2:] {
+			if strings.HasPrefix(field, "legacy-address=") {
+				legacyAddress = strings.TrimPrefix(field, "legacy-address=")
+				continue
+			}
+
+			metaFields = append(metaFields, field)
+		}
+
+		meta, err := parseNodeMeta(metaFields)
+		if err != nil {
+			return nil, err
+		}
+		meta.Port = int(port)
+
+		nodes = append(nodes, NodeRef{
+			id:            strings.TrimPrefix(fields[1], "id="),
+			host:          host,
+			port:          uint16(port),
+			meta:          meta,
+			legacyAddress: legacyAddress,
+		})
+	}
+
+	return nodes, nil
+}
+
 func NewNodeStatsCmd() (*NodeStatsCmd, error) {
 	return &NodeStatsCmd{}, nil
 }
 
 func (cmd *NodeStatsCmd) execute(server *Server) (Result, error) {
-	return PayloadResult{data: fmt.Sprintf("Keys: %d", server.store.Len())}, nil
+	return PayloadResult{data: fmt.Sprintf("%s\nRelay pool: %s\n%s", server.storageStats(), server.relays.Stats(), server.metrics)}, nil
 }
 
 func (cmd NodeStatsCmd) String() string {
 	return "node stats"
 }
 
+func (cmd NodeStatsCmd) idempotent() bool {
+	return true
+}
+
+func NewNodeFetchCmd(arguments string) (*NodeFetchCmd, error) {
+	if len(arguments) == 0 {
+		return nil, errors.New("No key given")
+	}
+
+	return &NodeFetchCmd{
+		key: arguments,
+	}, nil
+}
+
+func (cmd *NodeFetchCmd) execute(server *Server) (Result, error) {
+	val, expiration, _ := server.store.Get(cmd.key)
+
+	return PayloadResult{
+		data:       val,
+		expiration: expiration,
+	}, nil
+}
+
+func (cmd NodeFetchCmd) String() string {
+	return fmt.Sprintf("node fetch %s", cmd.key)
+}
+
+func (cmd NodeFetchCmd) idempotent() bool {
+	return true
+}
+
+func NewNodeDelCmd(arguments string) (*NodeDelCmd, error) {
+	if len(arguments) == 0 {
+		return nil, errors.New("No key given")
+	}
+
+	return &NodeDelCmd{
+		key: arguments,
+	}, nil
+}
+
+func (cmd *NodeDelCmd) execute(server *Server) (Result, error) {
+	err := server.store.Delete(cmd.key)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not delete value")
+	}
+
+	return VoidResult{}, nil
+}
+
+func (cmd NodeDelCmd) String() string {
+	return fmt.Sprintf("node del %s", cmd.key)
+}
+
+func (cmd NodeDelCmd) idempotent() bool {
+	return true
+}
+
+func NewNodeHandoffCmd(arguments string) (*NodeHandoffCmd, error) {
+	key, rest, err := extractUntil(arguments, " ")
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not extract key")
+	}
+
+	lifetimeStr, rest, err := extractUntil(rest, " ")
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not extract lifetime")
+	}
+
+	lifetime, err := time.ParseDuration(lifetimeStr)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid lifetime given")
+	}
+
+	if len(rest) == 0 {
+		return nil, errors.New("No value given")
+	}
+
+	return &NodeHandoffCmd{
+		key:      key,
+		value:    rest,
+		lifetime: lifetime,
+	}, nil
+}
+
+func (cmd *NodeHandoffCmd) execute(server *Server) (Result, error) {
+	// the sender might not know yet that we are on our way out
+	if state := server.cluster.State(); !state.placeable() {
+		return nil, errors.New(fmt.Sprintf("Can not accept keys in %s state", state))
+	}
+
+	// the key was written since we became responsible for it: what we have is
+	// more recent than what is handed off
+	if _, _, err := server.store.Get(cmd.key); err == nil {
+		return VoidResult{}, nil
+	}
+
+	var err error
+	if cmd.lifetime == 0 {
+		err = server.store.Set(cmd.key, cmd.value)
+	} else {
+		err = server.store.SetExpiring(cmd.key, cmd.value, cmd.lifetime)
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "could not store handed off value")
+	}
+
+	return VoidResult{}, nil
+}
+
+func (cmd NodeHandoffCmd) String() string {
+	return fmt.Sprintf("node handoff %s %s %s", cmd.key, cmd.lifetime, cmd.value)
+}
+
+func NewNodeInvalidationsCmd() (*NodeInvalidationsCmd, error) {
+	return &NodeInvalidationsCmd{}, nil
+}
+
+func (cmd *NodeInvalidationsCmd) execute(server *Server) (Result, error) {
+	return nil, errors.New("Invalidations can only be streamed to clients")
+}
+
+func (cmd NodeInvalidationsCmd) String() string {
+	return "node invalidations"
+}
+
+func NewNodeDrainCmd() (*NodeDrainCmd, error) {
+	return &NodeDrainCmd{}, nil
+}
+
+func (cmd *NodeDrainCmd) execute(server *Server) (Result, error) {
+	// draining takes as long as it takes to hand off every key
+	go server.Drain()
+
+	return VoidResult{}, nil
+}
+
+func (cmd NodeDrainCmd) String() string {
+	return "node drain"
+}
+
+func NewNodeSnapshotCmd() (*NodeSnapshotCmd, error) {
+	return &NodeSnapshotCmd{}, nil
+}
+
+func (cmd *NodeSnapshotCmd) execute(server *Server) (Result, error) {
+	if err := server.snapshot(); err != nil {
+		return nil, errors.Wrap(err, "Could not write the snapshot")
+	}
+
+	return VoidResult{}, nil
+}
+
+func (cmd NodeSnapshotCmd) String() string {
+	return "node snapshot"
+}
+
+func NewRelayedCmd(arguments string) (*RelayedCmd, error) {
+	epochStr, rest, err := extractUntil(arguments, " ")
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not extract epoch")
+	}
+
+	epoch, err := strconv.ParseUint(epochStr, 16, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid epoch given")
+	}
+
+	cmd, err := parseRequest(rest)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not parse relayed command")
+	}
+
+	if _, isRelayed := cmd.(*RelayedCmd); isRelayed {
+		return nil, errors.New("Relayed commands can not be relayed again")
+	}
+
+	return &RelayedCmd{
+		epoch: epoch,
+		cmd:   cmd,
+	}, nil
+}
+
+func (cmd *RelayedCmd) execute(server *Server) (Result, error) {
+	if !cmd.cmd.distributed() {
+		return cmd.cmd.execute(server)
+	}
+
+	if server.cluster.LocalNode().SameAs(server.cluster.ResponsibleNode(cmd.cmd.hashingKey())) {
+		return cmd.cmd.execute(server)
+	}
+
+	// we disagree with the sender on who is responsible for the key: relaying
+	// it again could make it bounce between nodes. If we share the same view
+	// of the cluster, we trust the sender, otherwise the client has to retry
+	// once the topology has converged.
+	localEpoch := server.cluster.Epoch()
+	if localEpoch == cmd.epoch {
+		return cmd.cmd.execute(server)
+	}
+
+	return nil, errors.New(fmt.Sprintf("%s (local epoch %x, relayed with epoch %x)", TopologyChangedMessage, localEpoch, cmd.epoch))
+}
+
+func (cmd RelayedCmd) String() string {
+	return fmt.Sprintf("relay %x %s", cmd.epoch, cmd.cmd)
+}
+
+func NewHelloCmd(arguments string) (*HelloCmd, error) {
+	versionStr, featuresStr, err := extractUntil(arguments+" ", " ")
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not extract version")
+	}
+
+	version, err := strconv.ParseUint(versionStr, 10, 16)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid version given")
+	}
+
+	return &HelloCmd{
+		version:  uint16(version),
+		features: parseFeatures(featuresStr),
+	}, nil
+}
+
+func (cmd *HelloCmd) execute(server *Server) (Result, error) {
+	version, err := negotiateProtocol(cmd.version)
+	if err != nil {
+		return nil, err
+	}
+
+	features := server.cluster.Features()
+	if len(cmd.features) != 0 {
+		features = intersectFeatures(features, cmd.features)
+	}
+
+	return PayloadResult{
+		data: fmt.Sprintf("version=%d features=%s", version, formatFeatures(features)),
+	}, nil
+}
+
+func (cmd HelloCmd) String() string {
+	return strings.TrimSpace(fmt.Sprintf("hello %d %s", cmd.version, formatFeatures(cmd.features)))
+}
+
 func NewClusterStatsCmd() (*ClusterStatsCmd, error) {
 	return &ClusterStatsCmd{}, nil
 }
@@ -269,16 +740,26 @@ func (cmd *ClusterStatsCmd) execute(server *Server) (Result, error) {
 	nodeCmd := &NodeStatsCmd{}
 
 	buffer.WriteString(fmt.Sprintf("%s\n", server.cluster.LocalNode().Address()))
-	buffer.WriteString(fmt.Sprintf("Keys: %d\n", server.store.Len()))
+	buffer.WriteString(fmt.Sprintf("%s\n", server.storageStats()))
+	buffer.WriteString(fmt.Sprintf("Relay pool: %s\n", server.relays.Stats()))
+	buffer.WriteString(fmt.Sprintf("%s\n", server.metrics))
+
+	localNode := server.cluster.LocalNode()
 
 	for _, member := range server.cluster.Members() {
-		if server.cluster.LocalNode().Address() == member.Address() {
+		if localNode.SameAs(member) {
 			continue
 		}
 
 		buffer.WriteString("---\n")
 		buffer.WriteString(fmt.Sprintf("%s\n", member.Address()))
-		server.relayCommand(&buffer, nodeCmd, member)
+
+		result, err := server.relay(nodeCmd, member)
+		if err != nil {
+			result = ErrorResult{err: err}
+		}
+
+		buffer.WriteString(result.String())
 	}
 
 	return PayloadResult{data: buffer.String()}, nil
@@ -349,9 +830,30 @@ func parseNodeCommand(input string) (Command, error) {
 	switch input {
 	case "stats":
 		return NewNodeStatsCmd()
+	case "drain":
+		return NewNodeDrainCmd()
+	case "snapshot":
+		return NewNodeSnapshotCmd()
+	case "invalidations":
+		return NewNodeInvalidationsCmd()
+	}
+
+	// then, try to parse subcommands that do have arguments
+	action, arguments, err := extractUntil(input, " ")
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not parse node subcommand")
 	}
 
-	return nil, errors.New(fmt.Sprintf("Unknown cluster subcommand %q", input))
+	switch action {
+	case "fetch":
+		return NewNodeFetchCmd(arguments)
+	case "del":
+		return NewNodeDelCmd(arguments)
+	case "handoff":
+		return NewNodeHandoffCmd(arguments)
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown node subcommand %q", action))
+	}
 }
 
 func parseCommand(reader io.Reader) (Command, error) {
@@ -363,8 +865,12 @@ func parseCommand(reader io.Reader) (Command, error) {
 	// remove the trailing \n
 	line = line[:len(line)-1]
 
+	return parseRequest(string(line))
+}
+
+func parseRequest(line string) (Command, error) {
 	// the action is the first word
-	action, arguments, err := extractUntil(string(line), " ")
+	action, arguments, err := extractUntil(line, " ")
 	if err != nil {
 		return nil, errors.Wrap(err, "Could not parse action")
 	}
@@ -382,6 +888,10 @@ func parseCommand(reader io.Reader) (Command, error) {
 		return parseNodeCommand(arguments)
 	case "cluster":
 		return parseClusterCommand(arguments)
+	case "relay":
+		return NewRelayedCmd(arguments)
+	case "hello":
+		return NewHelloCmd(arguments)
 	default:
 		return nil, errors.New(fmt.Sprintf("Unknown action %q", action))
 	}
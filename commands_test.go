@@ -17,6 +17,7 @@ func TestValidStoreCmdParsing(t *testing.T) {
 	require.Equal(t, "some-key", storeCmd.key)
 	require.Equal(t, "some-value", storeCmd.value)
 	require.True(t, storeCmd.distributed())
+	require.False(t, storeCmd.idempotent())
 	require.Equal(t, "some-key", storeCmd.hashingKey())
 	require.Equal(t, "store some-key some-value", storeCmd.String())
 }
@@ -45,6 +46,7 @@ func TestValidFetchCmdParsing(t *testing.T) {
 	fetchCmd := cmd.(*FetchCmd)
 	require.Equal(t, "some-key", fetchCmd.key)
 	require.True(t, fetchCmd.distributed())
+	require.True(t, fetchCmd.idempotent())
 	require.Equal(t, "some-key", fetchCmd.hashingKey())
 	require.Equal(t, "fetch some-key", fetchCmd.String())
 }
@@ -58,6 +60,7 @@ func TestValidDelCmdParsing(t *testing.T) {
 	delCmd := cmd.(*DelCmd)
 	require.Equal(t, "some-key", delCmd.key)
 	require.True(t, delCmd.distributed())
+	require.True(t, delCmd.idempotent())
 	require.Equal(t, "some-key", delCmd.hashingKey())
 	require.Equal(t, "del some-key", delCmd.String())
 }
@@ -74,6 +77,113 @@ func TestValidNodeStats(t *testing.T) {
 	require.Equal(t, "node stats", nodeStatsCmd.String())
 }
 
+func TestValidNodeInvalidations(t *testing.T) {
+	cmd, err := parseCommand(strings.NewReader("node invalidations\n"))
+
+	require.NoError(t, err, "Parsing a valid node invalidations command should not return errors")
+	require.IsType(t, &NodeInvalidationsCmd{}, cmd)
+
+	invalidationsCmd := cmd.(*NodeInvalidationsCmd)
+	require.False(t, invalidationsCmd.distributed())
+	require.Equal(t, "node invalidations", invalidationsCmd.String())
+}
+
+func TestValidNodeFetch(t *testing.T) {
+	cmd, err := parseCommand(strings.NewReader("node fetch some-key\n"))
+
+	require.NoError(t, err, "Parsing a valid node fetch command should not return errors")
+	require.IsType(t, &NodeFetchCmd{}, cmd)
+
+	nodeFetchCmd := cmd.(*NodeFetchCmd)
+	require.Equal(t, "some-key", nodeFetchCmd.key)
+	require.False(t, nodeFetchCmd.distributed())
+	require.Empty(t, nodeFetchCmd.hashingKey())
+	require.Equal(t, "node fetch some-key", nodeFetchCmd.String())
+}
+
+func TestValidNodeDel(t *testing.T) {
+	cmd, err := parseCommand(strings.NewReader("node del some-key\n"))
+
+	require.NoError(t, err, "Parsing a valid node del command should not return errors")
+	require.IsType(t, &NodeDelCmd{}, cmd)
+
+	nodeDelCmd := cmd.(*NodeDelCmd)
+	require.Equal(t, "some-key", nodeDelCmd.key)
+	require.False(t, nodeDelCmd.distributed())
+	require.Empty(t, nodeDelCmd.hashingKey())
+	require.Equal(t, "node del some-key", nodeDelCmd.String())
+}
+
+func TestValidNodeHandoff(t *testing.T) {
+	cmd, err := parseCommand(strings.NewReader("node handoff some-key 10s some value\n"))
+
+	require.NoError(t, err, "Parsing a valid node handoff command should not return errors")
+	require.IsType(t, &NodeHandoffCmd{}, cmd)
+
+	handoffCmd := cmd.(*NodeHandoffCmd)
+	require.Equal(t, "some-key", handoffCmd.key)
+	require.Equal(t, "some value", handoffCmd.value)
+	require.Equal(t, "10s", handoffCmd.lifetime.String())
+	require.False(t, handoffCmd.distributed())
+	require.Empty(t, handoffCmd.hashingKey())
+	require.Equal(t, "node handoff some-key 10s some value", handoffCmd.String())
+}
+
+func TestValidNodeDrain(t *testing.T) {
+	cmd, err := parseCommand(strings.NewReader("node drain\n"))
+
+	require.NoError(t, err, "Parsing a valid node drain command should not return errors")
+	require.IsType(t, &NodeDrainCmd{}, cmd)
+
+	drainCmd := cmd.(*NodeDrainCmd)
+	require.False(t, drainCmd.distributed())
+	require.Empty(t, drainCmd.hashingKey())
+	require.Equal(t, "node drain", drainCmd.String())
+}
+
+func TestValidNodeSnapshot(t *testing.T) {
+	cmd, err := parseCommand(strings.NewReader("node snapshot\n"))
+
+	require.NoError(t, err, "Parsing a valid node snapshot command should not return errors")
+	require.IsType(t, &NodeSnapshotCmd{}, cmd)
+
+	snapshotCmd := cmd.(*NodeSnapshotCmd)
+	require.False(t, snapshotCmd.distributed())
+	require.Empty(t, snapshotCmd.hashingKey())
+	require.Equal(t, "node snapshot", snapshotCmd.String())
+}
+
+func TestValidRelayedCmd(t *testing.T) {
+	cmd, err := parseCommand(strings.NewReader("relay 2a store some-key some value\n"))
+
+	require.NoError(t, err, "Parsing a valid relayed command should not return errors")
+	require.IsType(t, &RelayedCmd{}, cmd)
+
+	relayedCmd := cmd.(*RelayedCmd)
+	require.Equal(t, uint64(42), relayedCmd.epoch)
+	require.IsType(t, &StoreCmd{}, relayedCmd.cmd)
+	require.False(t, relayedCmd.distributed())
+	require.Equal(t, "relay 2a store some-key some value", relayedCmd.String())
+}
+
+func TestValidHello(t *testing.T) {
+	cmd, err := parseCommand(strings.NewReader("hello 1 rpc,relay-marker\n"))
+
+	require.NoError(t, err, "Parsing a valid hello command should not return errors")
+	require.IsType(t, &HelloCmd{}, cmd)
+
+	helloCmd := cmd.(*HelloCmd)
+	require.Equal(t, uint16(1), helloCmd.version)
+	require.Equal(t, []Feature{FeatureRPC, FeatureRelayMarker}, helloCmd.features)
+	require.False(t, helloCmd.distributed())
+	require.Equal(t, "hello 1 rpc,relay-marker", helloCmd.String())
+
+	cmd, err = parseCommand(strings.NewReader("hello 2\n"))
+
+	require.NoError(t, err, "Features are optional")
+	require.Equal(t, "hello 2", cmd.String())
+}
+
 func TestValidClusterStats(t *testing.T) {
 	cmd, err := parseCommand(strings.NewReader("cluster stats\n"))
 
@@ -139,11 +249,29 @@ func TestInvalidCommandsReturnErrors(t *testing.T) {
 		"storex some-key 10invalid-duration some-value\n",
 
 		"node unknown\n",
+		"node unknown arg\n",
+		"node fetch\n",
+		"node fetch \n",
+		"node del \n",
+		"node handoff some-key\n",
+		"node handoff some-key 10s\n",
+		"node handoff some-key invalid-duration some-value\n",
 
 		"cluster join\n",
 		"cluster unknown\n",
 		"cluster unknown arg\n",
 
+		"relay\n",
+		"relay 2a\n",
+		"relay not-hex fetch some-key\n",
+		"relay 2a unknown some-key\n",
+		"relay 2a relay 2a fetch some-key\n",
+
+		"hello\n",
+		"hello \n",
+		"hello one\n",
+		"hello 70000\n",
+
 		"unknown some-key\n",
 	}
 
@@ -154,3 +282,38 @@ func TestInvalidCommandsReturnErrors(t *testing.T) {
 		require.Nil(t, cmd, "Parsing an invalid command should not return a Command struct")
 	}
 }
+
+func TestNodeListsCanBeParsed(t *testing.T) {
+	list := "10.0.0.1:4224 id=node-a state=active version=1.2.3 engine=memory weight=2 zone=zone-a protocol=1 features=rpc,relay-marker\n" +
+		"[fd00::2]:4226 id=node-b state=joining version=dev engine=badger weight=1 zone= protocol=0 features= unknown=field legacy-address=[fd00::2]:4225\n"
+
+	nodes, err := ParseNodeList(list)
+
+	require.NoError(t, err)
+	require.Len(t, nodes, 2)
+
+	require.Equal(t, "node-a", nodes[0].ID())
+	require.Equal(t, "10.0.0.1:4224", nodes[0].Address())
+	require.Equal(t, "10.0.0.1:4224", nodes[0].LegacyAddress(), "Nodes are known by their address when nothing else is said")
+	require.Equal(t, NodeMeta{Port: 4224, Version: "1.2.3", Engine: "memory", State: StateActive, Weight: 2, Zone: "zone-a", Protocol: 1, Features: []Feature{FeatureRPC, FeatureRelayMarker}}, nodes[0].Meta())
+
+	require.Equal(t, "node-b", nodes[1].ID())
+	require.Equal(t, "[fd00::2]:4226", nodes[1].Address())
+	require.Equal(t, "[fd00::2]:4225", nodes[1].LegacyAddress())
+	require.Equal(t, NodeMeta{Port: 4226, Version: "dev", Engine: "badger", State: StateJoining, Weight: 1}, nodes[1].Meta())
+}
+
+func TestInvalidNodeListsAreRejected(t *testing.T) {
+	lists := []string{
+		"10.0.0.1:4224\n",
+		"10.0.0.1 id=node-a state=active\n",
+		"10.0.0.1:4224 id=node-a weight=heavy\n",
+		"10.0.0.1:4224 id=node-a not-a-field\n",
+	}
+
+	for _, list := range lists {
+		_, err := ParseNodeList(list)
+
+		require.Error(t, err, "list: %q", list)
+	}
+}
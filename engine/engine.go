@@ -0,0 +1,74 @@
+// Package engine defines the interface of the storage engines, and the
+// registry the servers find them in.
+//
+// gostore ships with the "memory" and "badger" engines. Other engines are
+// made available by registering them, usually from the init function of
+// their package:
+//
+//	func init() {
+//		engine.Register("redis", func(uri *url.URL, options engine.Options) (engine.Store, error) {
+//			return newRedisStore(uri.Host)
+//		})
+//	}
+//
+// They are then selected with a storage path such as "redis://localhost".
+package engine
+
+import (
+	"github.com/pkg/errors"
+	"time"
+)
+
+var (
+	KeyNotFound = errors.New("key not found")
+	KeyExpired  = errors.New("key has expired")
+)
+
+// Store is a storage engine. It must be safe for concurrent use.
+type Store interface {
+	// Get returns the value of a key, and when it expires in milliseconds
+	// since the epoch (zero if it does not). Unknown keys are reported with
+	// KeyNotFound, and expired ones with KeyNotFound or KeyExpired.
+	Get(key string) (string, uint64, error)
+
+	Set(key string, value string) error
+	SetExpiring(key string, value string, lifetime time.Duration) error
+
+	// Delete removes a key. Deleting an unknown key is not an error.
+	Delete(key string) error
+
+	// Len returns the number of live keys. It is called on every "node
+	// stats" command and stabilization run, and must not scan the keys.
+	Len() int
+	// Keys calls the callback for each key, until it returns false.
+	Keys(callback func(key string) bool)
+
+	// Flush makes the acknowledged writes durable, as far as the engine
+	// persists them.
+	Flush() error
+	// Close flushes the writes and releases the resources of the engine,
+	// which must not be used afterwards.
+	Close() error
+}
+
+// MemoryStats describes the memory used by an engine bounding it.
+type MemoryStats struct {
+	Used int64
+	Max  int64
+	// Evictions counts the entries evicted to make room for writes, and
+	// Rejections the writes that did not fit.
+	Evictions  uint64
+	Rejections uint64
+}
+
+// MemoryBounded is implemented by the engines bounding the memory they use.
+// Their stats are reported by the "node stats" command.
+type MemoryBounded interface {
+	MemoryStats() MemoryStats
+}
+
+// Snapshotter is implemented by the engines able to write a point-in-time
+// snapshot of their content, as requested by the "node snapshot" command.
+type Snapshotter interface {
+	Snapshot() error
+}
@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Options are given by the server to the engines it opens.
+type Options struct {
+	Logger *log.Logger
+
+	// OnEvict must be called for each key the engine evicts on its own to
+	// make room for writes, for the clients caching it to forget it. It
+	// must not use the store.
+	OnEvict func(key string)
+}
+
+// Factory opens the engine described by a URI. The scheme of the URI is the
+// name the engine was registered with, the rest of it is up to the engine.
+type Factory func(uri *url.URL, options Options) (Store, error)
+
+var (
+	factoriesMutex sync.RWMutex
+	factories      = make(map[string]Factory)
+)
+
+// Register makes an engine available under the given name, used as the
+// scheme of the URIs selecting it. It panics if an engine is already
+// registered with that name, or if the factory is nil.
+func Register(name string, factory Factory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+
+	if factory == nil {
+		panic("engine: Register factory is nil")
+	}
+	if _, exists := factories[name]; exists {
+		panic(fmt.Sprintf("engine: Register called twice for engine %q", name))
+	}
+
+	factories[name] = factory
+}
+
+// Engines returns the sorted names of the registered engines.
+func Engines() []string {
+	factoriesMutex.RLock()
+	defer factoriesMutex.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Open opens the engine described by a URI, such as "memory://?maxmemory=2g"
+// or "badger:///var/lib/gostore?sync=true".
+func Open(uri string, options Options) (Store, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("invalid storage URI %q", uri))
+	}
+
+	return OpenURL(parsed, options)
+}
+
+// OpenURL opens the engine described by a parsed URI.
+func OpenURL(uri *url.URL, options Options) (Store, error) {
+	factoriesMutex.RLock()
+	factory, exists := factories[uri.Scheme]
+	factoriesMutex.RUnlock()
+
+	if !exists {
+		return nil, errors.New(fmt.Sprintf("unknown storage engine %q (registered engines: %s)", uri.Scheme, strings.Join(Engines(), ", ")))
+	}
+
+	if options.Logger == nil {
+		options.Logger = log.StandardLogger()
+	}
+
+	return factory(uri, options)
+}
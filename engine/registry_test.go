@@ -0,0 +1,53 @@
+package engine
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type fakeStore struct {
+	uri *url.URL
+}
+
+func (store *fakeStore) Get(key string) (string, uint64, error) { return "", 0, KeyNotFound }
+func (store *fakeStore) Set(key string, value string) error     { return nil }
+func (store *fakeStore) SetExpiring(key string, value string, lifetime time.Duration) error {
+	return nil
+}
+func (store *fakeStore) Delete(key string) error             { return nil }
+func (store *fakeStore) Len() int                            { return 0 }
+func (store *fakeStore) Keys(callback func(key string) bool) {}
+func (store *fakeStore) Flush() error                        { return nil }
+func (store *fakeStore) Close() error                        { return nil }
+
+func TestRegisteredEnginesCanBeOpened(t *testing.T) {
+	Register("fake", func(uri *url.URL, options Options) (Store, error) {
+		require.NotNil(t, options.Logger, "A logger should always be given")
+		return &fakeStore{uri: uri}, nil
+	})
+
+	require.Contains(t, Engines(), "fake")
+
+	store, err := Open("fake://some-host/some/path?some=option", Options{})
+	require.NoError(t, err)
+
+	uri := store.(*fakeStore).uri
+	require.Equal(t, "some-host", uri.Host)
+	require.Equal(t, "/some/path", uri.Path)
+	require.Equal(t, "option", uri.Query().Get("some"))
+
+	require.Panics(t, func() {
+		Register("fake", func(uri *url.URL, options Options) (Store, error) {
+			return nil, nil
+		})
+	}, "Engines can not be registered twice")
+}
+
+func TestUnknownEnginesCanNotBeOpened(t *testing.T) {
+	_, err := Open("unknown:///some/path", Options{})
+
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `unknown storage engine "unknown"`)
+}
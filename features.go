@@ -0,0 +1,106 @@
+package gostore
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+const (
+	// ProtocolVersion is the version of the text protocol spoken with clients.
+	ProtocolVersion = 1
+	// MinProtocolVersion is the oldest version of the text protocol still
+	// accepted.
+	MinProtocolVersion = 1
+)
+
+// Feature is an optional capability of a node. Nodes advertise the features
+// they support in their metadata, so that newer nodes never send older ones
+// something they can not parse.
+type Feature string
+
+const (
+	// FeatureRPC nodes accept the binary inter-node protocol.
+	FeatureRPC Feature = "rpc"
+	// FeatureRelayMarker nodes understand relayed commands ("relay <epoch>
+	// <cmd>").
+	FeatureRelayMarker Feature = "relay-marker"
+	// FeatureNodeCommands nodes understand the node-to-node fetch, del and
+	// handoff commands.
+	FeatureNodeCommands Feature = "node-commands"
+	// FeatureInvalidations nodes stream the keys that change to clients
+	// ("node invalidations").
+	FeatureInvalidations Feature = "invalidations"
+	// FeatureHandoffProgress nodes gossip the topology for which they handed
+	// their keys off, which tells joining nodes when they hold their keys.
+	FeatureHandoffProgress Feature = "handoff-progress"
+	// FeatureIDRouting nodes can place keys on the IDs of the nodes instead
+	// of their addresses, which they do once every member can.
+	FeatureIDRouting Feature = "id-routing"
+	// FeatureFetchExpiration nodes tell the expiration of the values other
+	// nodes fetch from them over RPC.
+	FeatureFetchExpiration Feature = "fetch-expiration"
+)
+
+// localFeatures are the features supported by this version of the node.
+var localFeatures = []Feature{FeatureRPC, FeatureRelayMarker, FeatureNodeCommands, FeatureInvalidations, FeatureHandoffProgress, FeatureIDRouting, FeatureFetchExpiration}
+
+// negotiateProtocol returns the version of the protocol to use with a client
+// supporting up to the given version.
+func negotiateProtocol(peerVersion uint16) (uint16, error) {
+	if peerVersion < MinProtocolVersion {
+		return 0, errors.New(fmt.Sprintf("unsupported protocol version %d (minimum is %d)", peerVersion, MinProtocolVersion))
+	}
+
+	if peerVersion > ProtocolVersion {
+		return ProtocolVersion, nil
+	}
+
+	return peerVersion, nil
+}
+
+func hasFeature(features []Feature, feature Feature) bool {
+	for _, candidate := range features {
+		if candidate == feature {
+			return true
+		}
+	}
+
+	return false
+}
+
+// intersectFeatures returns the features of a that are also in b.
+func intersectFeatures(a, b []Feature) []Feature {
+	common := []Feature{}
+
+	for _, feature := range a {
+		if hasFeature(b, feature) {
+			common = append(common, feature)
+		}
+	}
+
+	return common
+}
+
+func featureNames(features []Feature) []string {
+	names := make([]string, 0, len(features))
+	for _, feature := range features {
+		names = append(names, string(feature))
+	}
+
+	return names
+}
+
+func formatFeatures(features []Feature) string {
+	return strings.Join(featureNames(features), ",")
+}
+
+func parseFeatures(input string) []Feature {
+	features := []Feature{}
+
+	for _, name := range strings.FieldsFunc(input, func(r rune) bool { return r == ',' || r == ' ' }) {
+		features = append(features, Feature(name))
+	}
+
+	return features
+}
@@ -0,0 +1,91 @@
+package gostore
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/K-Phoen/gostore/internal/storage"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const nodeIDFile = "node_id"
+
+// resolveNodeID returns the identity of the local node. An explicitly
+// configured ID always wins. Otherwise, the ID is read from the storage
+// directory, and generated then persisted there the first time the node
+// starts. Nodes whose engine persists nothing (in-memory ones without
+// append-only log nor snapshot, or external engines) have nowhere to persist
+// it and get a new ID on every start.
+func resolveNodeID(config Config) (string, error) {
+	if config.NodeID != "" {
+		return config.NodeID, nil
+	}
+
+	directory := storageDirectory(config)
+	if directory == "" {
+		return generateNodeID()
+	}
+
+	idPath := filepath.Join(directory, nodeIDFile)
+
+	content, err := ioutil.ReadFile(idPath)
+	if err == nil && len(strings.TrimSpace(string(content))) != 0 {
+		return strings.TrimSpace(string(content)), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "could not read node ID")
+	}
+
+	id, err := generateNodeID()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return "", errors.Wrap(err, "could not create storage directory")
+	}
+
+	if err := ioutil.WriteFile(idPath, []byte(id+"\n"), 0644); err != nil {
+		return "", errors.Wrap(err, "could not persist node ID")
+	}
+
+	return id, nil
+}
+
+func generateNodeID() (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", errors.Wrap(err, "could not generate node ID")
+	}
+
+	hostName, _ := os.Hostname()
+
+	return fmt.Sprintf("%s-%X", hostName, random), nil
+}
+
+// storageDirectory returns the directory the engine persists its data to:
+// the one of the badger engine, or the one holding the append-only log or
+// the snapshot of the in-memory engine. It is empty when nothing is
+// persisted.
+func storageDirectory(config Config) string {
+	uri, err := storageURI(config)
+	if err != nil {
+		return ""
+	}
+
+	switch uri.Scheme {
+	case "badger":
+		return storage.BadgerPath(uri)
+	case "memory":
+		for _, name := range []string{"appendonly", "snapshot"} {
+			if path := uri.Query().Get(name); path != "" {
+				return filepath.Dir(path)
+			}
+		}
+	}
+
+	return ""
+}
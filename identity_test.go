@@ -0,0 +1,81 @@
+package gostore
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAConfiguredNodeIDIsUsedAsIs(t *testing.T) {
+	config := DefaultConfig()
+	config.NodeID = "some-node"
+
+	id, err := resolveNodeID(config)
+
+	require.NoError(t, err)
+	require.Equal(t, "some-node", id)
+}
+
+func TestTheNodeIDIsPersistedInTheStoragePath(t *testing.T) {
+	storagePath, err := ioutil.TempDir("", "gostore-identity")
+	require.NoError(t, err)
+	defer os.RemoveAll(storagePath)
+
+	config := DefaultConfig()
+	config.StoragePath = storagePath
+
+	id, err := resolveNodeID(config)
+	require.NoError(t, err)
+	require.NotEmpty(t, id)
+
+	sameID, err := resolveNodeID(config)
+	require.NoError(t, err)
+	require.Equal(t, id, sameID, "The node ID should survive restarts")
+}
+
+func TestInMemoryNodesGetAFreshNodeID(t *testing.T) {
+	config := DefaultConfig()
+
+	first, err := resolveNodeID(config)
+	require.NoError(t, err)
+	second, err := resolveNodeID(config)
+	require.NoError(t, err)
+
+	require.NotEqual(t, first, second)
+}
+
+func TestTheNodeIDIsPersistedInTheDirectoryOfABadgerURI(t *testing.T) {
+	storagePath := t.TempDir()
+
+	config := DefaultConfig()
+	config.StoragePath = "badger://" + storagePath + "?sync=true"
+
+	id, err := resolveNodeID(config)
+	require.NoError(t, err)
+
+	content, err := ioutil.ReadFile(filepath.Join(storagePath, nodeIDFile))
+	require.NoError(t, err)
+	require.Equal(t, id+"\n", string(content))
+}
+
+func TestTheNodeIDIsPersistedNextToTheFilesOfTheInMemoryEngine(t *testing.T) {
+	for _, name := range []string{"appendonly", "snapshot"} {
+		directory := t.TempDir()
+
+		config := DefaultConfig()
+		if name == "appendonly" {
+			config.AppendOnlyPath = filepath.Join(directory, "gostore.aof")
+		} else {
+			config.SnapshotPath = filepath.Join(directory, "gostore.snapshot")
+		}
+
+		id, err := resolveNodeID(config)
+		require.NoError(t, err)
+
+		content, err := ioutil.ReadFile(filepath.Join(directory, nodeIDFile))
+		require.NoError(t, err, name)
+		require.Equal(t, id+"\n", string(content))
+	}
+}
@@ -0,0 +1,474 @@
+// Package rpc implements the binary protocol used by the nodes of a cluster
+// to talk to each other.
+//
+// A connection starts with the Magic preamble, followed by a Hello message
+// negotiating the version of the protocol. Then, every message is sent in a
+// frame:
+//
+//	[4 bytes: length of the rest of the frame][1 byte: message type][8 bytes: request ID][payload]
+//
+// Integers are big-endian. In payloads, strings and byte slices are prefixed
+// by their length (uvarint) and durations are sent in milliseconds (varint).
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"time"
+)
+
+const (
+	// Version is the latest version of the protocol spoken by this node
+	Version uint16 = 1
+	// MinVersion is the oldest version of the protocol this node can speak
+	MinVersion uint16 = 1
+
+	// MaxFrameSize is the size of the largest frame accepted
+	MaxFrameSize = 64 << 20
+)
+
+// Magic starts every RPC connection. Its first byte can not start a command
+// of the text protocol, which lets both protocols share the same port.
+var Magic = []byte{0x00, 'G', 'S', 'R', 'P', 'C'}
+
+type MessageType uint8
+
+const (
+	TypeHello MessageType = iota + 1
+	TypeResponse
+	TypeGet
+	TypeSet
+	TypeDelete
+	TypeTransfer
+	TypeStats
+)
+
+type Message interface {
+	Type() MessageType
+
+	encode(buffer *bytes.Buffer)
+	decode(reader *bytes.Reader) error
+}
+
+type Frame struct {
+	RequestID uint64
+	Message   Message
+}
+
+// Hello is the first message sent on a connection, with the latest version
+// and the optional features supported by the sender. The receiver answers
+// with a Hello holding the version that will be used, and the features both
+// sides support.
+//
+// Newer versions of the protocol may append fields to Hello: unknown
+// trailing fields are ignored, so that any node can parse any Hello.
+type Hello struct {
+	Version  uint16
+	Features []string
+}
+
+// Response is sent in response to every request but Hello.
+type Response struct {
+	// Error is empty if the request succeeded
+	Error   string
+	Payload []byte
+	// Expiration of the value read by a Get, in milliseconds since the
+	// epoch (zero for none). It is only sent to the nodes that negotiated
+	// the "fetch-expiration" feature.
+	Expiration uint64
+}
+
+// Get reads a key. Routed requests carry the topology epoch of the sender,
+// Local ones are executed on the receiving node, regardless of routing.
+type Get struct {
+	Epoch uint64
+	Local bool
+	Key   string
+}
+
+// Set writes a key, with an optional TTL (zero for none).
+type Set struct {
+	Epoch uint64
+	Key   string
+	Value []byte
+	TTL   time.Duration
+}
+
+type Delete struct {
+	Epoch uint64
+	Local bool
+	Key   string
+}
+
+// Transfer hands a key off to its new owner.
+type Transfer struct {
+	Key   string
+	Value []byte
+	TTL   time.Duration
+}
+
+// Stats asks a node for its statistics.
+type Stats struct{}
+
+func (m *Hello) Type() MessageType    { return TypeHello }
+func (m *Response) Type() MessageType { return TypeResponse }
+func (m *Get) Type() MessageType      { return TypeGet }
+func (m *Set) Type() MessageType      { return TypeSet }
+func (m *Delete) Type() MessageType   { return TypeDelete }
+func (m *Transfer) Type() MessageType { return TypeTransfer }
+func (m *Stats) Type() MessageType    { return TypeStats }
+
+func (m *Hello) encode(buffer *bytes.Buffer) {
+	writeUvarint(buffer, uint64(m.Version))
+	writeUvarint(buffer, uint64(len(m.Features)))
+	for _, feature := range m.Features {
+		writeBytes(buffer, []byte(feature))
+	}
+}
+
+func (m *Hello) decode(reader *bytes.Reader) error {
+	version, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return err
+	}
+	m.Version = uint16(version)
+
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return err
+	}
+	if count > uint64(reader.Len()) {
+		return errors.New(fmt.Sprintf("expected %d features, %d bytes available", count, reader.Len()))
+	}
+
+	for i := uint64(0); i < count; i++ {
+		feature, err := readString(reader)
+		if err != nil {
+			return err
+		}
+
+		m.Features = append(m.Features, feature)
+	}
+
+	// skip the fields added by newer versions
+	_, err = reader.Seek(0, io.SeekEnd)
+
+	return err
+}
+
+func (m *Response) encode(buffer *bytes.Buffer) {
+	writeBytes(buffer, []byte(m.Error))
+	writeBytes(buffer, m.Payload)
+
+	if m.Expiration != 0 {
+		writeUvarint(buffer, m.Expiration)
+	}
+}
+
+func (m *Response) decode(reader *bytes.Reader) error {
+	message, err := readBytes(reader)
+	if err != nil {
+		return err
+	}
+
+	m.Error = string(message)
+	m.Payload, err = readBytes(reader)
+	if err != nil || reader.Len() == 0 {
+		return err
+	}
+
+	m.Expiration, err = binary.ReadUvarint(reader)
+
+	return err
+}
+
+func (m *Get) encode(buffer *bytes.Buffer) {
+	writeUvarint(buffer, m.Epoch)
+	writeBool(buffer, m.Local)
+	writeBytes(buffer, []byte(m.Key))
+}
+
+func (m *Get) decode(reader *bytes.Reader) (err error) {
+	if m.Epoch, err = binary.ReadUvarint(reader); err != nil {
+		return err
+	}
+	if m.Local, err = readBool(reader); err != nil {
+		return err
+	}
+
+	m.Key, err = readString(reader)
+
+	return err
+}
+
+func (m *Set) encode(buffer *bytes.Buffer) {
+	writeUvarint(buffer, m.Epoch)
+	writeBytes(buffer, []byte(m.Key))
+	writeBytes(buffer, m.Value)
+	writeDuration(buffer, m.TTL)
+}
+
+func (m *Set) decode(reader *bytes.Reader) (err error) {
+	if m.Epoch, err = binary.ReadUvarint(reader); err != nil {
+		return err
+	}
+	if m.Key, err = readString(reader); err != nil {
+		return err
+	}
+	if m.Value, err = readBytes(reader); err != nil {
+		return err
+	}
+
+	m.TTL, err = readDuration(reader)
+
+	return err
+}
+
+func (m *Delete) encode(buffer *bytes.Buffer) {
+	writeUvarint(buffer, m.Epoch)
+	writeBool(buffer, m.Local)
+	writeBytes(buffer, []byte(m.Key))
+}
+
+func (m *Delete) decode(reader *bytes.Reader) (err error) {
+	if m.Epoch, err = binary.ReadUvarint(reader); err != nil {
+		return err
+	}
+	if m.Local, err = readBool(reader); err != nil {
+		return err
+	}
+
+	m.Key, err = readString(reader)
+
+	return err
+}
+
+func (m *Transfer) encode(buffer *bytes.Buffer) {
+	writeBytes(buffer, []byte(m.Key))
+	writeBytes(buffer, m.Value)
+	writeDuration(buffer, m.TTL)
+}
+
+func (m *Transfer) decode(reader *bytes.Reader) (err error) {
+	if m.Key, err = readString(reader); err != nil {
+		return err
+	}
+	if m.Value, err = readBytes(reader); err != nil {
+		return err
+	}
+
+	m.TTL, err = readDuration(reader)
+
+	return err
+}
+
+func (m *Stats) encode(buffer *bytes.Buffer) {}
+
+func (m *Stats) decode(reader *bytes.Reader) error {
+	return nil
+}
+
+func newMessage(messageType MessageType) (Message, error) {
+	switch messageType {
+	case TypeHello:
+		return &Hello{}, nil
+	case TypeResponse:
+		return &Response{}, nil
+	case TypeGet:
+		return &Get{}, nil
+	case TypeSet:
+		return &Set{}, nil
+	case TypeDelete:
+		return &Delete{}, nil
+	case TypeTransfer:
+		return &Transfer{}, nil
+	case TypeStats:
+		return &Stats{}, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown message type %d", messageType))
+	}
+}
+
+func WriteFrame(writer io.Writer, frame Frame) error {
+	var payload bytes.Buffer
+	frame.Message.encode(&payload)
+
+	header := make([]byte, 13)
+	binary.BigEndian.PutUint32(header[0:4], uint32(1+8+payload.Len()))
+	header[4] = byte(frame.Message.Type())
+	binary.BigEndian.PutUint64(header[5:13], frame.RequestID)
+
+	// a single write per frame
+	_, err := writer.Write(append(header, payload.Bytes()...))
+
+	return err
+}
+
+func ReadFrame(reader *bufio.Reader) (Frame, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return Frame{}, err
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	if length < 9 || length > MaxFrameSize {
+		return Frame{}, errors.New(fmt.Sprintf("invalid frame length %d", length))
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return Frame{}, errors.Wrap(err, "could not read frame")
+	}
+
+	message, err := newMessage(MessageType(body[0]))
+	if err != nil {
+		return Frame{}, err
+	}
+
+	payload := bytes.NewReader(body[9:])
+	if err := message.decode(payload); err != nil {
+		return Frame{}, errors.Wrap(err, fmt.Sprintf("invalid payload for message type %d", body[0]))
+	}
+
+	if payload.Len() != 0 {
+		return Frame{}, errors.New(fmt.Sprintf("%d unexpected bytes in message of type %d", payload.Len(), body[0]))
+	}
+
+	return Frame{
+		RequestID: binary.BigEndian.Uint64(body[1:9]),
+		Message:   message,
+	}, nil
+}
+
+// Handshake opens an RPC connection: it sends the preamble and negotiates
+// the version of the protocol and the features to use.
+func Handshake(writer io.Writer, reader *bufio.Reader, features []string) (*Hello, error) {
+	if _, err := writer.Write(Magic); err != nil {
+		return nil, err
+	}
+
+	response, err := Call(writer, reader, 0, &Hello{Version: Version, Features: features})
+	if err != nil {
+		return nil, err
+	}
+
+	switch message := response.(type) {
+	case *Hello:
+		if message.Version < MinVersion || message.Version > Version {
+			return nil, errors.New(fmt.Sprintf("peer negotiated unsupported version %d", message.Version))
+		}
+
+		return message, nil
+	case *Response:
+		return nil, errors.New(fmt.Sprintf("handshake refused: %s", message.Error))
+	default:
+		return nil, errors.New(fmt.Sprintf("unexpected message of type %d during handshake", message.Type()))
+	}
+}
+
+// Negotiate answers the Hello sent by a peer: it holds the version to use
+// and the features supported by both sides.
+func Negotiate(peer *Hello, features []string) (*Hello, error) {
+	if peer.Version < MinVersion {
+		return nil, errors.New(fmt.Sprintf("unsupported version %d (minimum is %d)", peer.Version, MinVersion))
+	}
+
+	negotiated := &Hello{Version: peer.Version}
+	if peer.Version > Version {
+		negotiated.Version = Version
+	}
+
+	for _, feature := range features {
+		for _, peerFeature := range peer.Features {
+			if feature == peerFeature {
+				negotiated.Features = append(negotiated.Features, feature)
+				break
+			}
+		}
+	}
+
+	return negotiated, nil
+}
+
+// Call sends a request and waits for its response.
+func Call(writer io.Writer, reader *bufio.Reader, requestID uint64, request Message) (Message, error) {
+	if err := WriteFrame(writer, Frame{RequestID: requestID, Message: request}); err != nil {
+		return nil, errors.Wrap(err, "could not send request")
+	}
+
+	frame, err := ReadFrame(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read response")
+	}
+
+	if frame.RequestID != requestID {
+		return nil, errors.New(fmt.Sprintf("expected response to request %d, got %d", requestID, frame.RequestID))
+	}
+
+	return frame.Message, nil
+}
+
+func writeUvarint(buffer *bytes.Buffer, value uint64) {
+	encoded := make([]byte, binary.MaxVarintLen64)
+	buffer.Write(encoded[:binary.PutUvarint(encoded, value)])
+}
+
+func writeBool(buffer *bytes.Buffer, value bool) {
+	if value {
+		buffer.WriteByte(1)
+	} else {
+		buffer.WriteByte(0)
+	}
+}
+
+func writeBytes(buffer *bytes.Buffer, value []byte) {
+	writeUvarint(buffer, uint64(len(value)))
+	buffer.Write(value)
+}
+
+func writeDuration(buffer *bytes.Buffer, value time.Duration) {
+	encoded := make([]byte, binary.MaxVarintLen64)
+	buffer.Write(encoded[:binary.PutVarint(encoded, int64(value/time.Millisecond))])
+}
+
+func readBool(reader *bytes.Reader) (bool, error) {
+	value, err := reader.ReadByte()
+
+	return value == 1, err
+}
+
+func readBytes(reader *bytes.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if length > uint64(reader.Len()) {
+		return nil, errors.New(fmt.Sprintf("expected %d bytes, %d available", length, reader.Len()))
+	}
+
+	if length == 0 {
+		return nil, nil
+	}
+
+	value := make([]byte, length)
+	_, err = io.ReadFull(reader, value)
+
+	return value, err
+}
+
+func readString(reader *bytes.Reader) (string, error) {
+	value, err := readBytes(reader)
+
+	return string(value), err
+}
+
+func readDuration(reader *bytes.Reader) (time.Duration, error) {
+	value, err := binary.ReadVarint(reader)
+
+	return time.Duration(value) * time.Millisecond, err
+}
@@ -0,0 +1,135 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"net"
+	"testing"
+	"time"
+)
+
+type rpcTestSuite struct {
+	suite.Suite
+}
+
+func TestRPCTestSuite(t *testing.T) {
+	suite.Run(t, new(rpcTestSuite))
+}
+
+func (suite *rpcTestSuite) TestMessagesCanBeEncodedAndDecoded() {
+	testCases := []Message{
+		&Hello{Version: 42},
+		&Hello{Version: 42, Features: []string{"some-feature", "other-feature"}},
+		&Response{Payload: []byte("some value")},
+		&Response{Payload: []byte("some value"), Expiration: 1700000000000},
+		&Response{Error: "key not found"},
+		&Get{Epoch: 0xdeadbeef, Key: "some-key"},
+		&Get{Local: true, Key: "some-key"},
+		&Set{Epoch: 12, Key: "some key", Value: []byte("a value\nwith new lines\x00and bytes")},
+		&Set{Epoch: 12, Key: "some-key", Value: []byte("value"), TTL: 1500 * time.Millisecond},
+		&Delete{Epoch: 12, Key: "some-key"},
+		&Delete{Local: true, Key: "some-key"},
+		&Transfer{Key: "some-key", Value: []byte("value"), TTL: time.Hour},
+		&Stats{},
+	}
+
+	for i, message := range testCases {
+		var buffer bytes.Buffer
+
+		suite.Require().NoError(WriteFrame(&buffer, Frame{RequestID: uint64(i), Message: message}))
+
+		frame, err := ReadFrame(bufio.NewReader(&buffer))
+
+		suite.Require().NoError(err)
+		suite.Require().Equal(uint64(i), frame.RequestID)
+		suite.Require().Equal(message, frame.Message)
+		suite.Require().Zero(buffer.Len(), "the whole frame should be consumed")
+	}
+}
+
+func (suite *rpcTestSuite) TestInvalidFramesAreRejected() {
+	testCases := map[string][]byte{
+		"too short":         {0, 0, 0, 1, byte(TypeStats)},
+		"too long":          {0xff, 0xff, 0xff, 0xff},
+		"unknown type":      {0, 0, 0, 9, 0xff, 0, 0, 0, 0, 0, 0, 0, 1},
+		"truncated payload": {0, 0, 0, 11, byte(TypeGet), 0, 0, 0, 0, 0, 0, 0, 1, 5, 0},
+		"trailing bytes":    {0, 0, 0, 10, byte(TypeStats), 0, 0, 0, 0, 0, 0, 0, 1, 0},
+	}
+
+	for name, frame := range testCases {
+		_, err := ReadFrame(bufio.NewReader(bytes.NewReader(frame)))
+
+		suite.Require().Error(err, name)
+	}
+}
+
+func (suite *rpcTestSuite) TestHelloFromNewerVersionsCanBeParsed() {
+	// a Hello with an extra trailing field
+	frame := []byte{0, 0, 0, 15, byte(TypeHello), 0, 0, 0, 0, 0, 0, 0, 0, 9, 1, 1, 'a', 42, 42}
+
+	decoded, err := ReadFrame(bufio.NewReader(bytes.NewReader(frame)))
+
+	suite.Require().NoError(err)
+	suite.Require().Equal(&Hello{Version: 9, Features: []string{"a"}}, decoded.Message)
+}
+
+func (suite *rpcTestSuite) TestVersionsAndFeaturesAreNegotiated() {
+	hello, err := Negotiate(&Hello{Version: Version + 1, Features: []string{"a", "b"}}, []string{"b", "c"})
+	suite.Require().NoError(err)
+	suite.Require().Equal(&Hello{Version: Version, Features: []string{"b"}}, hello)
+
+	hello, err = Negotiate(&Hello{Version: MinVersion}, []string{"b", "c"})
+	suite.Require().NoError(err)
+	suite.Require().Equal(&Hello{Version: MinVersion}, hello)
+
+	_, err = Negotiate(&Hello{Version: MinVersion - 1}, nil)
+	suite.Require().Error(err)
+}
+
+func (suite *rpcTestSuite) TestHandshake() {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go answerHello(suite.Require(), server)
+
+	hello, err := Handshake(client, bufio.NewReader(client), []string{"a", "b"})
+
+	suite.Require().NoError(err)
+	suite.Require().Equal(&Hello{Version: Version, Features: []string{"a"}}, hello)
+}
+
+func (suite *rpcTestSuite) TestResponsesMustMatchTheRequest() {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		reader := bufio.NewReader(server)
+		frame, _ := ReadFrame(reader)
+		WriteFrame(server, Frame{RequestID: frame.RequestID + 1, Message: &Response{}})
+	}()
+
+	_, err := Call(client, bufio.NewReader(client), 4, &Stats{})
+
+	suite.Require().Error(err)
+}
+
+func answerHello(require *require.Assertions, conn net.Conn) {
+	reader := bufio.NewReader(conn)
+
+	magic := make([]byte, len(Magic))
+	_, err := reader.Read(magic)
+	require.NoError(err)
+	require.Equal(Magic, magic)
+
+	frame, err := ReadFrame(reader)
+	require.NoError(err)
+
+	hello, err := Negotiate(frame.Message.(*Hello), []string{"a", "c"})
+	require.NoError(err)
+
+	require.NoError(WriteFrame(conn, Frame{RequestID: frame.RequestID, Message: hello}))
+}
@@ -0,0 +1,460 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Fsync policies of the append-only log.
+const (
+	// FsyncAlways syncs every write before acknowledging it.
+	FsyncAlways = "always"
+	// FsyncEverySecond syncs the log every second: up to a second of writes
+	// can be lost.
+	FsyncEverySecond = "everysec"
+	// FsyncNever lets the operating system decide when to sync the log.
+	FsyncNever = "no"
+)
+
+const (
+	// aofMagic starts every append-only log
+	aofMagic = "GOSTORE-AOF-1\n"
+
+	recordSet    byte = 1
+	recordDelete byte = 2
+
+	// records are framed by their length and checksum
+	recordHeaderSize = 8
+	maxRecordSize    = 1 << 30
+)
+
+// record is a write logged in the append-only log. Expirations are absolute,
+// in milliseconds since the epoch, for keys that expired while the node was
+// down not to come back.
+type record struct {
+	op         byte
+	key        string
+	value      string
+	expiration uint64
+}
+
+func (r record) encode() []byte {
+	var payload bytes.Buffer
+	varint := make([]byte, binary.MaxVarintLen64)
+
+	payload.WriteByte(r.op)
+	payload.Write(varint[:binary.PutUvarint(varint, uint64(len(r.key)))])
+	payload.WriteString(r.key)
+
+	if r.op == recordSet {
+		payload.Write(varint[:binary.PutUvarint(varint, uint64(len(r.value)))])
+		payload.WriteString(r.value)
+		payload.Write(varint[:binary.PutUvarint(varint, r.expiration)])
+	}
+
+	frame := make([]byte, recordHeaderSize+payload.Len())
+	binary.BigEndian.PutUint32(frame, uint32(payload.Len()))
+	binary.BigEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(payload.Bytes()))
+	copy(frame[recordHeaderSize:], payload.Bytes())
+
+	return frame
+}
+
+// readRecord reads a record, and tells how many bytes it spans.
+func readRecord(reader *bufio.Reader) (record, int, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return record{}, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	if length > maxRecordSize {
+		return record{}, 0, errors.New(fmt.Sprintf("record of %d bytes exceeds the maximum size", length))
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return record{}, 0, err
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return record{}, 0, errors.New("record checksum mismatch")
+	}
+
+	decoded, err := decodeRecord(bytes.NewReader(payload))
+
+	return decoded, recordHeaderSize + int(length), err
+}
+
+func decodeRecord(payload *bytes.Reader) (record, error) {
+	var decoded record
+	var err error
+
+	if decoded.op, err = payload.ReadByte(); err != nil {
+		return decoded, err
+	}
+
+	if decoded.key, err = readRecordString(payload); err != nil {
+		return decoded, err
+	}
+
+	switch decoded.op {
+	case recordDelete:
+		return decoded, nil
+	case recordSet:
+		if decoded.value, err = readRecordString(payload); err != nil {
+			return decoded, err
+		}
+
+		decoded.expiration, err = binary.ReadUvarint(payload)
+
+		return decoded, err
+	}
+
+	return decoded, errors.New(fmt.Sprintf("unknown record type %d", decoded.op))
+}
+
+func readRecordString(payload *bytes.Reader) (string, error) {
+	length, err := binary.ReadUvarint(payload)
+	if err != nil {
+		return "", err
+	}
+
+	if length > uint64(payload.Len()) {
+		return "", errors.New(fmt.Sprintf("expected %d bytes, %d available", length, payload.Len()))
+	}
+
+	value := make([]byte, length)
+	_, err = io.ReadFull(payload, value)
+
+	return string(value), err
+}
+
+// appendOnlyLog records the writes of the in-memory engine, to replay them
+// at startup. It is compacted by rewriting it from the content of the store
+// once it grew enough since the last rewrite.
+type appendOnlyLog struct {
+	logger *log.Logger
+	path   string
+	fsync  string
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+	// size of the log after the last rewrite
+	baseSize int64
+	// records appended while the log is being rewritten, nil otherwise
+	rewriteBuffer [][]byte
+	closed        bool
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// replayAppendOnlyLog calls apply for each record of the log, then opens it
+// to append new ones. A torn or corrupted tail, left by a crash in the middle
+// of a write, is truncated.
+func replayAppendOnlyLog(logger *log.Logger, path string, fsync string, apply func(record)) (*appendOnlyLog, error) {
+	switch fsync {
+	case FsyncAlways, FsyncEverySecond, FsyncNever:
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown fsync policy %q", fsync))
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open the append-only log")
+	}
+
+	size, err := replay(logger, file, apply)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "could not open the append-only log")
+	}
+
+	return &appendOnlyLog{
+		logger:   logger,
+		path:     path,
+		fsync:    fsync,
+		file:     file,
+		size:     size,
+		baseSize: size,
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+// replay applies the records of the log and returns the size of its valid
+// part.
+func replay(logger *log.Logger, file *os.File, apply func(record)) (int64, error) {
+	reader := bufio.NewReader(file)
+
+	magic := make([]byte, len(aofMagic))
+	n, err := io.ReadFull(reader, magic)
+	if err == io.EOF || (err == io.ErrUnexpectedEOF && bytes.HasPrefix([]byte(aofMagic), magic[:n])) {
+		// new log, or crashed while creating it
+		if err := file.Truncate(0); err != nil {
+			return 0, errors.Wrap(err, "could not initialize the append-only log")
+		}
+		if _, err := file.WriteAt([]byte(aofMagic), 0); err != nil {
+			return 0, errors.Wrap(err, "could not initialize the append-only log")
+		}
+
+		return int64(len(aofMagic)), file.Sync()
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "could not read the append-only log")
+	}
+	if string(magic) != aofMagic {
+		return 0, errors.New(fmt.Sprintf("%s is not an append-only log", file.Name()))
+	}
+
+	size := int64(len(aofMagic))
+	records := 0
+
+	for {
+		decoded, length, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.Warnf("Truncating the append-only log after %d records (offset %d): %s", records, size, err)
+
+			if err := file.Truncate(size); err != nil {
+				return 0, errors.Wrap(err, "could not truncate the append-only log")
+			}
+			break
+		}
+
+		apply(decoded)
+		size += int64(length)
+		records++
+	}
+
+	logger.Infof("Replayed %d records of the append-only log", records)
+
+	return size, nil
+}
+
+func (aof *appendOnlyLog) append(r record) error {
+	encoded := r.encode()
+
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+
+	if aof.closed {
+		return errors.New("the append-only log is closed")
+	}
+
+	if _, err := aof.file.Write(encoded); err != nil {
+		return errors.Wrap(err, "could not write to the append-only log")
+	}
+	aof.size += int64(len(encoded))
+
+	if aof.rewriteBuffer != nil {
+		aof.rewriteBuffer = append(aof.rewriteBuffer, encoded)
+	}
+
+	if aof.fsync == FsyncAlways {
+		if err := aof.file.Sync(); err != nil {
+			return errors.Wrap(err, "could not sync the append-only log")
+		}
+	}
+
+	return nil
+}
+
+// start syncs the log every second if needed, and rewrites it once it
+// doubled in size (and is at least minRewriteSize bytes large).
+func (aof *appendOnlyLog) start(minRewriteSize int64, snapshot func(write func(record) error) error) {
+	aof.done.Add(1)
+
+	go func() {
+		defer aof.done.Done()
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-aof.stop:
+				return
+			}
+
+			if aof.fsync == FsyncEverySecond {
+				aof.sync()
+			}
+
+			if aof.shouldRewrite(minRewriteSize) {
+				if err := aof.rewrite(snapshot); err != nil {
+					aof.logger.Errorf("Could not rewrite the append-only log: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+func (aof *appendOnlyLog) sync() {
+	if err := aof.flush(); err != nil {
+		aof.logger.Errorf("Could not sync the append-only log: %s", err)
+	}
+}
+
+// flush syncs the log to the disk.
+func (aof *appendOnlyLog) flush() error {
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+
+	if aof.closed {
+		return nil
+	}
+
+	return errors.Wrap(aof.file.Sync(), "could not sync the append-only log")
+}
+
+func (aof *appendOnlyLog) shouldRewrite(minRewriteSize int64) bool {
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+
+	return !aof.closed && aof.size >= minRewriteSize && aof.size >= 2*aof.baseSize
+}
+
+// rewrite compacts the log: the snapshot of the store is written to a new
+// log, followed by the records appended in the meantime, before replacing
+// the current log. Writes are only blocked while the new log is swapped in.
+func (aof *appendOnlyLog) rewrite(snapshot func(write func(record) error) error) error {
+	aof.mutex.Lock()
+	aof.rewriteBuffer = [][]byte{}
+	aof.mutex.Unlock()
+
+	rewritten, err := aof.writeSnapshot(snapshot)
+
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+
+	buffered := aof.rewriteBuffer
+	aof.rewriteBuffer = nil
+
+	if err != nil {
+		return err
+	}
+
+	if aof.closed {
+		rewritten.Close()
+		os.Remove(rewritten.Name())
+		return nil
+	}
+
+	size, err := rewritten.Seek(0, io.SeekEnd)
+	if err == nil {
+		for _, encoded := range buffered {
+			if _, err = rewritten.Write(encoded); err != nil {
+				break
+			}
+			size += int64(len(encoded))
+		}
+	}
+	if err == nil {
+		err = rewritten.Sync()
+	}
+	if err == nil {
+		err = os.Rename(rewritten.Name(), aof.path)
+	}
+	if err != nil {
+		rewritten.Close()
+		os.Remove(rewritten.Name())
+		return errors.Wrap(err, "could not replace the append-only log")
+	}
+
+	syncDir(filepath.Dir(aof.path))
+
+	aof.file.Close()
+	aof.file = rewritten
+	aof.size = size
+	aof.baseSize = size
+
+	aof.logger.Infof("Rewrote the append-only log (%d bytes)", size)
+
+	return nil
+}
+
+func (aof *appendOnlyLog) writeSnapshot(snapshot func(write func(record) error) error) (*os.File, error) {
+	file, err := os.Create(aof.path + ".rewrite")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create the rewritten append-only log")
+	}
+
+	writer := bufio.NewWriter(file)
+
+	_, err = writer.WriteString(aofMagic)
+	if err == nil {
+		err = snapshot(func(r record) error {
+			_, err := writer.Write(r.encode())
+			return err
+		})
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, errors.Wrap(err, "could not write the rewritten append-only log")
+	}
+
+	return file, nil
+}
+
+// Close stops the background routine, and syncs and closes the log.
+func (aof *appendOnlyLog) Close() error {
+	aof.mutex.Lock()
+	if aof.closed {
+		aof.mutex.Unlock()
+		return nil
+	}
+	aof.closed = true
+	close(aof.stop)
+	aof.mutex.Unlock()
+
+	aof.done.Wait()
+
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+
+	if err := aof.file.Sync(); err != nil {
+		aof.file.Close()
+		return errors.Wrap(err, "could not sync the append-only log")
+	}
+
+	return aof.file.Close()
+}
+
+// syncDir makes a rename in the given directory durable.
+func syncDir(path string) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	dir.Sync()
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"fmt"
+	logging "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openPersistedMap(t *testing.T, config SyncMapConfig) *shardedMap {
+	logger, _ := logging.NewNullLogger()
+	config = config.withDefaults()
+
+	store, err := newShardedMap(logger, config)
+	require.NoError(t, err)
+	require.NoError(t, store.persist(logger, config))
+
+	return store
+}
+
+func TestWritesAreReplayedAfterARestart(t *testing.T) {
+	config := SyncMapConfig{AppendOnlyPath: filepath.Join(t.TempDir(), "gostore.aof"), Fsync: FsyncAlways}
+
+	store := openPersistedMap(t, config)
+	require.NoError(t, store.Set("some-key", "some-value"))
+	require.NoError(t, store.Set("overwritten-key", "old-value"))
+	require.NoError(t, store.Set("overwritten-key", "new-value"))
+	require.NoError(t, store.SetExpiring("expiring-key", "some-value", time.Hour))
+	require.NoError(t, store.Set("deleted-key", "some-value"))
+	require.NoError(t, store.Delete("deleted-key"))
+	require.NoError(t, store.Close())
+
+	_, expiration, _ := store.Get("expiring-key")
+
+	store = openPersistedMap(t, config)
+	defer store.Close()
+
+	require.Equal(t, 3, store.Len())
+
+	value, _, err := store.Get("some-key")
+	require.NoError(t, err)
+	require.Equal(t, "some-value", value)
+
+	value, _, err = store.Get("overwritten-key")
+	require.NoError(t, err)
+	require.Equal(t, "new-value", value)
+
+	_, restoredExpiration, err := store.Get("expiring-key")
+	require.NoError(t, err)
+	require.Equal(t, expiration, restoredExpiration, "Expirations should be absolute")
+
+	_, _, err = store.Get("deleted-key")
+	require.Equal(t, KeyNotFound, err)
+}
+
+func TestKeysExpiredWhileDownDoNotComeBack(t *testing.T) {
+	config := SyncMapConfig{AppendOnlyPath: filepath.Join(t.TempDir(), "gostore.aof")}
+
+	store := openPersistedMap(t, config)
+	require.NoError(t, store.SetExpiring("expiring-key", "some-value", 50*time.Millisecond))
+	require.NoError(t, store.Close())
+
+	time.Sleep(100 * time.Millisecond)
+
+	store = openPersistedMap(t, config)
+	defer store.Close()
+
+	require.Zero(t, store.Len())
+}
+
+func TestEvictedKeysDoNotComeBack(t *testing.T) {
+	config := SyncMapConfig{
+		AppendOnlyPath: filepath.Join(t.TempDir(), "gostore.aof"),
+		Shards:         1,
+		MaxMemory:      2 * entrySize("key-1", "value"),
+	}
+
+	store := openPersistedMap(t, config)
+	require.NoError(t, store.Set("key-1", "value"))
+	require.NoError(t, store.Set("key-2", "value"))
+	require.NoError(t, store.Set("key-3", "value"))
+	require.NoError(t, store.Delete("key-3"))
+	require.NoError(t, store.Close())
+
+	store = openPersistedMap(t, config)
+	defer store.Close()
+
+	_, _, err := store.Get("key-1")
+	require.Equal(t, KeyNotFound, err)
+	_, _, err = store.Get("key-2")
+	require.NoError(t, err)
+}
+
+func TestWritesThatCouldNotBeLoggedAreNotApplied(t *testing.T) {
+	config := SyncMapConfig{AppendOnlyPath: filepath.Join(t.TempDir(), "gostore.aof"), MaxMemory: 1024, Policy: AllKeysLRU, Shards: 1}
+
+	store := openPersistedMap(t, config)
+	defer store.Close()
+
+	require.NoError(t, store.Set("some-key", "some-value"))
+
+	// writes to a closed log fail
+	require.NoError(t, store.journal.Close())
+
+	require.Error(t, store.Set("new-key", "some-value"))
+	require.Error(t, store.SetExpiring("expiring-key", "some-value", time.Hour))
+	require.Error(t, store.Set("some-key", "overwritten"))
+	require.Error(t, store.Delete("some-key"))
+	// making room for it would evict some-key
+	require.Error(t, store.Set("large-key", strings.Repeat("a", 900)))
+
+	require.Equal(t, 1, store.Len())
+
+	value, _, err := store.Get("some-key")
+	require.NoError(t, err)
+	require.Equal(t, "some-value", value)
+}
+
+func TestTornWritesAreTruncated(t *testing.T) {
+	config := SyncMapConfig{AppendOnlyPath: filepath.Join(t.TempDir(), "gostore.aof")}
+
+	store := openPersistedMap(t, config)
+	require.NoError(t, store.Set("some-key", "some-value"))
+	require.NoError(t, store.Close())
+
+	info, err := os.Stat(config.AppendOnlyPath)
+	require.NoError(t, err)
+
+	// a crash in the middle of a write
+	torn := record{op: recordSet, key: "other-key", value: "other-value"}.encode()
+	file, err := os.OpenFile(config.AppendOnlyPath, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = file.Write(torn[:len(torn)-3])
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	store = openPersistedMap(t, config)
+	require.Equal(t, 1, store.Len())
+	require.NoError(t, store.Set("other-key", "other-value"))
+	require.NoError(t, store.Close())
+
+	truncated, err := os.Stat(config.AppendOnlyPath)
+	require.NoError(t, err)
+	require.Equal(t, info.Size()+int64(len(torn)), truncated.Size(), "The torn record should have been replaced")
+
+	store = openPersistedMap(t, config)
+	defer store.Close()
+	require.Equal(t, 2, store.Len())
+}
+
+func TestOtherFilesAreNotReplayed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "not-a-log")
+	require.NoError(t, os.WriteFile(path, []byte("some content that is not a log"), 0644))
+
+	logger, _ := logging.NewNullLogger()
+	_, err := NewSyncMap(logger, SyncMapConfig{AppendOnlyPath: path})
+	require.Error(t, err)
+
+	_, err = NewSyncMap(logger, SyncMapConfig{AppendOnlyPath: path + ".aof", Fsync: "sometimes"})
+	require.Error(t, err)
+}
+
+func TestTheLogIsRewritten(t *testing.T) {
+	config := SyncMapConfig{AppendOnlyPath: filepath.Join(t.TempDir(), "gostore.aof")}
+
+	store := openPersistedMap(t, config)
+
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key-%d", i%10), fmt.Sprintf("value-%d", i)))
+	}
+	require.NoError(t, store.Delete("key-0"))
+
+	before, err := os.Stat(config.AppendOnlyPath)
+	require.NoError(t, err)
+
+	// writes happening during the rewrite are kept
+	require.NoError(t, store.journal.rewrite(func(write func(record) error) error {
+		require.NoError(t, store.Set("key-1", "written-during-the-rewrite"))
+		require.NoError(t, store.Delete("key-2"))
+
+		return store.dump(write)
+	}))
+	require.NoError(t, store.Set("key-3", "written-after-the-rewrite"))
+	require.NoError(t, store.Close())
+
+	after, err := os.Stat(config.AppendOnlyPath)
+	require.NoError(t, err)
+	require.True(t, after.Size() < before.Size()/10, "The log should have been compacted")
+
+	store = openPersistedMap(t, config)
+	defer store.Close()
+
+	require.Equal(t, 8, store.Len())
+
+	value, _, _ := store.Get("key-1")
+	require.Equal(t, "written-during-the-rewrite", value)
+	value, _, _ = store.Get("key-3")
+	require.Equal(t, "written-after-the-rewrite", value)
+	value, _, _ = store.Get("key-9")
+	require.Equal(t, "value-999", value)
+}
+
+func TestTheLogIsRewrittenInTheBackground(t *testing.T) {
+	config := SyncMapConfig{AppendOnlyPath: filepath.Join(t.TempDir(), "gostore.aof"), RewriteMinSize: 1024}
+
+	store := openPersistedMap(t, config)
+	defer store.Close()
+
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, store.Set("some-key", fmt.Sprintf("value-%d", i)))
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+
+	info, err := os.Stat(config.AppendOnlyPath)
+	require.NoError(t, err)
+	require.True(t, info.Size() < 1024, "The log should have been rewritten")
+}
@@ -1,48 +1,199 @@
 package storage
 
 import (
+	"encoding/binary"
+	"fmt"
 	"github.com/dgraph-io/badger"
+	"github.com/dgraph-io/badger/options"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 )
 
-type badgerDb struct {
-	db *badger.DB
+// expiringMeta flags the values prefixed by their expiration, in
+// milliseconds since the epoch: badger only expires keys to the second.
+const expiringMeta byte = 1
+
+// BadgerConfig tunes the badger engine. Zero values keep badger's defaults.
+//
+// The version of badger in use neither compresses its tables nor caches
+// their blocks: LoadTablesToRAM is the closest to a cache, trading memory
+// for reads.
+type BadgerConfig struct {
+	// SyncWrites syncs every write to the disk before acknowledging it.
+	// Otherwise, writes are only synced by Flush and Close, and the last
+	// ones can be lost if the machine crashes.
+	SyncWrites bool
+
+	// MaxTableSize is the maximum size of a table of the LSM tree, and
+	// LevelOneSize the maximum size of its first level.
+	MaxTableSize int64
+	LevelOneSize int64
+	// NumMemtables is how many tables are kept in memory before being
+	// written to the disk.
+	NumMemtables int
+	// LoadTablesToRAM loads the tables of the LSM tree in memory, instead
+	// of mapping them.
+	LoadTablesToRAM bool
+
+	// ValueThreshold is the size of the values kept in the LSM tree,
+	// larger ones are stored in the value log.
+	ValueThreshold int
+	// ValueLogFileSize is the maximum size of a file of the value log.
+	ValueLogFileSize int64
+
+	// GCInterval is how often the value log is garbage collected, zero
+	// disabling it. Files where at least GCDiscardRatio of the space can be
+	// reclaimed are rewritten.
+	GCInterval     time.Duration
+	GCDiscardRatio float64
 }
 
-func (s *badgerDb) Len() int {
-	count := 0
+func DefaultBadgerConfig() BadgerConfig {
+	return BadgerConfig{
+		GCInterval:     10 * time.Minute,
+		GCDiscardRatio: 0.5,
+	}
+}
 
-	// meh.
-	s.Keys(func(key string) bool {
-		count++
-		return true
-	})
+func (config BadgerConfig) options(storagePath string) badger.Options {
+	opts := badger.DefaultOptions
+	opts.Dir = storagePath
+	opts.ValueDir = storagePath
+	opts.SyncWrites = config.SyncWrites
+
+	if config.MaxTableSize != 0 {
+		opts.MaxTableSize = config.MaxTableSize
+	}
+	if config.LevelOneSize != 0 {
+		opts.LevelOneSize = config.LevelOneSize
+	}
+	if config.NumMemtables != 0 {
+		opts.NumMemtables = config.NumMemtables
+	}
+	if config.LoadTablesToRAM {
+		opts.TableLoadingMode = options.LoadToRAM
+	}
+	if config.ValueThreshold != 0 {
+		opts.ValueThreshold = config.ValueThreshold
+	}
+	if config.ValueLogFileSize != 0 {
+		opts.ValueLogFileSize = config.ValueLogFileSize
+	}
+
+	return opts
+}
+
+type badgerDb struct {
+	db   *badger.DB
+	path string
 
-	return count
+	// counted once when opening the database, then maintained by the writes
+	count *keyCount
+
+	stop      chan struct{}
+	done      sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// Len returns the number of live keys, without scanning them.
+func (s *badgerDb) Len() int {
+	return s.count.Len()
 }
 
 func (s *badgerDb) Set(key string, value string) error {
-	return s.db.Update(func(txn *badger.Txn) error {
+	return s.write(key, 0, func(txn *badger.Txn) error {
 		return txn.Set([]byte(key), []byte(value))
 	})
 }
 
 func (s *badgerDb) SetExpiring(key string, value string, lifetime time.Duration) error {
-	return s.db.Update(func(txn *badger.Txn) error {
-		return txn.SetWithTTL([]byte(key), []byte(value), lifetime)
+	expiration := expiresAt(lifetime)
+
+	prefixed := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(prefixed, expiration)
+	copy(prefixed[8:], value)
+
+	return s.write(key, expiration, func(txn *badger.Txn) error {
+		return txn.SetEntry(&badger.Entry{
+			Key:      []byte(key),
+			Value:    prefixed,
+			UserMeta: expiringMeta,
+			// for badger to collect it eventually
+			ExpiresAt: (expiration + 999) / 1000,
+		})
 	})
 }
 
 func (s *badgerDb) Delete(key string) error {
-	return s.db.Update(func(txn *badger.Txn) error {
+	previous, existed, err := s.update(key, func(txn *badger.Txn) error {
 		return txn.Delete([]byte(key))
 	})
+	if err != nil {
+		return err
+	}
+
+	if existed {
+		s.count.removed(previous)
+	}
+
+	return nil
+}
+
+// write stores a key with the given expiration (zero if it does not
+// expire), and counts it.
+func (s *badgerDb) write(key string, expiration uint64, set func(txn *badger.Txn) error) error {
+	previous, existed, err := s.update(key, set)
+	if err != nil {
+		return err
+	}
+
+	if existed {
+		s.count.removed(previous)
+	}
+	s.count.added(expiration)
+
+	return nil
+}
+
+// update runs a write transaction on a key, and returns the expiration of
+// its previous value if it had one. Reading the key makes concurrent writes
+// to the same key conflict, in which case the transaction is retried: every
+// write sees the value it replaces, and keys are counted exactly once.
+func (s *badgerDb) update(key string, write func(txn *badger.Txn) error) (uint64, bool, error) {
+	for {
+		var previous uint64
+		var existed bool
+
+		err := s.db.Update(func(txn *badger.Txn) error {
+			item, err := txn.Get([]byte(key))
+			if err != nil && err != badger.ErrKeyNotFound {
+				return err
+			}
+
+			if err == nil && !item.IsDeletedOrExpired() {
+				existed = true
+				if previous, err = expiration(item); err != nil {
+					return err
+				}
+			}
+
+			return write(txn)
+		})
+		if err == badger.ErrConflict {
+			continue
+		}
+
+		return previous, existed, err
+	}
 }
 
 func (s *badgerDb) Get(key string) (string, uint64, error) {
 	var value []byte
-	expiresAt := uint64(0)
-	now := uint64(time.Now().Unix())
+	expiration := uint64(0)
 
 	err := s.db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte(key))
@@ -53,24 +204,39 @@ func (s *badgerDb) Get(key string) (string, uint64, error) {
 			return err
 		}
 
-		expiresAt = item.ExpiresAt()
-		if expiresAt != 0 && now >= expiresAt {
-			return KeyExpired
-		}
-
 		if item.IsDeletedOrExpired() {
 			return KeyNotFound
 		}
 
 		value, err = item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
 
-		return err
+		if item.UserMeta()&expiringMeta != 0 {
+			if len(value) < 8 {
+				return errors.New(fmt.Sprintf("corrupted expiring value for key %q", key))
+			}
+
+			expiration = binary.BigEndian.Uint64(value)
+			value = value[8:]
+		} else {
+			// written with badger's own TTL, to the second
+			expiration = item.ExpiresAt() * 1000
+		}
+
+		if expiration != 0 && uint64(time.Now().UnixMilli()) >= expiration {
+			value = nil
+			return KeyExpired
+		}
+
+		return nil
 	})
 
-	return string(value), expiresAt, err
+	return string(value), expiration, err
 }
 
-func (s *badgerDb) Keys(callback func (key string) bool) {
+func (s *badgerDb) Keys(callback func(key string) bool) {
 	s.db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchValues = false
@@ -80,6 +246,10 @@ func (s *badgerDb) Keys(callback func (key string) bool) {
 		for it.Rewind(); it.Valid(); it.Next() {
 			item := it.Item()
 
+			if expired(item) {
+				continue
+			}
+
 			keepGoing := callback(string(item.Key()))
 			if !keepGoing {
 				break
@@ -89,11 +259,144 @@ func (s *badgerDb) Keys(callback func (key string) bool) {
 	})
 }
 
-func NewBadgerDb(logger badger.Logger, storagePath string) (Store, error) {
-	opts := badger.DefaultOptions
-	opts.Dir = storagePath
-	opts.ValueDir = storagePath
-	opts.SyncWrites = false
+// expiration returns when a key expires, in milliseconds since the epoch
+// (zero if it does not).
+func expiration(item *badger.Item) (uint64, error) {
+	if item.UserMeta()&expiringMeta == 0 {
+		// written with badger's own TTL, to the second
+		return item.ExpiresAt() * 1000, nil
+	}
+
+	expiration := uint64(0)
+	err := item.Value(func(value []byte) error {
+		if len(value) < 8 {
+			return errors.New(fmt.Sprintf("corrupted expiring value for key %q", item.Key()))
+		}
+
+		expiration = binary.BigEndian.Uint64(value)
+
+		return nil
+	})
+
+	return expiration, err
+}
+
+// expired tells if a key expired, without waiting for badger to notice it.
+func expired(item *badger.Item) bool {
+	expiration, err := expiration(item)
+
+	return err == nil && expiration != 0 && uint64(time.Now().UnixMilli()) >= expiration
+}
+
+// countKeys counts the live keys of the database, by expiration.
+func countKeys(db *badger.DB) (*keyCount, error) {
+	count := newKeyCount()
+
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if item.IsDeletedOrExpired() {
+				continue
+			}
+
+			expiration, err := expiration(item)
+			if err != nil {
+				return err
+			}
+
+			count.added(expiration)
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+// Flush syncs the value log, which the database is recovered from after a
+// crash. The version of badger in use can not be asked to, so the file
+// currently written to is synced through a file descriptor of its own: the
+// previous ones were synced when badger stopped writing to them.
+func (s *badgerDb) Flush() error {
+	files, err := filepath.Glob(filepath.Join(s.path, "*.vlog"))
+	if err != nil || len(files) == 0 {
+		return err
+	}
+
+	// the files are numbered, with leading zeros
+	sort.Strings(files)
+
+	file, err := os.OpenFile(files[len(files)-1], os.O_RDWR, 0)
+	if err != nil {
+		return errors.Wrap(err, "could not sync the value log")
+	}
+	defer file.Close()
+
+	return errors.Wrap(file.Sync(), "could not sync the value log")
+}
+
+// Close stops the garbage collection of the value log, and closes the
+// database, which syncs it.
+func (s *badgerDb) Close() error {
+	var err error
+
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		s.done.Wait()
+
+		err = s.db.Close()
+	})
+
+	return err
+}
+
+// startGCRoutine garbage collects the value log at the given interval.
+func (s *badgerDb) startGCRoutine(logger badger.Logger, interval time.Duration, discardRatio float64) {
+	s.done.Add(1)
+
+	go func() {
+		defer s.done.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.stop:
+				return
+			}
+
+			rewritten := 0
+			var err error
+
+			// each run rewrites a file at most
+			for err == nil {
+				if err = s.db.RunValueLogGC(discardRatio); err == nil {
+					rewritten++
+				}
+			}
+
+			if err != badger.ErrNoRewrite && err != badger.ErrRejected {
+				logger.Errorf("Could not garbage collect the value log: %s", err)
+			} else if rewritten != 0 {
+				logger.Infof("Garbage collected %d value log files", rewritten)
+			}
+		}
+	}()
+}
+
+func NewBadgerDb(logger badger.Logger, storagePath string, config BadgerConfig) (Store, error) {
+	if config.GCInterval > 0 && (config.GCDiscardRatio <= 0 || config.GCDiscardRatio >= 1) {
+		return nil, errors.New(fmt.Sprintf("the discard ratio of the value log GC must be between 0 and 1, got %v", config.GCDiscardRatio))
+	}
+
+	opts := config.options(storagePath)
 	opts.Logger = logger
 
 	db, err := badger.Open(opts)
@@ -101,7 +404,23 @@ func NewBadgerDb(logger badger.Logger, storagePath string) (Store, error) {
 		return nil, err
 	}
 
-	return &badgerDb{
-		db: db,
-	}, nil
+	// the only full scan: the count is maintained from then on
+	count, err := countKeys(db)
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "could not count the keys")
+	}
+
+	store := &badgerDb{
+		db:    db,
+		path:  storagePath,
+		count: count,
+		stop:  make(chan struct{}),
+	}
+
+	if config.GCInterval > 0 {
+		store.startGCRoutine(logger, config.GCInterval, config.GCDiscardRatio)
+	}
+
+	return store, nil
 }
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"fmt"
+	logging "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openBadger(t *testing.T, path string) *badgerDb {
+	logger, _ := logging.NewNullLogger()
+
+	store, err := NewBadgerDb(logger, path, DefaultBadgerConfig())
+	require.NoError(t, err)
+
+	return store.(*badgerDb)
+}
+
+func TestBadgerCountsTheKeysAsTheyAreWritten(t *testing.T) {
+	store := openBadger(t, t.TempDir())
+	defer store.Close()
+
+	require.NoError(t, store.Set("some-key", "some-value"))
+	require.NoError(t, store.Set("some-key", "overwritten"))
+	require.NoError(t, store.SetExpiring("expiring-key", "some-value", time.Hour))
+	require.NoError(t, store.SetExpiring("expiring-key", "overwritten", 2*time.Hour))
+	require.NoError(t, store.Set("deleted-key", "some-value"))
+	require.NoError(t, store.Delete("deleted-key"))
+	require.NoError(t, store.Delete("unknown-key"))
+	require.Equal(t, 2, store.Len())
+
+	// a key losing its lifetime
+	require.NoError(t, store.Set("expiring-key", "persistent"))
+	require.Equal(t, 2, store.Len())
+
+	require.NoError(t, store.Delete("expiring-key"))
+	require.Equal(t, 1, store.Len())
+}
+
+func TestBadgerStopsCountingExpiredKeys(t *testing.T) {
+	store := openBadger(t, t.TempDir())
+	defer store.Close()
+
+	require.NoError(t, store.Set("some-key", "some-value"))
+	require.NoError(t, store.SetExpiring("short-lived-key", "some-value", 50*time.Millisecond))
+	require.NoError(t, store.SetExpiring("long-lived-key", "some-value", time.Hour))
+	require.Equal(t, 3, store.Len())
+
+	time.Sleep(60 * time.Millisecond)
+	require.Equal(t, 2, store.Len())
+
+	// overwriting or deleting an expired key does not count it twice
+	require.NoError(t, store.SetExpiring("short-lived-key", "some-value", time.Hour))
+	require.Equal(t, 3, store.Len())
+	require.NoError(t, store.SetExpiring("expired-key", "some-value", 10*time.Millisecond))
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, store.Delete("expired-key"))
+	require.Equal(t, 3, store.Len())
+}
+
+func TestBadgerCountsTheKeysWhenOpened(t *testing.T) {
+	path := t.TempDir()
+
+	store := openBadger(t, path)
+	require.NoError(t, store.Set("some-key", "some-value"))
+	require.NoError(t, store.SetExpiring("expiring-key", "some-value", time.Hour))
+	require.NoError(t, store.SetExpiring("short-lived-key", "some-value", 500*time.Millisecond))
+	require.NoError(t, store.Close())
+
+	store = openBadger(t, path)
+	defer store.Close()
+
+	require.Equal(t, 3, store.Len())
+
+	time.Sleep(510 * time.Millisecond)
+	require.Equal(t, 2, store.Len())
+}
+
+func TestBadgerCountsConcurrentWritesToTheSameKeyOnce(t *testing.T) {
+	store := openBadger(t, t.TempDir())
+	defer store.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 50; j++ {
+				if j%2 == 0 {
+					require.NoError(t, store.SetExpiring("some-key", fmt.Sprintf("value-%d-%d", i, j), time.Hour+time.Duration(j)*time.Millisecond))
+				} else {
+					require.NoError(t, store.Set("some-key", fmt.Sprintf("value-%d-%d", i, j)))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	require.Equal(t, 1, store.Len())
+}
+
+func TestBadgerFlushesAndClosesCleanly(t *testing.T) {
+	path := t.TempDir()
+
+	store := openBadger(t, path)
+	require.NoError(t, store.Set("some-key", "some-value"))
+	require.NoError(t, store.Flush())
+	require.NoError(t, store.Close())
+	require.NoError(t, store.Close(), "Closing twice should be harmless")
+
+	store = openBadger(t, path)
+	defer store.Close()
+
+	value, _, err := store.Get("some-key")
+	require.NoError(t, err)
+	require.Equal(t, "some-value", value)
+}
+
+func TestBadgerRejectsInvalidDiscardRatios(t *testing.T) {
+	logger, _ := logging.NewNullLogger()
+
+	config := DefaultBadgerConfig()
+	config.GCDiscardRatio = 1
+
+	_, err := NewBadgerDb(logger, t.TempDir(), config)
+	require.Error(t, err)
+}
+
+func TestBadgerGCRoutineStopsWithTheStore(t *testing.T) {
+	logger, _ := logging.NewNullLogger()
+
+	config := DefaultBadgerConfig()
+	config.GCInterval = 10 * time.Millisecond
+	config.ValueLogFileSize = 1 << 20
+
+	store, err := NewBadgerDb(logger, t.TempDir(), config)
+	require.NoError(t, err)
+
+	// the routine runs alongside the writes, and stops with the store
+	for i := 0; i < 100; i++ {
+		require.NoError(t, store.Set("some-key", fmt.Sprintf("value-%d", i)))
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	require.NoError(t, store.Close())
+}
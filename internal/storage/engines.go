@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/K-Phoen/gostore/engine"
+	"github.com/pkg/errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The engines of this package are registered as "memory" and "badger".
+func init() {
+	engine.Register("memory", openSyncMap)
+	engine.Register("badger", openBadgerDb)
+}
+
+// openSyncMap opens the in-memory engine described by a URI such as
+// "memory://?maxmemory=2g&maxmemory-policy=allkeys-lfu".
+func openSyncMap(uri *url.URL, options engine.Options) (engine.Store, error) {
+	config := SyncMapConfig{OnEvict: options.OnEvict}
+	query := newURIQuery(uri)
+
+	query.size("maxmemory", &config.MaxMemory)
+	query.string("maxmemory-policy", &config.Policy)
+	query.int("shards", &config.Shards)
+	query.string("appendonly", &config.AppendOnlyPath)
+	query.string("appendfsync", &config.Fsync)
+	query.size("rewrite-min-size", &config.RewriteMinSize)
+	query.string("snapshot", &config.SnapshotPath)
+	query.duration("snapshot-interval", &config.SnapshotInterval)
+
+	if err := query.finish(); err != nil {
+		return nil, err
+	}
+
+	return NewSyncMap(options.Logger, config)
+}
+
+// openBadgerDb opens the badger engine described by a URI such as
+// "badger:///var/lib/gostore?sync=true". Relative paths are given as
+// "badger://./data".
+func openBadgerDb(uri *url.URL, options engine.Options) (engine.Store, error) {
+	path := BadgerPath(uri)
+	if path == "" {
+		return nil, errors.New(fmt.Sprintf("no path given in storage URI %q", uri.Redacted()))
+	}
+
+	config := DefaultBadgerConfig()
+	query := newURIQuery(uri)
+
+	query.bool("sync", &config.SyncWrites)
+	query.size("max-table-size", &config.MaxTableSize)
+	query.size("level-one-size", &config.LevelOneSize)
+	query.int("memtables", &config.NumMemtables)
+	query.bool("tables-in-ram", &config.LoadTablesToRAM)
+	query.int("value-threshold", &config.ValueThreshold)
+	query.size("value-log-file-size", &config.ValueLogFileSize)
+	query.duration("gc-interval", &config.GCInterval)
+	query.float("gc-discard-ratio", &config.GCDiscardRatio)
+
+	if err := query.finish(); err != nil {
+		return nil, err
+	}
+
+	return NewBadgerDb(options.Logger, path, config)
+}
+
+// BadgerPath returns the directory of the badger engine described by a URI.
+func BadgerPath(uri *url.URL) string {
+	return uri.Host + uri.Path
+}
+
+// uriQuery reads the parameters of a storage URI, remembering the first
+// invalid one and the unknown ones.
+type uriQuery struct {
+	values url.Values
+	used   map[string]bool
+	err    error
+}
+
+func newURIQuery(uri *url.URL) *uriQuery {
+	return &uriQuery{values: uri.Query(), used: make(map[string]bool)}
+}
+
+// parse calls set with the value of the given parameter, if it is set.
+func (query *uriQuery) parse(name string, set func(value string) error) {
+	query.used[name] = true
+
+	if _, exists := query.values[name]; !exists || query.err != nil {
+		return
+	}
+
+	if err := set(query.values.Get(name)); err != nil {
+		query.err = errors.Wrap(err, fmt.Sprintf("invalid %q parameter", name))
+	}
+}
+
+func (query *uriQuery) string(name string, target *string) {
+	query.parse(name, func(value string) error {
+		*target = value
+		return nil
+	})
+}
+
+func (query *uriQuery) int(name string, target *int) {
+	query.parse(name, func(value string) (err error) {
+		*target, err = strconv.Atoi(value)
+		return
+	})
+}
+
+func (query *uriQuery) bool(name string, target *bool) {
+	query.parse(name, func(value string) (err error) {
+		*target, err = strconv.ParseBool(value)
+		return
+	})
+}
+
+func (query *uriQuery) float(name string, target *float64) {
+	query.parse(name, func(value string) (err error) {
+		*target, err = strconv.ParseFloat(value, 64)
+		return
+	})
+}
+
+func (query *uriQuery) duration(name string, target *time.Duration) {
+	query.parse(name, func(value string) (err error) {
+		*target, err = time.ParseDuration(value)
+		return
+	})
+}
+
+func (query *uriQuery) size(name string, target *int64) {
+	query.parse(name, func(value string) (err error) {
+		*target, err = ParseSize(value)
+		return
+	})
+}
+
+// finish returns the first invalid parameter, or lists the unknown ones.
+func (query *uriQuery) finish() error {
+	if query.err != nil {
+		return query.err
+	}
+
+	var unknown []string
+	for name := range query.values {
+		if !query.used[name] {
+			unknown = append(unknown, name)
+		}
+	}
+
+	if len(unknown) != 0 {
+		sort.Strings(unknown)
+		return errors.New(fmt.Sprintf("unknown parameters %s", strings.Join(unknown, ", ")))
+	}
+
+	return nil
+}
+
+// ParseSize parses a number of bytes, optionally followed by a unit: "k",
+// "m", "g" or "t" (with or without a trailing "b"). Units are powers of 1024.
+func ParseSize(size string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"t", 1 << 40},
+		{"g", 1 << 30},
+		{"m", 1 << 20},
+		{"k", 1 << 10},
+	}
+
+	number := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(size)), "b")
+	multiplier := int64(1)
+
+	for _, unit := range units {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSuffix(number, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || value < 0 {
+		return 0, errors.New(fmt.Sprintf("invalid size %q", size))
+	}
+
+	if value > (1<<63-1)/multiplier {
+		return 0, errors.New(fmt.Sprintf("size %q is too large", size))
+	}
+
+	return value * multiplier, nil
+}
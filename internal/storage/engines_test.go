@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"github.com/K-Phoen/gostore/engine"
+	logging "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+)
+
+func TestSizesCanBeParsed(t *testing.T) {
+	tt := []struct {
+		size string
+		want int64
+	}{
+		{"1024", 1024},
+		{"100k", 100 << 10},
+		{"512mb", 512 << 20},
+		{"2g", 2 << 30},
+		{"2GB", 2 << 30},
+		{"1t", 1 << 40},
+	}
+
+	for _, tc := range tt {
+		size, err := ParseSize(tc.size)
+
+		require.NoError(t, err, tc.size)
+		require.Equal(t, tc.want, size, tc.size)
+	}
+
+	for _, invalid := range []string{"", "g", "-1k", "1.5g", "some size", "9999999999t"} {
+		_, err := ParseSize(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestTheInMemoryEngineIsConfiguredByItsURI(t *testing.T) {
+	logger, _ := logging.NewNullLogger()
+
+	store, err := engine.Open("memory://?maxmemory=2g&maxmemory-policy=allkeys-lfu&shards=4", engine.Options{Logger: logger})
+	require.NoError(t, err)
+	defer store.Close()
+
+	sharded := store.(*shardedMap)
+	require.Len(t, sharded.shards, 4)
+	require.Equal(t, int64(2<<30), sharded.MemoryStats().Max)
+	require.IsType(t, &lfuPolicy{}, sharded.shards[0].config.policy)
+}
+
+func TestTheBadgerEngineIsConfiguredByItsURI(t *testing.T) {
+	logger, _ := logging.NewNullLogger()
+	path := filepath.Join(t.TempDir(), "badger")
+
+	store, err := engine.Open("badger://"+path+"?sync=true&gc-interval=0s", engine.Options{Logger: logger})
+	require.NoError(t, err)
+	defer store.Close()
+
+	require.Equal(t, path, store.(*badgerDb).path)
+}
+
+func TestInvalidEngineURIsAreRejected(t *testing.T) {
+	logger, _ := logging.NewNullLogger()
+
+	for _, uri := range []string{
+		"memory://?maxmemory=lots",
+		"memory://?max-memory=2g",
+		"memory://?maxmemory-policy=unknown",
+		"badger://",
+		"badger:///tmp/gostore?sync=maybe",
+	} {
+		_, err := engine.Open(uri, engine.Options{Logger: logger})
+		require.Error(t, err, uri)
+	}
+}
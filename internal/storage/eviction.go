@@ -0,0 +1,315 @@
+package storage
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/pkg/errors"
+	"math/rand"
+	"time"
+)
+
+// Names of the eviction policies, as given in the configuration.
+const (
+	// NoEviction rejects the writes that do not fit in memory.
+	NoEviction = "noeviction"
+
+	AllKeysLRU    = "allkeys-lru"
+	AllKeysLFU    = "allkeys-lfu"
+	AllKeysRandom = "allkeys-random"
+
+	// the volatile policies only evict keys with a lifetime
+	VolatileLRU    = "volatile-lru"
+	VolatileLFU    = "volatile-lfu"
+	VolatileRandom = "volatile-random"
+)
+
+const (
+	// lfuSamples is how many keys the LFU policy looks at to pick a victim
+	lfuSamples = 5
+	// lfuInitialCount is the count of new keys, so that they are not
+	// evicted right away
+	lfuInitialCount = 5
+	// lfuLogFactor slows the growth of the counts down: a key needs about
+	// a million hits to reach the maximum count
+	lfuLogFactor = 10
+	// lfuDecayPeriod is how long it takes for the count of a key that is
+	// not accessed to be decremented
+	lfuDecayPeriod = time.Minute
+)
+
+// EvictionPolicy picks the keys to evict when the memory is full. Policies
+// are told about every change of the store, and are not safe for concurrent
+// use: the store serializes the calls.
+type EvictionPolicy interface {
+	// Added is called when a key is stored or overwritten. Keys with a
+	// lifetime are volatile.
+	Added(key string, volatile bool)
+	// Accessed is called when a key is read.
+	Accessed(key string)
+	// Removed is called when a key is deleted, expires or is evicted. It
+	// might be called for keys the policy does not know about.
+	Removed(key string)
+
+	// Victim returns the next key to evict, or false when none can be.
+	Victim() (string, bool)
+}
+
+// NewEvictionPolicy creates the eviction policy with the given name. The
+// NoEviction policy is nil.
+func NewEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case NoEviction:
+		return nil, nil
+	case AllKeysLRU:
+		return newLRUPolicy(), nil
+	case AllKeysLFU:
+		return newLFUPolicy(), nil
+	case AllKeysRandom:
+		return newRandomPolicy(), nil
+	case VolatileLRU:
+		return volatileOnly{newLRUPolicy()}, nil
+	case VolatileLFU:
+		return volatileOnly{newLFUPolicy()}, nil
+	case VolatileRandom:
+		return volatileOnly{newRandomPolicy()}, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("unknown eviction policy %q", name))
+}
+
+// volatileOnly restricts a policy to the keys with a lifetime.
+type volatileOnly struct {
+	EvictionPolicy
+}
+
+func (policy volatileOnly) Added(key string, volatile bool) {
+	if !volatile {
+		// it might have been volatile before being overwritten
+		policy.EvictionPolicy.Removed(key)
+		return
+	}
+
+	policy.EvictionPolicy.Added(key, volatile)
+}
+
+// keySet is a set of keys from which random ones can be picked.
+type keySet struct {
+	keys  []string
+	index map[string]int
+}
+
+func newKeySet() *keySet {
+	return &keySet{index: make(map[string]int)}
+}
+
+func (set *keySet) Len() int {
+	return len(set.keys)
+}
+
+func (set *keySet) Contains(key string) bool {
+	_, exists := set.index[key]
+
+	return exists
+}
+
+func (set *keySet) Add(key string) {
+	if set.Contains(key) {
+		return
+	}
+
+	set.index[key] = len(set.keys)
+	set.keys = append(set.keys, key)
+}
+
+func (set *keySet) Remove(key string) {
+	i, exists := set.index[key]
+	if !exists {
+		return
+	}
+
+	last := len(set.keys) - 1
+	set.keys[i] = set.keys[last]
+	set.index[set.keys[i]] = i
+
+	set.keys = set.keys[:last]
+	delete(set.index, key)
+}
+
+// Random returns a random key of a non-empty set.
+func (set *keySet) Random() string {
+	return set.keys[rand.Intn(len(set.keys))]
+}
+
+// lruPolicy evicts the least recently used keys.
+type lruPolicy struct {
+	// most recently used keys first
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+func (policy *lruPolicy) Added(key string, volatile bool) {
+	if element, exists := policy.elements[key]; exists {
+		policy.order.MoveToFront(element)
+		return
+	}
+
+	policy.elements[key] = policy.order.PushFront(key)
+}
+
+func (policy *lruPolicy) Accessed(key string) {
+	if element, exists := policy.elements[key]; exists {
+		policy.order.MoveToFront(element)
+	}
+}
+
+func (policy *lruPolicy) Removed(key string) {
+	if element, exists := policy.elements[key]; exists {
+		policy.order.Remove(element)
+		delete(policy.elements, key)
+	}
+}
+
+func (policy *lruPolicy) Victim() (string, bool) {
+	oldest := policy.order.Back()
+	if oldest == nil {
+		return "", false
+	}
+
+	return oldest.Value.(string), true
+}
+
+// randomPolicy evicts random keys.
+type randomPolicy struct {
+	keys *keySet
+}
+
+func newRandomPolicy() *randomPolicy {
+	return &randomPolicy{keys: newKeySet()}
+}
+
+func (policy *randomPolicy) Added(key string, volatile bool) {
+	policy.keys.Add(key)
+}
+
+func (policy *randomPolicy) Accessed(key string) {
+}
+
+func (policy *randomPolicy) Removed(key string) {
+	policy.keys.Remove(key)
+}
+
+func (policy *randomPolicy) Victim() (string, bool) {
+	if policy.keys.Len() == 0 {
+		return "", false
+	}
+
+	return policy.keys.Random(), true
+}
+
+type lfuCounter struct {
+	count        uint8
+	lastAccessed time.Time
+}
+
+// lfuPolicy evicts the least frequently used keys. Counts grow
+// logarithmically with the hits, and decay while keys are not accessed,
+// which lets formerly popular keys be evicted. The victim is the least
+// frequently used key of a random sample.
+type lfuPolicy struct {
+	keys     *keySet
+	counters map[string]*lfuCounter
+
+	now func() time.Time
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{
+		keys:     newKeySet(),
+		counters: make(map[string]*lfuCounter),
+
+		now: time.Now,
+	}
+}
+
+func (policy *lfuPolicy) Added(key string, volatile bool) {
+	if _, exists := policy.counters[key]; exists {
+		policy.Accessed(key)
+		return
+	}
+
+	policy.keys.Add(key)
+	policy.counters[key] = &lfuCounter{count: lfuInitialCount, lastAccessed: policy.now()}
+}
+
+func (policy *lfuPolicy) Accessed(key string) {
+	counter, exists := policy.counters[key]
+	if !exists {
+		return
+	}
+
+	counter.count = policy.decayed(counter)
+	counter.lastAccessed = policy.now()
+
+	if counter.count == 255 {
+		return
+	}
+
+	// the higher the count, the less likely it is to be incremented
+	base := 0.0
+	if counter.count > lfuInitialCount {
+		base = float64(counter.count - lfuInitialCount)
+	}
+
+	if rand.Float64() < 1.0/(base*lfuLogFactor+1) {
+		counter.count++
+	}
+}
+
+func (policy *lfuPolicy) Removed(key string) {
+	policy.keys.Remove(key)
+	delete(policy.counters, key)
+}
+
+func (policy *lfuPolicy) Victim() (string, bool) {
+	if policy.keys.Len() == 0 {
+		return "", false
+	}
+
+	var victim string
+	lowest := -1
+
+	for i := 0; i < lfuSamples && i < policy.keys.Len(); i++ {
+		key := policy.keys.keys[i]
+		// small sets are looked at entirely
+		if policy.keys.Len() > lfuSamples {
+			key = policy.keys.Random()
+		}
+
+		count := int(policy.decayed(policy.counters[key]))
+
+		if lowest == -1 || count < lowest {
+			victim = key
+			lowest = count
+		}
+	}
+
+	return victim, true
+}
+
+// decayed returns the count of a key, decremented once per decay period
+// elapsed since it was last accessed.
+func (policy *lfuPolicy) decayed(counter *lfuCounter) uint8 {
+	periods := int64(policy.now().Sub(counter.lastAccessed) / lfuDecayPeriod)
+	if periods >= int64(counter.count) {
+		return 0
+	}
+
+	return counter.count - uint8(periods)
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestUnknownEvictionPoliciesAreRejected(t *testing.T) {
+	_, err := NewEvictionPolicy("most-recently-used")
+	require.Error(t, err)
+
+	policy, err := NewEvictionPolicy(NoEviction)
+	require.NoError(t, err)
+	require.Nil(t, policy)
+}
+
+func TestEvictionPoliciesForgetRemovedKeys(t *testing.T) {
+	for _, name := range []string{AllKeysLRU, AllKeysLFU, AllKeysRandom, VolatileLRU, VolatileLFU, VolatileRandom} {
+		policy, err := NewEvictionPolicy(name)
+		require.NoError(t, err)
+
+		_, found := policy.Victim()
+		require.False(t, found, "%s: there is nothing to evict in an empty store", name)
+
+		policy.Added("some-key", true)
+		policy.Accessed("some-key")
+		policy.Removed("unknown-key")
+
+		victim, found := policy.Victim()
+		require.True(t, found, name)
+		require.Equal(t, "some-key", victim, name)
+
+		policy.Removed("some-key")
+
+		_, found = policy.Victim()
+		require.False(t, found, "%s: removed keys can not be evicted", name)
+	}
+}
+
+func TestVolatilePoliciesIgnoreKeysWithoutLifetime(t *testing.T) {
+	policy, err := NewEvictionPolicy(VolatileRandom)
+	require.NoError(t, err)
+
+	policy.Added("persistent-key", false)
+	_, found := policy.Victim()
+	require.False(t, found)
+
+	policy.Added("some-key", true)
+	// overwritten without lifetime
+	policy.Added("some-key", false)
+	_, found = policy.Victim()
+	require.False(t, found)
+}
+
+func TestLRUPolicyEvictsTheLeastRecentlyUsedKey(t *testing.T) {
+	policy := newLRUPolicy()
+
+	policy.Added("key-1", false)
+	policy.Added("key-2", false)
+	policy.Added("key-3", false)
+	policy.Accessed("key-1")
+
+	victim, _ := policy.Victim()
+	require.Equal(t, "key-2", victim)
+}
+
+func TestLFUPolicyEvictsTheLeastFrequentlyUsedKey(t *testing.T) {
+	now := time.Now()
+	policy := newLFUPolicy()
+	policy.now = func() time.Time { return now }
+
+	policy.Added("popular-key", false)
+	policy.Added("unpopular-key", false)
+
+	for i := 0; i < 100; i++ {
+		policy.Accessed("popular-key")
+	}
+
+	require.True(t, policy.counters["popular-key"].count > lfuInitialCount)
+
+	for i := 0; i < 10; i++ {
+		victim, _ := policy.Victim()
+		require.Equal(t, "unpopular-key", victim)
+	}
+}
+
+func TestLFUCountsDecay(t *testing.T) {
+	now := time.Now()
+	policy := newLFUPolicy()
+	policy.now = func() time.Time { return now }
+
+	policy.Added("some-key", false)
+	counter := policy.counters["some-key"]
+
+	now = now.Add(2 * lfuDecayPeriod)
+	require.Equal(t, uint8(lfuInitialCount-2), policy.decayed(counter))
+
+	now = now.Add(time.Hour)
+	require.Zero(t, policy.decayed(counter))
+}
+
+func TestKeySetsSupportRemovals(t *testing.T) {
+	set := newKeySet()
+
+	set.Add("key-1")
+	set.Add("key-2")
+	set.Add("key-3")
+	set.Add("key-2")
+	require.Equal(t, 3, set.Len())
+
+	set.Remove("key-1")
+	set.Remove("unknown-key")
+	require.Equal(t, 2, set.Len())
+	require.ElementsMatch(t, []string{"key-2", "key-3"}, set.keys)
+
+	for i := 0; i < 10; i++ {
+		require.NotEqual(t, "key-1", set.Random())
+	}
+}
@@ -0,0 +1,67 @@
+package storage
+
+// expiryHeap is a min-heap of the entries with a lifetime, the first one to
+// expire on top. It implements heap.Interface.
+type expiryHeap []*entry
+
+func (h expiryHeap) Len() int {
+	return len(h)
+}
+
+func (h expiryHeap) Less(i, j int) bool {
+	return h[i].expiration < h[j].expiration
+}
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].expiryIndex = i
+	h[j].expiryIndex = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	item := x.(*entry)
+	item.expiryIndex = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	last := len(old) - 1
+
+	item := old[last]
+	old[last] = nil
+	item.expiryIndex = -1
+	*h = old[:last]
+
+	return item
+}
+
+// deadlineHeap is a min-heap of expirations, in milliseconds since the
+// epoch. It implements heap.Interface.
+type deadlineHeap []uint64
+
+func (h deadlineHeap) Len() int {
+	return len(h)
+}
+
+func (h deadlineHeap) Less(i, j int) bool {
+	return h[i] < h[j]
+}
+
+func (h deadlineHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *deadlineHeap) Push(x interface{}) {
+	*h = append(*h, x.(uint64))
+}
+
+func (h *deadlineHeap) Pop() interface{} {
+	old := *h
+	last := len(old) - 1
+
+	deadline := old[last]
+	*h = old[:last]
+
+	return deadline
+}
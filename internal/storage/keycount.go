@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// keyCount maintains the number of live keys of an engine that can not
+// count them cheaply. Keys with a lifetime are counted by expiration, and
+// stop being counted once it is reached: no key has to be kept in memory.
+//
+// Engines tell it about every write, along with the expiration of the
+// previous value of the key, if any.
+type keyCount struct {
+	mutex sync.Mutex
+
+	// keys without lifetime
+	persistent int
+	// keys with a lifetime, by expiration
+	volatile      map[uint64]int
+	volatileTotal int
+	deadlines     deadlineHeap
+}
+
+func newKeyCount() *keyCount {
+	return &keyCount{volatile: make(map[uint64]int)}
+}
+
+// Len returns the number of keys that did not expire yet.
+func (count *keyCount) Len() int {
+	count.mutex.Lock()
+	defer count.mutex.Unlock()
+
+	count.retire()
+
+	return count.persistent + count.volatileTotal
+}
+
+// added counts a key stored with the given expiration (zero if it does not
+// expire).
+func (count *keyCount) added(expiration uint64) {
+	count.mutex.Lock()
+	defer count.mutex.Unlock()
+
+	if expiration == 0 {
+		count.persistent++
+		return
+	}
+
+	count.adjust(expiration, 1)
+}
+
+// removed stops counting a key that was stored with the given expiration,
+// because it was overwritten or deleted.
+func (count *keyCount) removed(expiration uint64) {
+	count.mutex.Lock()
+	defer count.mutex.Unlock()
+
+	if expiration == 0 {
+		count.persistent--
+		return
+	}
+
+	if count.volatile[expiration] == 0 && expiration <= uint64(time.Now().UnixMilli()) {
+		// the key already stopped being counted when it expired
+		return
+	}
+
+	count.adjust(expiration, -1)
+}
+
+// adjust changes the number of keys with the given expiration. Writes are
+// not counted in the order they are committed: the key added by a write can
+// be removed by the next one before being counted, in which case the count
+// of its expiration is negative for a while. Counts dropping to zero are kept
+// until their deadline is retired, for it to be queued only once. It must be
+// called with the lock held.
+func (count *keyCount) adjust(expiration uint64, delta int) {
+	keys, queued := count.volatile[expiration]
+	if !queued {
+		heap.Push(&count.deadlines, expiration)
+	}
+
+	count.volatile[expiration] = keys + delta
+	count.volatileTotal += delta
+}
+
+// retire stops counting the expired keys. It must be called with the lock
+// held.
+func (count *keyCount) retire() {
+	now := uint64(time.Now().UnixMilli())
+
+	for len(count.deadlines) != 0 && count.deadlines[0] <= now {
+		expiration := heap.Pop(&count.deadlines).(uint64)
+
+		count.volatileTotal -= count.volatile[expiration]
+		delete(count.volatile, expiration)
+	}
+}
@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestKeyCountsQueueEachDeadlineOnce(t *testing.T) {
+	count := newKeyCount()
+	expiration := uint64(time.Now().Add(time.Hour).UnixMilli())
+
+	for i := 0; i < 10; i++ {
+		count.added(expiration)
+		count.removed(expiration)
+	}
+
+	require.Equal(t, 0, count.Len())
+	require.Len(t, count.deadlines, 1, "Keys written again with the same expiration should not queue it again")
+}
+
+func TestKeyCountsForgetTheKeysOnceExpired(t *testing.T) {
+	count := newKeyCount()
+	expiration := uint64(time.Now().Add(20 * time.Millisecond).UnixMilli())
+
+	count.added(0)
+	count.added(expiration)
+	count.added(expiration)
+	count.removed(expiration)
+	require.Equal(t, 2, count.Len())
+
+	time.Sleep(40 * time.Millisecond)
+
+	require.Equal(t, 1, count.Len())
+	require.Empty(t, count.deadlines)
+	require.Empty(t, count.volatile)
+
+	// the key was already forgotten
+	count.removed(expiration)
+	require.Equal(t, 1, count.Len())
+}
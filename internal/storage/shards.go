@@ -0,0 +1,311 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// DefaultShards is the number of shards of the in-memory engine, when none
+// is configured.
+const DefaultShards = 16
+
+// DefaultRewriteMinSize is the size the append-only log has to reach before
+// being rewritten, when none is configured.
+const DefaultRewriteMinSize = 64 << 20
+
+type SyncMapConfig struct {
+	// Shards is the number of independently locked shards the keys are
+	// spread over.
+	Shards int
+
+	// MaxMemory is the approximate number of bytes the entries can use,
+	// split evenly between the shards. Zero means no limit. Each shard is
+	// bounded on its own: an entry larger than MaxMemory/Shards is always
+	// rejected, and a bound leaving less than an entry to each shard is
+	// refused.
+	MaxMemory int64
+	// Policy is the name of the eviction policy picking the keys evicted to
+	// make room for writes (see NewEvictionPolicy), AllKeysLRU by default.
+	Policy string
+
+	// OnEvict is called for each entry evicted to make room for a write. It
+	// must not use the store.
+	OnEvict func(key string)
+
+	// AppendOnlyPath is the file the writes are logged to, and replayed from
+	// at startup. The engine is not persisted when empty.
+	AppendOnlyPath string
+	// Fsync tells when the log is synced to the disk: FsyncAlways,
+	// FsyncEverySecond (the default) or FsyncNever.
+	Fsync string
+	// RewriteMinSize is the size the log has to reach before being rewritten.
+	// It is rewritten each time it doubles in size from then on.
+	RewriteMinSize int64
+
+	// SnapshotPath is the file point-in-time snapshots of the engine are
+	// written to, and loaded from at startup unless the append-only log is
+	// enabled: the log is more recent, and the snapshot could bring deleted
+	// keys back. Without log, a snapshot is also written when the engine is
+	// closed. Snapshots are disabled when empty.
+	SnapshotPath string
+	// SnapshotInterval is how often a snapshot is written. Zero means that
+	// snapshots are only written on demand.
+	SnapshotInterval time.Duration
+}
+
+func (config SyncMapConfig) withDefaults() SyncMapConfig {
+	if config.Shards <= 0 {
+		config.Shards = DefaultShards
+	}
+	if config.Policy == "" {
+		config.Policy = AllKeysLRU
+	}
+	if config.Fsync == "" {
+		config.Fsync = FsyncEverySecond
+	}
+	if config.RewriteMinSize == 0 {
+		config.RewriteMinSize = DefaultRewriteMinSize
+	}
+
+	return config
+}
+
+// shardedMap is the in-memory engine: keys are spread over shards, each one
+// with its own lock, memory bound, eviction policy and expiry routine.
+type shardedMap struct {
+	shards []*syncMap
+
+	journal   *appendOnlyLog
+	snapshots *snapshotFile
+
+	closeOnce sync.Once
+}
+
+func (m *shardedMap) shard(key string) *syncMap {
+	// FNV-1a, inlined not to allocate
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+
+	return m.shards[hash%uint32(len(m.shards))]
+}
+
+func (m *shardedMap) Len() int {
+	length := 0
+	for _, shard := range m.shards {
+		length += shard.Len()
+	}
+
+	return length
+}
+
+func (m *shardedMap) Set(key string, value string) error {
+	return m.shard(key).Set(key, value)
+}
+
+func (m *shardedMap) SetExpiring(key string, value string, lifetime time.Duration) error {
+	return m.shard(key).SetExpiring(key, value, lifetime)
+}
+
+func (m *shardedMap) Delete(key string) error {
+	return m.shard(key).Delete(key)
+}
+
+func (m *shardedMap) Get(key string) (string, uint64, error) {
+	return m.shard(key).Get(key)
+}
+
+// Keys iterates over the keys a shard at a time: writers are only blocked
+// while the keys of their shard are copied.
+func (m *shardedMap) Keys(callback func(key string) bool) {
+	keepGoing := true
+
+	for _, shard := range m.shards {
+		shard.Keys(func(key string) bool {
+			keepGoing = callback(key)
+			return keepGoing
+		})
+
+		if !keepGoing {
+			return
+		}
+	}
+}
+
+func (m *shardedMap) MemoryStats() MemoryStats {
+	var stats MemoryStats
+
+	for _, shard := range m.shards {
+		shardStats := shard.MemoryStats()
+
+		stats.Used += shardStats.Used
+		stats.Max += shardStats.Max
+		stats.Evictions += shardStats.Evictions
+		stats.Rejections += shardStats.Rejections
+	}
+
+	return stats
+}
+
+// Snapshot writes a point-in-time snapshot of the store. Each shard is
+// captured under its read lock, which is only held while the entries are
+// listed: entries are never modified once stored, so the snapshot is written
+// without blocking the writers.
+func (m *shardedMap) Snapshot() error {
+	if m.snapshots == nil {
+		return errors.New("snapshots are not enabled")
+	}
+
+	return m.snapshots.write(m.dump)
+}
+
+// Flush syncs the append-only log, if the engine is persisted.
+func (m *shardedMap) Flush() error {
+	if m.journal == nil {
+		return nil
+	}
+
+	return m.journal.flush()
+}
+
+// Close stops the expiry routines and persisting the writes. Without
+// append-only log, a last snapshot is written for the writes since the
+// previous one not to be lost.
+func (m *shardedMap) Close() error {
+	var err error
+
+	m.closeOnce.Do(func() {
+		for _, shard := range m.shards {
+			shard.stopExpiryRoutine()
+		}
+
+		if m.snapshots != nil {
+			m.snapshots.Close()
+
+			if m.journal == nil {
+				err = m.snapshots.write(m.dump)
+			}
+		}
+
+		if m.journal != nil {
+			err = m.journal.Close()
+		}
+	})
+
+	return err
+}
+
+// persist replays the append-only log, then logs the writes to it.
+func (m *shardedMap) persist(logger *log.Logger, config SyncMapConfig) error {
+	journal, err := replayAppendOnlyLog(logger, config.AppendOnlyPath, config.Fsync, m.apply)
+	if err != nil {
+		return err
+	}
+
+	m.journal = journal
+	for _, shard := range m.shards {
+		shard.config.journal = journal
+	}
+
+	journal.start(config.RewriteMinSize, m.dump)
+
+	return nil
+}
+
+// apply replays a record of the append-only log or of a snapshot.
+func (m *shardedMap) apply(r record) {
+	shard := m.shard(r.key)
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	// expired while the node was down
+	if r.op == recordDelete || (r.expiration != 0 && r.expiration <= uint64(time.Now().UnixMilli())) {
+		shard.remove(r.key)
+		return
+	}
+
+	if err := shard.set(r.key, r.value, r.expiration); err != nil {
+		shard.logger.Warnf("Could not restore key %q: %s", r.key, err)
+	}
+}
+
+// dump writes the content of the store as records, a shard at a time.
+func (m *shardedMap) dump(write func(record) error) error {
+	for _, shard := range m.shards {
+		for _, item := range shard.entries() {
+			if err := write(record{op: recordSet, key: item.key, value: item.value, expiration: item.expiration}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func newShardedMap(logger *log.Logger, config SyncMapConfig) (*shardedMap, error) {
+	config = config.withDefaults()
+
+	// rounded up, for small bounds not to become no bound at all
+	shardMemory := (config.MaxMemory + int64(config.Shards) - 1) / int64(config.Shards)
+	if config.MaxMemory != 0 && shardMemory < entryOverhead {
+		return nil, errors.New(fmt.Sprintf("a memory bound of %d bytes can not be split between %d shards: each one needs at least %d bytes", config.MaxMemory, config.Shards, entryOverhead))
+	}
+
+	store := &shardedMap{}
+
+	for i := 0; i < config.Shards; i++ {
+		policy, err := NewEvictionPolicy(config.Policy)
+		if err != nil {
+			return nil, err
+		}
+
+		store.shards = append(store.shards, newSyncMap(logger, shardConfig{
+			maxMemory: shardMemory,
+			policy:    policy,
+			onEvict:   config.OnEvict,
+		}))
+	}
+
+	return store, nil
+}
+
+func NewSyncMap(logger *log.Logger, config SyncMapConfig) (Store, error) {
+	config = config.withDefaults()
+
+	store, err := newShardedMap(logger, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.SnapshotPath != "" {
+		store.snapshots = newSnapshotFile(logger, config.SnapshotPath)
+
+		if config.AppendOnlyPath == "" {
+			if err := store.snapshots.load(store.apply); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if config.AppendOnlyPath != "" {
+		if err := store.persist(logger, config); err != nil {
+			return nil, err
+		}
+	}
+
+	if store.snapshots != nil && config.SnapshotInterval > 0 {
+		store.snapshots.schedule(config.SnapshotInterval, store.dump)
+	}
+
+	for _, shard := range store.shards {
+		shard.startExpiryRoutine()
+	}
+
+	return store, nil
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"fmt"
+	logging "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestShardedMap(t testing.TB, config SyncMapConfig) *shardedMap {
+	logger, _ := logging.NewNullLogger()
+
+	store, err := newShardedMap(logger, config)
+	require.NoError(t, err)
+
+	return store
+}
+
+func TestKeysAreSpreadOverTheShards(t *testing.T) {
+	store := newTestShardedMap(t, SyncMapConfig{Shards: 8})
+
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key-%d", i), "value"))
+	}
+
+	require.Equal(t, 1000, store.Len())
+
+	for _, shard := range store.shards {
+		require.NotZero(t, shard.Len(), "Every shard should hold some keys")
+	}
+
+	keys := make(map[string]bool)
+	store.Keys(func(key string) bool {
+		keys[key] = true
+		return true
+	})
+	require.Len(t, keys, 1000)
+
+	count := 0
+	store.Keys(func(key string) bool {
+		count++
+		return count < 200
+	})
+	require.Equal(t, 200, count, "The iteration should stop across shards")
+}
+
+func TestTheMemoryBoundIsSplitBetweenTheShards(t *testing.T) {
+	store := newTestShardedMap(t, SyncMapConfig{Shards: 4, MaxMemory: 40 * entrySize("key-00", "value")})
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key-%02d", i), "value"))
+	}
+
+	stats := store.MemoryStats()
+	require.Equal(t, 40*entrySize("key-00", "value"), stats.Max)
+	require.True(t, stats.Used <= stats.Max)
+	require.Equal(t, uint64(100-store.Len()), stats.Evictions)
+}
+
+func TestMemoryBoundsTooSmallForTheShardsAreRejected(t *testing.T) {
+	logger, _ := logging.NewNullLogger()
+
+	_, err := NewSyncMap(logger, SyncMapConfig{Shards: 16, MaxMemory: 1024})
+	require.Error(t, err, "No shard could hold an entry")
+
+	_, err = NewSyncMap(logger, SyncMapConfig{Shards: 1, MaxMemory: 1024})
+	require.NoError(t, err)
+}
+
+func TestUnknownPoliciesAreRejected(t *testing.T) {
+	logger, _ := logging.NewNullLogger()
+
+	_, err := NewSyncMap(logger, SyncMapConfig{Policy: "most-recently-used"})
+	require.Error(t, err)
+}
+
+func TestShardsCanBeUsedConcurrently(t *testing.T) {
+	store := newTestShardedMap(t, SyncMapConfig{Shards: 4, MaxMemory: 100 * entrySize("key-00", "value")})
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+
+		go func(worker int) {
+			defer wg.Done()
+
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("key-%02d", (worker*i)%200)
+
+				switch i % 5 {
+				case 0:
+					store.Set(key, "value")
+				case 1:
+					store.SetExpiring(key, "value", time.Millisecond)
+				case 2:
+					store.Get(key)
+				case 3:
+					store.Delete(key)
+				case 4:
+					store.Keys(func(key string) bool {
+						store.Get(key)
+						return true
+					})
+				}
+			}
+		}(worker)
+	}
+
+	wg.Wait()
+}
+
+// The benchmarks compare a single shard (ie: a global lock) with the default
+// number of shards, to run with several values of GOMAXPROCS:
+//
+//	go test ./internal/storage -run XXX -bench SyncMap -cpu 1,2,4,8
+func BenchmarkSyncMapGet(b *testing.B) {
+	benchmarkSyncMap(b, func(store Store, key string, i int) {
+		store.Get(key)
+	})
+}
+
+func BenchmarkSyncMapSet(b *testing.B) {
+	benchmarkSyncMap(b, func(store Store, key string, i int) {
+		store.Set(key, "some-value")
+	})
+}
+
+// 90% of reads and 10% of writes
+func BenchmarkSyncMapMixed(b *testing.B) {
+	benchmarkSyncMap(b, func(store Store, key string, i int) {
+		if i%10 == 0 {
+			store.Set(key, "some-value")
+		} else {
+			store.Get(key)
+		}
+	})
+}
+
+func benchmarkSyncMap(b *testing.B, operation func(store Store, key string, i int)) {
+	const keys = 1 << 16
+
+	names := make([]string, keys)
+	for i := range names {
+		names[i] = fmt.Sprintf("key-%d", i)
+	}
+
+	for _, shards := range []int{1, DefaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			store := newTestShardedMap(b, SyncMapConfig{Shards: shards})
+			for _, key := range names {
+				store.Set(key, "some-value")
+			}
+
+			var worker uint32
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// each worker walks the keys from a different offset
+				i := int(atomic.AddUint32(&worker, 1)) * 7919
+
+				for pb.Next() {
+					operation(store, names[i%keys], i)
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/K-Phoen/gostore/engine"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// snapshotMagic starts every snapshot
+	snapshotMagic = "GOSTORE-SNAP-1\n"
+
+	// snapshots end with the number of records they contain, and the
+	// checksum of everything before it
+	snapshotFooterSize = 12
+)
+
+// ErrSnapshotInProgress is returned when a snapshot is requested while
+// another one is being written.
+var ErrSnapshotInProgress = errors.New("a snapshot is already in progress")
+
+type Snapshotter = engine.Snapshotter
+
+// snapshotFile writes and loads the snapshots of the in-memory engine.
+// Snapshots are made of the same records as the append-only log, with
+// absolute expirations.
+type snapshotFile struct {
+	logger *log.Logger
+	path   string
+
+	// held while a snapshot is written
+	writing sync.Mutex
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+func newSnapshotFile(logger *log.Logger, path string) *snapshotFile {
+	return &snapshotFile{
+		logger: logger,
+		path:   path,
+		stop:   make(chan struct{}),
+	}
+}
+
+// load reads the snapshot, and calls apply for each of its records once it
+// was entirely checked: a corrupted snapshot is rejected rather than half
+// loaded. A missing snapshot is not an error.
+func (snapshot *snapshotFile) load(apply func(record)) error {
+	file, err := os.Open(snapshot.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not open the snapshot")
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Wrap(err, "could not open the snapshot")
+	}
+
+	bodySize := info.Size() - snapshotFooterSize
+	if bodySize < int64(len(snapshotMagic)) {
+		return errors.New(fmt.Sprintf("%s is not a snapshot, or is truncated", snapshot.path))
+	}
+
+	checksum := crc32.NewIEEE()
+	reader := bufio.NewReader(io.TeeReader(io.LimitReader(file, bodySize), checksum))
+
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != snapshotMagic {
+		return errors.New(fmt.Sprintf("%s is not a snapshot", snapshot.path))
+	}
+
+	var records []record
+
+	for {
+		decoded, _, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("corrupted snapshot after %d records", len(records)))
+		}
+
+		records = append(records, decoded)
+	}
+
+	footer := make([]byte, snapshotFooterSize)
+	if _, err := file.ReadAt(footer, bodySize); err != nil {
+		return errors.Wrap(err, "could not read the snapshot")
+	}
+
+	if count := binary.BigEndian.Uint64(footer); count != uint64(len(records)) {
+		return errors.New(fmt.Sprintf("corrupted snapshot: %d records expected, %d found", count, len(records)))
+	}
+	if checksum.Sum32() != binary.BigEndian.Uint32(footer[8:]) {
+		return errors.New("corrupted snapshot: checksum mismatch")
+	}
+
+	for _, r := range records {
+		apply(r)
+	}
+
+	snapshot.logger.Infof("Loaded %d records from the snapshot", len(records))
+
+	return nil
+}
+
+// write replaces the snapshot with the records given by dump. The new
+// snapshot is written next to the current one, which is only replaced once
+// it is complete.
+func (snapshot *snapshotFile) write(dump func(write func(record) error) error) error {
+	if !snapshot.writing.TryLock() {
+		return ErrSnapshotInProgress
+	}
+	defer snapshot.writing.Unlock()
+
+	start := time.Now()
+
+	file, err := os.Create(snapshot.path + ".tmp")
+	if err != nil {
+		return errors.Wrap(err, "could not create the snapshot")
+	}
+
+	count, err := writeSnapshot(file, dump)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), snapshot.path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return errors.Wrap(err, "could not write the snapshot")
+	}
+
+	syncDir(filepath.Dir(snapshot.path))
+
+	snapshot.logger.Infof("Wrote a snapshot of %d records in %s", count, time.Since(start))
+
+	return nil
+}
+
+func writeSnapshot(file *os.File, dump func(write func(record) error) error) (uint64, error) {
+	checksum := crc32.NewIEEE()
+	writer := bufio.NewWriter(io.MultiWriter(file, checksum))
+	count := uint64(0)
+
+	if _, err := writer.WriteString(snapshotMagic); err != nil {
+		return 0, err
+	}
+
+	err := dump(func(r record) error {
+		count++
+		_, err := writer.Write(r.encode())
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := writer.Flush(); err != nil {
+		return 0, err
+	}
+
+	footer := make([]byte, snapshotFooterSize)
+	binary.BigEndian.PutUint64(footer, count)
+	binary.BigEndian.PutUint32(footer[8:], checksum.Sum32())
+
+	_, err = file.Write(footer)
+
+	return count, err
+}
+
+// schedule writes a snapshot at the given interval, until closed.
+func (snapshot *snapshotFile) schedule(interval time.Duration, dump func(write func(record) error) error) {
+	snapshot.done.Add(1)
+
+	go func() {
+		defer snapshot.done.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-snapshot.stop:
+				return
+			}
+
+			if err := snapshot.write(dump); err != nil {
+				snapshot.logger.Errorf("Could not write the scheduled snapshot: %s", err)
+			}
+		}
+	}()
+}
+
+// Close stops the scheduled snapshots, and waits for the one being written.
+func (snapshot *snapshotFile) Close() {
+	close(snapshot.stop)
+	snapshot.done.Wait()
+
+	snapshot.writing.Lock()
+	snapshot.writing.Unlock()
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	logging "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openSnapshottedMap(t *testing.T, config SyncMapConfig) *shardedMap {
+	logger, _ := logging.NewNullLogger()
+
+	store, err := NewSyncMap(logger, config)
+	require.NoError(t, err)
+
+	return store.(*shardedMap)
+}
+
+func TestSnapshotsAreLoadedAtStartup(t *testing.T) {
+	config := SyncMapConfig{SnapshotPath: filepath.Join(t.TempDir(), "gostore.snapshot")}
+
+	store := openSnapshottedMap(t, config)
+	require.NoError(t, store.Set("some-key", "some-value"))
+	require.NoError(t, store.SetExpiring("expiring-key", "some-value", time.Hour))
+	require.NoError(t, store.Snapshot())
+	require.NoError(t, store.Set("written-after-the-snapshot", "some-value"))
+
+	_, expiration, _ := store.Get("expiring-key")
+
+	// as if the node crashed
+	crashed := store
+	defer crashed.Close()
+
+	store = openSnapshottedMap(t, config)
+	defer store.Close()
+
+	require.Equal(t, 2, store.Len())
+
+	value, _, err := store.Get("some-key")
+	require.NoError(t, err)
+	require.Equal(t, "some-value", value)
+
+	_, restoredExpiration, err := store.Get("expiring-key")
+	require.NoError(t, err)
+	require.Equal(t, expiration, restoredExpiration, "Expirations should be absolute")
+}
+
+func TestKeysExpiredSinceTheSnapshotAreNotLoaded(t *testing.T) {
+	config := SyncMapConfig{SnapshotPath: filepath.Join(t.TempDir(), "gostore.snapshot")}
+
+	store := openSnapshottedMap(t, config)
+	require.NoError(t, store.SetExpiring("expiring-key", "some-value", 50*time.Millisecond))
+	require.NoError(t, store.Snapshot())
+	require.NoError(t, store.Close())
+
+	time.Sleep(60 * time.Millisecond)
+
+	store = openSnapshottedMap(t, config)
+	defer store.Close()
+
+	require.Equal(t, 0, store.Len())
+}
+
+func TestCorruptedSnapshotsAreRejected(t *testing.T) {
+	config := SyncMapConfig{SnapshotPath: filepath.Join(t.TempDir(), "gostore.snapshot")}
+
+	store := openSnapshottedMap(t, config)
+	for _, key := range []string{"key-1", "key-2", "key-3"} {
+		require.NoError(t, store.Set(key, "some-value"))
+	}
+	require.NoError(t, store.Snapshot())
+	require.NoError(t, store.Close())
+
+	content, err := os.ReadFile(config.SnapshotPath)
+	require.NoError(t, err)
+
+	logger, _ := logging.NewNullLogger()
+
+	corruptions := map[string][]byte{
+		"flipped byte": append(append(append([]byte{}, content[:20]...), content[20]^0xff), content[21:]...),
+		"truncated":    content[:len(content)-20],
+		"empty":        {},
+	}
+
+	for name, corrupted := range corruptions {
+		require.NoError(t, os.WriteFile(config.SnapshotPath, corrupted, 0644))
+
+		_, err := NewSyncMap(logger, config)
+		require.Error(t, err, name)
+	}
+}
+
+func TestSnapshotsAreScheduled(t *testing.T) {
+	config := SyncMapConfig{
+		SnapshotPath:     filepath.Join(t.TempDir(), "gostore.snapshot"),
+		SnapshotInterval: 50 * time.Millisecond,
+	}
+
+	store := openSnapshottedMap(t, config)
+	defer store.Close()
+	require.NoError(t, store.Set("some-key", "some-value"))
+
+	time.Sleep(100 * time.Millisecond)
+
+	config.SnapshotInterval = 0
+	restored := openSnapshottedMap(t, config)
+	defer restored.Close()
+
+	require.Equal(t, 1, restored.Len())
+}
+
+func TestASnapshotIsWrittenWhenClosed(t *testing.T) {
+	config := SyncMapConfig{SnapshotPath: filepath.Join(t.TempDir(), "gostore.snapshot")}
+
+	store := openSnapshottedMap(t, config)
+	require.NoError(t, store.Set("some-key", "some-value"))
+	require.NoError(t, store.Close())
+
+	store = openSnapshottedMap(t, config)
+	defer store.Close()
+
+	require.Equal(t, 1, store.Len())
+}
+
+func TestTheAppendOnlyLogTakesPrecedenceOverSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	config := SyncMapConfig{
+		SnapshotPath:   filepath.Join(dir, "gostore.snapshot"),
+		AppendOnlyPath: filepath.Join(dir, "gostore.aof"),
+	}
+
+	store := openSnapshottedMap(t, config)
+	require.NoError(t, store.Set("deleted-key", "some-value"))
+	require.NoError(t, store.Snapshot())
+	require.NoError(t, store.Delete("deleted-key"))
+	require.NoError(t, store.Close())
+
+	store = openSnapshottedMap(t, config)
+	defer store.Close()
+
+	_, _, err := store.Get("deleted-key")
+	require.Equal(t, KeyNotFound, err)
+}
+
+func TestSnapshotsRequireAPath(t *testing.T) {
+	store := openSnapshottedMap(t, SyncMapConfig{})
+	defer store.Close()
+
+	require.Error(t, store.Snapshot())
+}
@@ -1,23 +1,25 @@
 package storage
 
 import (
+	"github.com/K-Phoen/gostore/engine"
 	"github.com/pkg/errors"
 	"time"
 )
 
 var (
-	KeyNotFound = errors.New("key not found")
-	KeyExpired = errors.New("key has expired")
+	KeyNotFound = engine.KeyNotFound
+	KeyExpired  = engine.KeyExpired
+	OutOfMemory = errors.New("not enough memory to store the key")
 )
 
-type Store interface {
-	Get(key string) (string, uint64, error)
+// Store is implemented by the engines of this package, see engine.Store.
+type Store = engine.Store
 
-	Set(key string, value string) error
-	SetExpiring(key string, value string, lifetime time.Duration) error
+// expiresAt returns the expiration of a lifetime starting now, in
+// milliseconds since the epoch. It is rounded up, for keys not to expire
+// earlier than asked.
+func expiresAt(lifetime time.Duration) uint64 {
+	deadline := time.Now().Add(lifetime)
 
-	Delete(key string) error
-
-	Len() int
-	Keys(callback func (key string) bool)
-}
\ No newline at end of file
+	return uint64(deadline.Add(time.Millisecond - time.Nanosecond).UnixMilli())
+}
@@ -22,10 +22,14 @@ type storageTestSuite struct {
 func (suite *storageTestSuite) SetupSuite() {
 	logger, _ := logging.NewNullLogger()
 
-	suite.syncMap = NewSyncMap(logger)
+	syncMap, err := NewSyncMap(logger, SyncMapConfig{})
+	if err != nil {
+		panic(fmt.Sprintf("Could not start syncMap storage engine: %s", err))
+	}
+	suite.syncMap = syncMap
 
 	suite.badgerStoragePath = "/tmp/gostore-test-badger-store"
-	badger, err := NewBadgerDb(logger, suite.badgerStoragePath)
+	badger, err := NewBadgerDb(logger, suite.badgerStoragePath, DefaultBadgerConfig())
 	if err != nil {
 		panic(fmt.Sprintf("Could not start badger storage engine: %s", err))
 	}
@@ -33,6 +37,8 @@ func (suite *storageTestSuite) SetupSuite() {
 }
 
 func (suite *storageTestSuite) TearDownSuite() {
+	suite.syncMap.Close()
+	suite.badger.Close()
 	os.RemoveAll(suite.badgerStoragePath)
 }
 
@@ -48,6 +54,32 @@ func (suite *storageTestSuite) TestCommonStorageFeaturesWithBadger() {
 	commonStorageFeaturesAssertions(suite.T(), suite.badger)
 }
 
+func (suite *storageTestSuite) TestSubSecondLifetimesWithSyncMap() {
+	subSecondLifetimesAssertions(suite.T(), suite.syncMap)
+}
+
+func (suite *storageTestSuite) TestSubSecondLifetimesWithBadger() {
+	subSecondLifetimesAssertions(suite.T(), suite.badger)
+}
+
+func subSecondLifetimesAssertions(t *testing.T, store Store) {
+	before := uint64(time.Now().UnixMilli())
+	require.NoError(t, store.SetExpiring("short-lived-key", "some-value", 300*time.Millisecond))
+	after := uint64(time.Now().UnixMilli())
+
+	val, expiration, err := store.Get("short-lived-key")
+	require.NoError(t, err)
+	require.Equal(t, "some-value", val)
+	require.True(t, expiration >= before+300 && expiration <= after+301, "The expiration should be precise to the millisecond")
+
+	time.Sleep(400 * time.Millisecond)
+
+	_, _, err = store.Get("short-lived-key")
+	require.Error(t, err, "The key should have expired")
+
+	store.Delete("short-lived-key")
+}
+
 func commonStorageFeaturesAssertions(t *testing.T, store Store) {
 	require.Equal(t, 0, store.Len(), "An empty store should have no length")
 
@@ -77,8 +109,9 @@ func commonStorageFeaturesAssertions(t *testing.T, store Store) {
 	require.Equal(t, "some-value", val, "Getting a non-expired key should return its value")
 	require.NoError(t, err, "Getting a known, non-expired key should return no error")
 
-	// wait for the key to expire
-	time.Sleep(lifetime)
+	// wait for the key to expire (expirations are rounded up to the
+	// millisecond)
+	time.Sleep(lifetime + time.Millisecond)
 
 	val, _, err = store.Get("expiring-key")
 	require.Equal(t, 0, store.Len(), "Length should be updated after the element has expired")
@@ -1,36 +1,85 @@
 package storage
 
 import (
+	"container/heap"
+	"github.com/K-Phoen/gostore/engine"
 	log "github.com/sirupsen/logrus"
 	"sync"
 	"time"
 )
 
+// entryOverhead approximates the memory used by an entry besides its key and
+// value: map slot, string headers, expiration, policy bookkeeping, ...
+const entryOverhead = 128
+
+// expiryBatchSize is how many expired keys are removed at most while holding
+// the lock, not to stall the writers.
+const expiryBatchSize = 1000
+
+// shardConfig configures a single shard of the in-memory engine.
+type shardConfig struct {
+	// maxMemory is the approximate number of bytes the entries can use.
+	// Zero means no limit.
+	maxMemory int64
+	// policy picks the keys evicted to make room for writes. When nil, the
+	// writes that do not fit are rejected with OutOfMemory.
+	policy EvictionPolicy
+
+	// onEvict is called (with the lock held) for each entry evicted to make
+	// room for a write.
+	onEvict func(key string)
+
+	// journal records the writes, when the engine is persisted
+	journal *appendOnlyLog
+}
+
+type MemoryStats = engine.MemoryStats
+
+type MemoryBounded = engine.MemoryBounded
+
 type entry struct {
+	key   string
 	value string
 
+	// in milliseconds since the epoch, zero if the entry does not expire
 	expiration uint64
+	// position in the expiry heap
+	expiryIndex int
+
+	size int64
 }
 
+// syncMap is a shard of the in-memory engine.
 type syncMap struct {
 	mutex sync.RWMutex
 
-	data map[string]entry
+	data map[string]*entry
+	// entries with a lifetime, by expiration
+	expiries expiryHeap
+	// wakes the expiry routine up when its next deadline changes
+	wakeUp chan struct{}
+	// stops the expiry routine
+	stop chan struct{}
+	done sync.WaitGroup
 
-	logger *log.Logger
+	memory     int64
+	evictions  uint64
+	rejections uint64
 
-	evictionInterval time.Duration
-	// in percent
-	evictionBatchSize int
+	logger *log.Logger
+	config shardConfig
 }
 
-func (e entry) Expired() bool {
+func (e *entry) Expired() bool {
 	if e.expiration == 0 {
 		return false
 	}
 
-	// means that sub-second lifetimes will not work as expected
-	return uint64(time.Now().Unix()) >= e.expiration
+	return uint64(time.Now().UnixMilli()) >= e.expiration
+}
+
+func entrySize(key string, value string) int64 {
+	return int64(len(key)+len(value)) + entryOverhead
 }
 
 func (m *syncMap) Len() int {
@@ -42,31 +91,51 @@ func (m *syncMap) Len() int {
 
 func (m *syncMap) Set(key string, value string) error {
 	m.mutex.Lock()
-	m.data[key] = entry{value: value, expiration: 0}
-	m.mutex.Unlock()
+	defer m.mutex.Unlock()
 
-	return nil
+	return m.write(record{op: recordSet, key: key, value: value})
 }
 
 func (m *syncMap) SetExpiring(key string, value string, lifetime time.Duration) error {
 	m.mutex.Lock()
-	m.data[key] = entry{value: value, expiration: uint64(time.Now().Add(lifetime).Unix())}
-	m.mutex.Unlock()
+	defer m.mutex.Unlock()
 
-	return nil
+	return m.write(record{op: recordSet, key: key, value: value, expiration: expiresAt(lifetime)})
 }
 
 func (m *syncMap) Delete(key string) error {
 	m.mutex.Lock()
-	delete(m.data, key)
-	m.mutex.Unlock()
+	defer m.mutex.Unlock()
+
+	if _, exists := m.data[key]; !exists {
+		return nil
+	}
+
+	// a write that could not be logged is not applied: it would be lost
+	// on restart
+	if err := m.journal(record{op: recordDelete, key: key}); err != nil {
+		return err
+	}
+
+	m.remove(key)
 
 	return nil
 }
 
 func (m *syncMap) Get(key string) (string, uint64, error) {
-	m.mutex.RLock()
-	defer m.mutex.RUnlock()
+	// without policy to tell, live keys are read under the read lock
+	if m.config.policy == nil {
+		m.mutex.RLock()
+		item, exists := m.data[key]
+		if exists && !item.Expired() {
+			m.mutex.RUnlock()
+			return item.value, item.expiration, nil
+		}
+		m.mutex.RUnlock()
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
 	item, exists := m.data[key]
 
@@ -74,20 +143,29 @@ func (m *syncMap) Get(key string) (string, uint64, error) {
 		return "", 0, KeyNotFound
 	}
 
-
 	if item.Expired() {
-		delete(m.data, key)
+		m.remove(key)
 		return "", 0, KeyExpired
 	}
 
+	if m.config.policy != nil {
+		m.config.policy.Accessed(key)
+	}
+
 	return item.value, item.expiration, nil
 }
 
-func (m *syncMap) Keys(callback func (key string) bool) {
+// Keys iterates over a snapshot of the keys, for the callback not to block
+// the writers.
+func (m *syncMap) Keys(callback func(key string) bool) {
 	m.mutex.RLock()
-	defer m.mutex.RUnlock()
-
+	keys := make([]string, 0, len(m.data))
 	for key := range m.data {
+		keys = append(keys, key)
+	}
+	m.mutex.RUnlock()
+
+	for _, key := range keys {
 		keepGoing := callback(key)
 
 		if !keepGoing {
@@ -96,52 +174,289 @@ func (m *syncMap) Keys(callback func (key string) bool) {
 	}
 }
 
-func (m *syncMap) startEvictionRoutine() {
-	ticker := time.NewTicker(m.evictionInterval)
+func (m *syncMap) MemoryStats() MemoryStats {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 
-	go func() {
-		for range ticker.C {
-			m.evictExpired()
+	return MemoryStats{
+		Used:       m.memory,
+		Max:        m.config.maxMemory,
+		Evictions:  m.evictions,
+		Rejections: m.rejections,
+	}
+}
+
+// write logs a set, then applies it once logged: a write that could not be
+// logged would be lost on restart. It must be called with the lock held.
+func (m *syncMap) write(r record) error {
+	size := entrySize(r.key, r.value)
+
+	if err := m.reserve(r.key, size); err != nil {
+		return err
+	}
+
+	if err := m.journal(r); err != nil {
+		return err
+	}
+
+	m.store(r.key, r.value, r.expiration, size)
+
+	return nil
+}
+
+// set stores a key without logging it, as when replaying the append-only log
+// or a snapshot. It must be called with the lock held.
+func (m *syncMap) set(key string, value string, expiration uint64) error {
+	size := entrySize(key, value)
+
+	if err := m.reserve(key, size); err != nil {
+		return err
+	}
+
+	m.store(key, value, expiration, size)
+
+	return nil
+}
+
+// store replaces a key, room having been made for it. It must be called with
+// the lock held.
+func (m *syncMap) store(key string, value string, expiration uint64, size int64) {
+	m.remove(key)
+
+	item := &entry{key: key, value: value, expiration: expiration, size: size}
+	m.data[key] = item
+	m.memory += size
+
+	if expiration != 0 {
+		heap.Push(&m.expiries, item)
+
+		// the expiry routine sleeps until a later deadline
+		if item.expiryIndex == 0 {
+			select {
+			case m.wakeUp <- struct{}{}:
+			default:
+			}
 		}
-	}()
+	}
+
+	if m.config.policy != nil {
+		m.config.policy.Added(key, expiration != 0)
+	}
 }
 
-func (m *syncMap) evictExpired() {
-	m.logger.Debugf("Starting eviction routine")
+// reserve makes room for an entry of the given size replacing the given key:
+// expired entries are evicted first, then the ones picked by the policy. It
+// must be called with the lock held.
+func (m *syncMap) reserve(key string, size int64) error {
+	if m.config.maxMemory == 0 {
+		return nil
+	}
 
-	evictedKeys := 0
+	needed := func() int64 {
+		needed := m.memory + size - m.config.maxMemory
+		if item, exists := m.data[key]; exists {
+			needed -= item.size
+		}
 
-	m.mutex.Lock()
+		return needed
+	}
+
+	if needed() <= 0 {
+		return nil
+	}
+
+	if size > m.config.maxMemory {
+		m.rejections++
+		return OutOfMemory
+	}
+
+	m.removeExpired(-1)
 
-	batchSize := int(float64(len(m.data)) * float64(m.evictionBatchSize) / 100.0)
+	if needed() > 0 && m.config.policy != nil {
+		item, replaced := m.data[key]
 
-	for key, item := range m.data {
-		if item.Expired() {
-			delete(m.data, key)
-			evictedKeys++
+		// the entry being replaced is not a candidate
+		if replaced {
+			m.config.policy.Removed(key)
 		}
 
-		if evictedKeys >= batchSize {
-			break
+		var err error
+
+		for needed() > 0 && err == nil {
+			victim, found := m.config.policy.Victim()
+			if !found {
+				break
+			}
+
+			// evicted keys must not come back after a restart
+			if err = m.journal(record{op: recordDelete, key: victim}); err != nil {
+				break
+			}
+
+			m.remove(victim)
+			m.evictions++
+
+			if m.config.onEvict != nil {
+				m.config.onEvict(victim)
+			}
+		}
+
+		if replaced {
+			m.config.policy.Added(key, item.expiration != 0)
+		}
+
+		if err != nil {
+			return err
 		}
 	}
 
-	m.mutex.Unlock()
+	if needed() > 0 {
+		m.rejections++
+		return OutOfMemory
+	}
 
-	m.logger.Debugf("Evicted %d keys (maximum batch size: %d)", evictedKeys, batchSize)
+	return nil
 }
 
-func NewSyncMap(logger *log.Logger) Store {
-	store := &syncMap{
-		data: make(map[string]entry),
+// journal logs a write, when the engine is persisted. It must be called with
+// the lock held, for the writes of a key to be logged in order.
+func (m *syncMap) journal(r record) error {
+	if m.config.journal == nil {
+		return nil
+	}
 
-		logger: logger,
+	return m.config.journal.append(r)
+}
+
+// entries returns the live entries, for them to be written without holding
+// the lock: entries are never modified once stored.
+func (m *syncMap) entries() []*entry {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 
-		evictionInterval: 10 * time.Second,
-		evictionBatchSize: 20, // percent
+	entries := make([]*entry, 0, len(m.data))
+	for _, item := range m.data {
+		if !item.Expired() {
+			entries = append(entries, item)
+		}
 	}
 
-	store.startEvictionRoutine()
+	return entries
+}
 
-	return store
+// remove deletes a key, if it exists. It must be called with the lock held.
+func (m *syncMap) remove(key string) {
+	item, exists := m.data[key]
+	if !exists {
+		return
+	}
+
+	delete(m.data, key)
+	m.memory -= item.size
+
+	if item.expiration != 0 {
+		heap.Remove(&m.expiries, item.expiryIndex)
+	}
+
+	if m.config.policy != nil {
+		m.config.policy.Removed(key)
+	}
+}
+
+// removeExpired removes up to the given number of expired keys (all of them
+// if negative), and tells how many were removed. It must be called with the
+// lock held.
+func (m *syncMap) removeExpired(limit int) int {
+	removed := 0
+
+	for len(m.expiries) != 0 && m.expiries[0].Expired() && removed != limit {
+		m.remove(m.expiries[0].key)
+		removed++
+	}
+
+	return removed
+}
+
+// nextExpiration tells how long until the next key expires, false if none
+// will. It must be called with the lock held.
+func (m *syncMap) nextExpiration() (time.Duration, bool) {
+	if len(m.expiries) == 0 {
+		return 0, false
+	}
+
+	return time.Until(time.UnixMilli(int64(m.expiries[0].expiration))), true
+}
+
+// startExpiryRoutine removes the keys as they expire, sleeping until the
+// next deadline.
+func (m *syncMap) startExpiryRoutine() {
+	m.done.Add(1)
+
+	go func() {
+		defer m.done.Done()
+
+		timer := time.NewTimer(time.Hour)
+		defer timer.Stop()
+
+		for {
+			next, scheduled := m.evictExpired()
+			if !scheduled {
+				next = time.Hour
+			}
+
+			timer.Reset(next)
+
+			select {
+			case <-timer.C:
+			case <-m.wakeUp:
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopExpiryRoutine stops the expiry routine, and waits for it to return.
+func (m *syncMap) stopExpiryRoutine() {
+	close(m.stop)
+	m.done.Wait()
+}
+
+// evictExpired removes the expired keys, a batch at a time, and tells how
+// long until the next key expires.
+func (m *syncMap) evictExpired() (time.Duration, bool) {
+	evictedKeys := 0
+
+	for {
+		m.mutex.Lock()
+		removed := m.removeExpired(expiryBatchSize)
+		next, scheduled := m.nextExpiration()
+		m.mutex.Unlock()
+
+		evictedKeys += removed
+
+		if removed != expiryBatchSize {
+			if evictedKeys != 0 {
+				m.logger.Debugf("Evicted %d expired keys", evictedKeys)
+			}
+
+			return next, scheduled
+		}
+	}
+}
+
+func newSyncMap(logger *log.Logger, config shardConfig) *syncMap {
+	// without bound, nothing is ever evicted
+	if config.maxMemory == 0 {
+		config.policy = nil
+	}
+
+	return &syncMap{
+		data:   make(map[string]*entry),
+		wakeUp: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+
+		logger: logger,
+		config: config,
+	}
 }
@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"fmt"
 	logging "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/suite"
+	"math/rand"
 	"testing"
 	"time"
 )
@@ -10,22 +12,18 @@ import (
 type syncmapTestSuite struct {
 	suite.Suite
 
-	store syncMap
+	store *syncMap
 }
 
-func (suite *syncmapTestSuite) SetupSuite() {
-	logger, _ := logging.NewNullLogger()
-
-	store := syncMap{
-		data: make(map[string]entry),
-
-		logger: logger,
+func (suite *syncmapTestSuite) SetupTest() {
+	suite.bound(shardConfig{})
+}
 
-		evictionInterval: 250 * time.Millisecond, // not relevant here as we trigger the eviction process manually
-		evictionBatchSize: 100, // percent
-	}
+// bound replaces the store by one configured with the given bound.
+func (suite *syncmapTestSuite) bound(config shardConfig) {
+	logger, _ := logging.NewNullLogger()
 
-	suite.store = store
+	suite.store = newSyncMap(logger, config)
 }
 
 func TestSyncMapTestSuite(t *testing.T) {
@@ -48,4 +46,187 @@ func (suite *syncmapTestSuite) TestEvictionRoutine() {
 	suite.store.evictExpired()
 
 	require.Equal(1, suite.store.Len(), "Length should be correct and the expired key should have been deleted by the eviction routine")
-}
\ No newline at end of file
+	require.Equal(entrySize("known-key", "some-value"), suite.store.MemoryStats().Used, "The memory used by the expired key should be released")
+}
+
+func (suite *syncmapTestSuite) TestMemoryIsAccounted() {
+	require := suite.Require()
+
+	suite.store.Set("some-key", "some-value")
+	suite.store.Set("other-key", "other-value")
+	require.Equal(entrySize("some-key", "some-value")+entrySize("other-key", "other-value"), suite.store.MemoryStats().Used)
+
+	suite.store.Set("some-key", "v")
+	require.Equal(entrySize("some-key", "v")+entrySize("other-key", "other-value"), suite.store.MemoryStats().Used, "Overwritten values should be accounted once")
+
+	suite.store.Delete("some-key")
+	suite.store.Delete("other-key")
+	require.Zero(suite.store.MemoryStats().Used)
+}
+
+func (suite *syncmapTestSuite) TestLeastRecentlyUsedEntriesAreEvicted() {
+	require := suite.Require()
+
+	var evicted []string
+	suite.bound(shardConfig{
+		maxMemory: 3 * entrySize("key-1", "value"),
+		policy:    newLRUPolicy(),
+		onEvict: func(key string) {
+			evicted = append(evicted, key)
+		},
+	})
+
+	require.NoError(suite.store.Set("key-1", "value"))
+	require.NoError(suite.store.Set("key-2", "value"))
+	require.NoError(suite.store.Set("key-3", "value"))
+
+	_, _, err := suite.store.Get("key-1")
+	require.NoError(err)
+
+	require.NoError(suite.store.Set("key-4", "value"))
+	require.Equal([]string{"key-2"}, evicted, "The least recently used key should be evicted")
+
+	// rewriting a key only needs room for the difference
+	require.NoError(suite.store.Set("key-4", "other"))
+	require.Len(evicted, 1)
+
+	require.NoError(suite.store.Set("key-1", "a larger value"))
+	require.Equal([]string{"key-2", "key-3"}, evicted)
+
+	_, _, err = suite.store.Get("key-1")
+	require.NoError(err)
+	_, _, err = suite.store.Get("key-4")
+	require.NoError(err)
+
+	require.Equal(uint64(2), suite.store.MemoryStats().Evictions)
+	require.True(suite.store.MemoryStats().Used <= suite.store.config.maxMemory)
+}
+
+func (suite *syncmapTestSuite) TestWritesCanBeRejectedWhenFull() {
+	require := suite.Require()
+
+	suite.bound(shardConfig{maxMemory: 2 * entrySize("key-1", "value")})
+
+	require.NoError(suite.store.Set("key-1", "value"))
+	require.NoError(suite.store.Set("key-2", "value"))
+	require.Equal(OutOfMemory, suite.store.Set("key-3", "value"))
+	require.NoError(suite.store.Set("key-2", "other"), "Overwriting a key with a value of the same size should fit")
+
+	require.Equal(2, suite.store.Len())
+	require.Equal(uint64(1), suite.store.MemoryStats().Rejections)
+	require.Zero(suite.store.MemoryStats().Evictions)
+}
+
+func (suite *syncmapTestSuite) TestEntriesLargerThanTheLimitAreRejected() {
+	require := suite.Require()
+
+	suite.bound(shardConfig{maxMemory: entrySize("key", "value"), policy: newLRUPolicy()})
+	require.NoError(suite.store.Set("k", "v"))
+
+	require.Equal(OutOfMemory, suite.store.Set("key", "a larger value"))
+
+	_, _, err := suite.store.Get("k")
+	require.NoError(err, "Nothing should be evicted for writes that can not fit")
+}
+
+func (suite *syncmapTestSuite) TestExpiredEntriesAreEvictedFirst() {
+	require := suite.Require()
+
+	suite.bound(shardConfig{maxMemory: 2 * entrySize("key-1", "value"), policy: newLRUPolicy()})
+
+	require.NoError(suite.store.Set("key-1", "value"))
+	require.NoError(suite.store.SetExpiring("key-2", "value", 100*time.Millisecond))
+
+	time.Sleep(150 * time.Millisecond)
+
+	require.NoError(suite.store.Set("key-3", "value"))
+
+	_, _, err := suite.store.Get("key-1")
+	require.NoError(err, "The expired key should have been evicted instead")
+	require.Zero(suite.store.MemoryStats().Evictions, "Expired keys do not count as evictions")
+}
+
+func (suite *syncmapTestSuite) TestVolatilePoliciesOnlyEvictKeysWithALifetime() {
+	require := suite.Require()
+
+	policy, err := NewEvictionPolicy(VolatileLRU)
+	require.NoError(err)
+	suite.bound(shardConfig{maxMemory: 2 * entrySize("key-1", "value"), policy: policy})
+
+	require.NoError(suite.store.Set("key-1", "value"))
+	require.NoError(suite.store.SetExpiring("key-2", "value", time.Minute))
+	require.NoError(suite.store.Set("key-3", "value"))
+
+	_, _, err = suite.store.Get("key-2")
+	require.Equal(KeyNotFound, err, "The key with a lifetime should have been evicted")
+
+	require.Equal(OutOfMemory, suite.store.Set("key-4", "value"), "Keys without lifetime can not be evicted")
+	require.Equal(2, suite.store.Len())
+}
+
+func (suite *syncmapTestSuite) TestExpiredKeysAreRemovedInDeadlineOrder() {
+	require := suite.Require()
+
+	for _, i := range rand.Perm(100) {
+		lifetime := time.Duration(i+1) * time.Millisecond
+		if i%2 == 0 {
+			lifetime += time.Hour
+		}
+
+		require.NoError(suite.store.SetExpiring(fmt.Sprintf("key-%d", i), "value", lifetime))
+	}
+
+	// no longer expiring
+	require.NoError(suite.store.Set("key-1", "value"))
+	// expiring later
+	require.NoError(suite.store.SetExpiring("key-3", "value", time.Hour))
+
+	time.Sleep(150 * time.Millisecond)
+
+	next, scheduled := suite.store.evictExpired()
+	require.True(scheduled)
+	require.True(next > 59*time.Minute, "The next expiration should be the earliest remaining one")
+
+	require.Equal(52, suite.store.Len())
+	require.Len(suite.store.expiries, 51)
+
+	for i, item := range suite.store.expiries {
+		require.Equal(i, item.expiryIndex)
+		require.True(item.expiration >= suite.store.expiries[(i-1)/2].expiration, "The heap should be ordered")
+	}
+}
+
+func (suite *syncmapTestSuite) TestKeysAreRemovedAtTheirDeadline() {
+	require := suite.Require()
+
+	suite.store.startExpiryRoutine()
+	defer suite.store.stopExpiryRoutine()
+
+	require.NoError(suite.store.SetExpiring("later-key", "value", time.Hour))
+	// sooner than what the routine sleeps until
+	require.NoError(suite.store.SetExpiring("sooner-key", "value", 50*time.Millisecond))
+
+	time.Sleep(150 * time.Millisecond)
+
+	suite.store.mutex.Lock()
+	defer suite.store.mutex.Unlock()
+
+	require.Len(suite.store.data, 1, "The expired key should be removed without being read")
+	require.Contains(suite.store.data, "later-key")
+}
+
+func (suite *syncmapTestSuite) TestTheExpiryRoutineCanBeStopped() {
+	require := suite.Require()
+
+	suite.store.startExpiryRoutine()
+	suite.store.stopExpiryRoutine()
+
+	require.NoError(suite.store.SetExpiring("expiring-key", "value", 10*time.Millisecond))
+
+	time.Sleep(50 * time.Millisecond)
+
+	suite.store.mutex.Lock()
+	defer suite.store.mutex.Unlock()
+
+	require.Contains(suite.store.data, "expiring-key", "A stopped routine should not remove expired keys")
+}
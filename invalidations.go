@@ -0,0 +1,268 @@
+package gostore
+
+import (
+	"bufio"
+	"container/heap"
+	"github.com/K-Phoen/gostore/engine"
+	"net"
+	"sync"
+	"time"
+)
+
+// invalidationBuffer is how many invalidations can wait to be sent to a
+// subscriber. Subscribers falling further behind are disconnected: they
+// have to assume that anything they cached is stale.
+const invalidationBuffer = 1024
+
+// invalidationHub broadcasts the keys that changed on this node (written,
+// deleted or expired) to the subscribed clients, which use them to keep
+// their near caches coherent.
+type invalidationHub struct {
+	mutex       sync.Mutex
+	subscribers map[chan string]struct{}
+	// pending expirations of the keys that were written or fetched while
+	// there were subscribers, by key and by deadline
+	expirations map[string]*pendingExpiration
+	deadlines   expirationHeap
+	// fires at the earliest deadline
+	timer *time.Timer
+}
+
+type pendingExpiration struct {
+	key string
+	at  time.Time
+	// position in the deadlines heap
+	index int
+}
+
+func newInvalidationHub() *invalidationHub {
+	return &invalidationHub{
+		subscribers: make(map[chan string]struct{}),
+		expirations: make(map[string]*pendingExpiration),
+	}
+}
+
+func (hub *invalidationHub) subscribe() chan string {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	subscriber := make(chan string, invalidationBuffer)
+	hub.subscribers[subscriber] = struct{}{}
+
+	return subscriber
+}
+
+func (hub *invalidationHub) unsubscribe(subscriber chan string) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	if _, exists := hub.subscribers[subscriber]; exists {
+		delete(hub.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+// invalidate tells every subscriber that the given key changed.
+func (hub *invalidationHub) invalidate(key string) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.publish(key)
+
+	// the timer is left as is: firing early is harmless
+	if pending, exists := hub.expirations[key]; exists {
+		heap.Remove(&hub.deadlines, pending.index)
+		delete(hub.expirations, key)
+	}
+}
+
+// expireAt makes sure that subscribers are told when the given key expires.
+func (hub *invalidationHub) expireAt(key string, expiration time.Time) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	if len(hub.subscribers) == 0 {
+		return
+	}
+
+	if pending, exists := hub.expirations[key]; exists {
+		pending.at = expiration
+		heap.Fix(&hub.deadlines, pending.index)
+	} else {
+		pending := &pendingExpiration{key: key, at: expiration}
+		hub.expirations[key] = pending
+		heap.Push(&hub.deadlines, pending)
+	}
+
+	hub.schedule()
+}
+
+// expire tells the subscribers about the keys whose deadline passed.
+func (hub *invalidationHub) expire() {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	now := time.Now()
+
+	for len(hub.deadlines) != 0 && !hub.deadlines[0].at.After(now) {
+		pending := heap.Pop(&hub.deadlines).(*pendingExpiration)
+		delete(hub.expirations, pending.key)
+
+		hub.publish(pending.key)
+	}
+
+	hub.schedule()
+}
+
+// schedule sets the timer to the earliest deadline. It must be called with
+// the lock held.
+func (hub *invalidationHub) schedule() {
+	if len(hub.deadlines) == 0 {
+		if hub.timer != nil {
+			hub.timer.Stop()
+		}
+		return
+	}
+
+	next := time.Until(hub.deadlines[0].at)
+
+	if hub.timer == nil {
+		hub.timer = time.AfterFunc(next, hub.expire)
+		return
+	}
+
+	hub.timer.Reset(next)
+}
+
+// publish must be called with the lock held.
+func (hub *invalidationHub) publish(key string) {
+	for subscriber := range hub.subscribers {
+		select {
+		case subscriber <- key:
+		default:
+			delete(hub.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+func (hub *invalidationHub) Close() {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	for subscriber := range hub.subscribers {
+		delete(hub.subscribers, subscriber)
+		close(subscriber)
+	}
+
+	hub.expirations = make(map[string]*pendingExpiration)
+	hub.deadlines = nil
+
+	if hub.timer != nil {
+		hub.timer.Stop()
+	}
+}
+
+// expirationHeap orders the pending expirations by deadline.
+type expirationHeap []*pendingExpiration
+
+func (h expirationHeap) Len() int {
+	return len(h)
+}
+
+func (h expirationHeap) Less(i, j int) bool {
+	return h[i].at.Before(h[j].at)
+}
+
+func (h expirationHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expirationHeap) Push(x interface{}) {
+	pending := x.(*pendingExpiration)
+	pending.index = len(*h)
+	*h = append(*h, pending)
+}
+
+func (h *expirationHeap) Pop() interface{} {
+	old := *h
+	pending := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+
+	return pending
+}
+
+// notifyingStore reports every change of the store to an invalidation hub.
+type notifyingStore struct {
+	engine.Store
+
+	hub *invalidationHub
+}
+
+func (store notifyingStore) Set(key string, value string) error {
+	err := store.Store.Set(key, value)
+	store.hub.invalidate(key)
+
+	return err
+}
+
+func (store notifyingStore) SetExpiring(key string, value string, lifetime time.Duration) error {
+	err := store.Store.SetExpiring(key, value, lifetime)
+	store.hub.invalidate(key)
+	store.hub.expireAt(key, time.Now().Add(lifetime))
+
+	return err
+}
+
+func (store notifyingStore) Delete(key string) error {
+	err := store.Store.Delete(key)
+	store.hub.invalidate(key)
+
+	return err
+}
+
+// streamInvalidations turns a client connection into a stream of
+// invalidations: after an empty result acknowledging the subscription, every
+// key that changes on this node is sent as a result. Empty results are sent
+// as heartbeats.
+func (server Server) streamInvalidations(conn net.Conn, reader *bufio.Reader) {
+	subscriber := server.invalidations.subscribe()
+	defer server.invalidations.unsubscribe(subscriber)
+
+	// nothing is expected from the client anymore: a read returning means
+	// that it went away
+	clientGone := make(chan struct{})
+	go func() {
+		conn.SetReadDeadline(time.Time{})
+		reader.Peek(1)
+		close(clientGone)
+	}()
+
+	heartbeat := time.NewTicker(server.config.InvalidationHeartbeat)
+	defer heartbeat.Stop()
+
+	var result Result = VoidResult{}
+
+	for {
+		conn.SetWriteDeadline(time.Now().Add(server.config.WriteTimeout))
+
+		if _, err := conn.Write([]byte(result.String())); err != nil {
+			return
+		}
+
+		select {
+		case key, open := <-subscriber:
+			if !open {
+				return
+			}
+			result = PayloadResult{data: key}
+		case <-heartbeat.C:
+			result = VoidResult{}
+		case <-clientGone:
+			return
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package gostore
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestChangedKeysAreBroadcast(t *testing.T) {
+	hub := newInvalidationHub()
+	defer hub.Close()
+
+	first := hub.subscribe()
+	second := hub.subscribe()
+
+	hub.invalidate("some-key")
+
+	require.Equal(t, "some-key", <-first)
+	require.Equal(t, "some-key", <-second)
+
+	hub.unsubscribe(second)
+	hub.invalidate("other-key")
+
+	require.Equal(t, "other-key", <-first)
+	_, open := <-second
+	require.False(t, open, "Unsubscribed channels should be closed")
+}
+
+func TestExpiredKeysAreBroadcast(t *testing.T) {
+	hub := newInvalidationHub()
+	defer hub.Close()
+
+	// nobody to tell
+	hub.expireAt("some-key", time.Now())
+	require.Empty(t, hub.expirations)
+
+	subscriber := hub.subscribe()
+	hub.expireAt("some-key", time.Now().Add(10*time.Millisecond))
+
+	select {
+	case key := <-subscriber:
+		require.Equal(t, "some-key", key)
+	case <-time.After(time.Second):
+		require.FailNow(t, "the expiration was not broadcast")
+	}
+}
+
+func TestExpirationsShareASingleSchedule(t *testing.T) {
+	hub := newInvalidationHub()
+	defer hub.Close()
+
+	subscriber := hub.subscribe()
+
+	hub.expireAt("later-key", time.Now().Add(40*time.Millisecond))
+	hub.expireAt("rescheduled-key", time.Now().Add(time.Hour))
+	hub.expireAt("sooner-key", time.Now().Add(10*time.Millisecond))
+	hub.expireAt("rescheduled-key", time.Now().Add(20*time.Millisecond))
+	hub.expireAt("overwritten-key", time.Now().Add(30*time.Millisecond))
+	require.Len(t, hub.deadlines, 4)
+
+	// written again: its expiration is no longer pending
+	hub.invalidate("overwritten-key")
+	require.Equal(t, "overwritten-key", <-subscriber)
+
+	for _, expected := range []string{"sooner-key", "rescheduled-key", "later-key"} {
+		select {
+		case key := <-subscriber:
+			require.Equal(t, expected, key, "Keys should be broadcast as they expire")
+		case <-time.After(time.Second):
+			require.FailNow(t, "the expiration was not broadcast", expected)
+		}
+	}
+
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	require.Empty(t, hub.expirations)
+	require.Empty(t, hub.deadlines)
+}
+
+func TestSlowSubscribersAreDisconnected(t *testing.T) {
+	hub := newInvalidationHub()
+	defer hub.Close()
+
+	subscriber := hub.subscribe()
+
+	for i := 0; i <= invalidationBuffer; i++ {
+		hub.invalidate("some-key")
+	}
+
+	received := 0
+	for range subscriber {
+		received++
+	}
+
+	require.Equal(t, invalidationBuffer, received, "The subscriber should be disconnected once its buffer is full")
+}
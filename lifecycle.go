@@ -0,0 +1,163 @@
+package gostore
+
+import (
+	"net"
+	"sync"
+)
+
+// lifecycle is shared by the copies of a server: it tells them when the
+// server stops, and keeps track of what must be waited for before the
+// storage engine can be closed.
+type lifecycle struct {
+	stopping chan struct{}
+	stopOnce sync.Once
+
+	mutex    sync.Mutex
+	listener net.Listener
+
+	// background routines: stabilization and handoffs
+	routines sync.WaitGroup
+
+	connections connTracker
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{
+		stopping:    make(chan struct{}),
+		connections: connTracker{conns: make(map[net.Conn]bool)},
+	}
+}
+
+func (lifecycle *lifecycle) stopped() bool {
+	select {
+	case <-lifecycle.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// listen registers the listener of the server. It returns false if the
+// server already stopped, in which case the listener is closed.
+func (lifecycle *lifecycle) listen(listener net.Listener) bool {
+	lifecycle.mutex.Lock()
+	defer lifecycle.mutex.Unlock()
+
+	if lifecycle.stopped() {
+		listener.Close()
+		return false
+	}
+
+	lifecycle.listener = listener
+
+	return true
+}
+
+// stop tells the routines and the handlers to stop, stops accepting
+// connections and closes the idle ones. It returns false if the server was
+// already stopped.
+func (lifecycle *lifecycle) stop() (bool, error) {
+	stopping := false
+	lifecycle.stopOnce.Do(func() {
+		stopping = true
+	})
+	if !stopping {
+		return false, nil
+	}
+
+	lifecycle.mutex.Lock()
+	close(lifecycle.stopping)
+	listener := lifecycle.listener
+	lifecycle.mutex.Unlock()
+
+	var err error
+	if listener != nil {
+		err = listener.Close()
+	}
+
+	lifecycle.connections.closeIdle()
+
+	return true, err
+}
+
+// connTracker keeps track of the connections being handled, for the idle
+// ones to be closed when the server stops and the others to be waited for.
+type connTracker struct {
+	mutex sync.Mutex
+	// connections waiting for a command are idle
+	conns    map[net.Conn]bool
+	closing  bool
+	handlers sync.WaitGroup
+}
+
+// add registers a connection being handled. It returns false, closing the
+// connection, if the server is stopping.
+func (tracker *connTracker) add(conn net.Conn) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if tracker.closing {
+		conn.Close()
+		return false
+	}
+
+	tracker.conns[conn] = false
+	tracker.handlers.Add(1)
+
+	return true
+}
+
+// remove closes a connection that is no longer handled.
+func (tracker *connTracker) remove(conn net.Conn) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	conn.Close()
+	delete(tracker.conns, conn)
+	tracker.handlers.Done()
+}
+
+// idle marks a connection as waiting for a command. It returns false if the
+// server is stopping, in which case no other command must be read.
+func (tracker *connTracker) idle(conn net.Conn) bool {
+	return tracker.mark(conn, true)
+}
+
+// busy marks a connection as handling a command. It returns false if the
+// connection was closed while idle.
+func (tracker *connTracker) busy(conn net.Conn) bool {
+	return tracker.mark(conn, false)
+}
+
+func (tracker *connTracker) mark(conn net.Conn, idle bool) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if tracker.closing {
+		return false
+	}
+
+	tracker.conns[conn] = idle
+
+	return true
+}
+
+// closeIdle closes the idle connections, and makes the busy ones close once
+// their command is handled.
+func (tracker *connTracker) closeIdle() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.closing = true
+
+	for conn, idle := range tracker.conns {
+		if idle {
+			conn.Close()
+		}
+	}
+}
+
+// wait returns once every connection was handled.
+func (tracker *connTracker) wait() {
+	tracker.handlers.Wait()
+}
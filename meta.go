@@ -0,0 +1,146 @@
+package gostore
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type NodeState string
+
+const (
+	// StateJoining nodes are still receiving their share of the keys
+	StateJoining NodeState = "joining"
+	// StateActive nodes are fully part of the cluster
+	StateActive NodeState = "active"
+	// StateDraining nodes are handing their keys off before leaving
+	StateDraining NodeState = "draining"
+	// StateMaintenance nodes are temporarily under maintenance
+	StateMaintenance NodeState = "maintenance"
+	// StateLeft nodes left the cluster
+	StateLeft NodeState = "left"
+)
+
+// placeable states are the ones in which a node is given ownership of keys:
+// writes go to them.
+func (state NodeState) placeable() bool {
+	return state == StateJoining || state == StateActive
+}
+
+// settled states are the ones in which a node holds the keys it was
+// responsible for before the latest topology change.
+func (state NodeState) settled() bool {
+	return state == StateActive || state == StateDraining || state == StateMaintenance
+}
+
+// NodeMeta is gossiped along with every member of the cluster. It carries
+// what other nodes need to know about a member that memberlist doesn't know
+// itself: the address of its data plane, what it runs and how it should be
+// treated.
+type NodeMeta struct {
+	// Host is empty when the node did not configure an advertise host, in
+	// which case the address seen by memberlist is used.
+	Host string `json:"host,omitempty"`
+	Port int    `json:"port"`
+
+	Version string    `json:"version"`
+	Engine  string    `json:"engine"`
+	State   NodeState `json:"state"`
+	Weight  int       `json:"weight"`
+	Zone    string    `json:"zone,omitempty"`
+
+	// Protocol and Features are empty for nodes predating protocol
+	// negotiation.
+	Protocol uint16    `json:"protocol,omitempty"`
+	Features []Feature `json:"features,omitempty"`
+
+	// HandedOff is the epoch of the latest topology in which the node handed
+	// off all the keys it was not responsible for anymore.
+	HandedOff uint64 `json:"handed_off,omitempty"`
+}
+
+func (meta NodeMeta) String() string {
+	return fmt.Sprintf("state=%s version=%s engine=%s weight=%d zone=%s protocol=%d features=%s", meta.State, meta.Version, meta.Engine, meta.Weight, meta.Zone, meta.Protocol, formatFeatures(meta.Features))
+}
+
+// parseNodeMeta parses metadata rendered by String. Unknown fields are
+// ignored, so that metadata rendered by newer nodes can still be parsed.
+func parseNodeMeta(fields []string) (NodeMeta, error) {
+	var meta NodeMeta
+
+	for _, field := range fields {
+		separator := strings.Index(field, "=")
+		if separator == -1 {
+			return meta, errors.New(fmt.Sprintf("invalid metadata field %q", field))
+		}
+
+		name, value := field[:separator], field[separator+1:]
+
+		var err error
+		switch name {
+		case "state":
+			meta.State = NodeState(value)
+		case "version":
+			meta.Version = value
+		case "engine":
+			meta.Engine = value
+		case "weight":
+			meta.Weight, err = strconv.Atoi(value)
+		case "zone":
+			meta.Zone = value
+		case "protocol":
+			var protocol uint64
+			protocol, err = strconv.ParseUint(value, 10, 16)
+			meta.Protocol = uint16(protocol)
+		case "features":
+			if value != "" {
+				meta.Features = parseFeatures(value)
+			}
+		}
+
+		if err != nil {
+			return meta, errors.Wrap(err, fmt.Sprintf("invalid metadata field %q", field))
+		}
+	}
+
+	return meta, nil
+}
+
+// validateZone rejects the zones that can not be rendered in a node list,
+// where fields are separated by spaces and nodes by new lines.
+func validateZone(zone string) error {
+	if strings.IndexFunc(zone, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) != -1 {
+		return errors.New(fmt.Sprintf("invalid zone %q: zones can not contain spaces nor control characters", zone))
+	}
+
+	return nil
+}
+
+func (meta NodeMeta) supports(feature Feature) bool {
+	return hasFeature(meta.Features, feature)
+}
+
+func (meta NodeMeta) encode() ([]byte, error) {
+	return json.Marshal(meta)
+}
+
+func decodeNodeMeta(data []byte) (NodeMeta, error) {
+	var meta NodeMeta
+
+	if len(data) == 0 {
+		return meta, errors.New("no metadata gossiped")
+	}
+
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, errors.Wrap(err, "invalid metadata")
+	}
+
+	if meta.Port == 0 {
+		return meta, errors.New("no data port in metadata")
+	}
+
+	return meta, nil
+}
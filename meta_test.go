@@ -0,0 +1,67 @@
+package gostore
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestNodeMetaCanBeEncodedAndDecoded(t *testing.T) {
+	meta := NodeMeta{
+		Host:    "10.0.0.1",
+		Port:    4224,
+		Version: "1.2.3",
+		Engine:  "badger",
+		State:   StateDraining,
+		Weight:  3,
+		Zone:    "zone-a",
+
+		Protocol: ProtocolVersion,
+		Features: []Feature{FeatureRPC, FeatureRelayMarker},
+
+		HandedOff: 42,
+	}
+
+	encoded, err := meta.encode()
+	require.NoError(t, err)
+
+	decoded, err := decodeNodeMeta(encoded)
+	require.NoError(t, err)
+	require.Equal(t, meta, decoded)
+}
+
+func TestInvalidNodeMetaIsRejected(t *testing.T) {
+	inputs := [][]byte{
+		nil,
+		[]byte("not json"),
+		[]byte(`{"host": "10.0.0.1"}`),
+	}
+
+	for _, input := range inputs {
+		_, err := decodeNodeMeta(input)
+
+		require.Error(t, err, "input: %q", input)
+	}
+}
+
+func TestZonesThatCanNotBeRenderedAreRejected(t *testing.T) {
+	require.NoError(t, validateZone(""))
+	require.NoError(t, validateZone("eu-west-1a"))
+
+	for _, zone := range []string{"eu west", "eu\twest", "eu\nwest"} {
+		require.Error(t, validateZone(zone), "zone: %q", zone)
+	}
+}
+
+func TestNodeMetaIsRenderedAsKeyValuePairs(t *testing.T) {
+	meta := NodeMeta{Version: "1.2.3", Engine: "memory", State: StateActive, Weight: 1, Zone: "zone-a", Protocol: 1, Features: []Feature{FeatureRPC, FeatureRelayMarker}}
+
+	require.Equal(t, "state=active version=1.2.3 engine=memory weight=1 zone=zone-a protocol=1 features=rpc,relay-marker", meta.String())
+}
+
+func TestNodesPredatingNegotiationSupportNoFeature(t *testing.T) {
+	meta, err := decodeNodeMeta([]byte(`{"port": 4224, "version": "0.1.0", "state": "active"}`))
+
+	require.NoError(t, err)
+	require.Zero(t, meta.Protocol)
+	require.False(t, meta.supports(FeatureRPC))
+}
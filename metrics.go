@@ -0,0 +1,26 @@
+package gostore
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// metrics are counters describing the activity of a node, reported by the
+// "node stats" command.
+type metrics struct {
+	// accessed atomically
+	relayRetries  uint64
+	relayFailures uint64
+}
+
+func (m *metrics) relayRetried() {
+	atomic.AddUint64(&m.relayRetries, 1)
+}
+
+func (m *metrics) relayFailed() {
+	atomic.AddUint64(&m.relayFailures, 1)
+}
+
+func (m *metrics) String() string {
+	return fmt.Sprintf("Relay retries: %d\nRelay failures: %d", atomic.LoadUint64(&m.relayRetries), atomic.LoadUint64(&m.relayFailures))
+}
@@ -0,0 +1,389 @@
+package gostore
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type PoolConfig struct {
+	// maximum number of connections kept open, per peer, between two requests
+	MaxIdle int
+	// maximum number of connections used at the same time, per peer
+	MaxActive int
+
+	// how long to wait for a connection when MaxActive is reached
+	WaitTimeout time.Duration
+	DialTimeout time.Duration
+	// idle connections are closed after this long, it should be shorter than
+	// the peers' IdleTimeout. Zero keeps them open, without checking whether
+	// the peers closed them.
+	IdleTimeout time.Duration
+}
+
+// minHealthCheckInterval bounds how often idle connections are checked.
+const minHealthCheckInterval = 10 * time.Millisecond
+
+// PoolStats is a snapshot of the activity of a connection pool.
+type PoolStats struct {
+	Active int
+	Idle   int
+
+	Dials    uint64
+	Reuses   uint64
+	Waits    uint64
+	WaitTime time.Duration
+	Errors   uint64
+}
+
+type pooledConn struct {
+	net.Conn
+
+	reader   *bufio.Reader
+	peer     *peerPool
+	lastUsed time.Time
+	// reused connections were idle before being used
+	reused bool
+
+	// negotiated during the handshake
+	version   uint16
+	requestID uint64
+}
+
+type peerPool struct {
+	address string
+
+	// one token per connection that can still be used
+	slots chan struct{}
+
+	mutex sync.Mutex
+	idle  []*pooledConn
+}
+
+// connPool keeps connections to the other nodes of the cluster open, so that
+// relaying a command doesn't cost a new connection (and ephemeral port).
+type connPool struct {
+	// accessed atomically, kept first to be 64-bit aligned
+	dials    uint64
+	reuses   uint64
+	waits    uint64
+	waitTime int64
+	errors   uint64
+
+	config PoolConfig
+	// called on every new connection, before it is used
+	handshake func(conn *pooledConn) error
+
+	mutex sync.Mutex
+	peers map[string]*peerPool
+
+	stop    chan struct{}
+	routine sync.WaitGroup
+}
+
+// validate rejects the configurations a pool can not work with.
+func (config PoolConfig) validate() error {
+	if config.MaxActive < 1 {
+		return errors.New(fmt.Sprintf("invalid pool size %d: at least one active connection is needed", config.MaxActive))
+	}
+
+	if config.MaxIdle < 0 || config.WaitTimeout < 0 || config.DialTimeout < 0 || config.IdleTimeout < 0 {
+		return errors.New("pool limits and timeouts can not be negative")
+	}
+
+	return nil
+}
+
+func (s PoolStats) String() string {
+	return fmt.Sprintf("%d active, %d idle, %d dials, %d reuses, %d waits (%s), %d errors", s.Active, s.Idle, s.Dials, s.Reuses, s.Waits, s.WaitTime, s.Errors)
+}
+
+func (pool *connPool) peer(address string) *peerPool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	peer, exists := pool.peers[address]
+	if !exists {
+		peer = &peerPool{
+			address: address,
+			slots:   make(chan struct{}, pool.config.MaxActive),
+		}
+		for i := 0; i < pool.config.MaxActive; i++ {
+			peer.slots <- struct{}{}
+		}
+
+		pool.peers[address] = peer
+	}
+
+	return peer
+}
+
+// get returns a connection to the given address, either reused from the
+// idle ones or freshly dialed. It must be given back with put.
+func (pool *connPool) get(address string) (*pooledConn, error) {
+	peer := pool.peer(address)
+
+	select {
+	case <-peer.slots:
+	default:
+		atomic.AddUint64(&pool.waits, 1)
+		waitStart := time.Now()
+
+		select {
+		case <-peer.slots:
+			atomic.AddInt64(&pool.waitTime, int64(time.Since(waitStart)))
+		case <-time.After(pool.config.WaitTimeout):
+			atomic.AddInt64(&pool.waitTime, int64(time.Since(waitStart)))
+			atomic.AddUint64(&pool.errors, 1)
+
+			return nil, errors.New(fmt.Sprintf("timed out waiting for a connection to %s", address))
+		}
+	}
+
+	if conn := peer.popIdle(pool.config.IdleTimeout); conn != nil {
+		atomic.AddUint64(&pool.reuses, 1)
+		conn.reused = true
+		return conn, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", address, pool.config.DialTimeout)
+	if err != nil {
+		peer.slots <- struct{}{}
+		atomic.AddUint64(&pool.errors, 1)
+
+		return nil, err
+	}
+
+	atomic.AddUint64(&pool.dials, 1)
+
+	pooled := &pooledConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+		peer:   peer,
+	}
+
+	if pool.handshake != nil {
+		conn.SetDeadline(time.Now().Add(pool.config.DialTimeout))
+
+		if err := pool.handshake(pooled); err != nil {
+			conn.Close()
+			peer.slots <- struct{}{}
+			atomic.AddUint64(&pool.errors, 1)
+
+			return nil, errors.Wrap(err, "handshake failed")
+		}
+	}
+
+	return pooled, nil
+}
+
+// put gives a connection back to the pool. Connections that are not healthy
+// (an error occurred while using them) are closed instead of being reused.
+func (pool *connPool) put(conn *pooledConn, healthy bool) {
+	peer := conn.peer
+
+	if !healthy {
+		atomic.AddUint64(&pool.errors, 1)
+	}
+
+	if !healthy || !peer.pushIdle(conn, pool.config.MaxIdle) {
+		conn.Close()
+	}
+
+	peer.slots <- struct{}{}
+}
+
+// dropIdle closes the idle connections to the given address, when the peer
+// most likely closed them.
+func (pool *connPool) dropIdle(address string) {
+	peer := pool.peer(address)
+
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	for _, conn := range peer.idle {
+		conn.Close()
+	}
+	peer.idle = nil
+}
+
+func (peer *peerPool) popIdle(idleTimeout time.Duration) *pooledConn {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	for len(peer.idle) != 0 {
+		conn := peer.idle[len(peer.idle)-1]
+		peer.idle = peer.idle[:len(peer.idle)-1]
+
+		if !conn.expired(idleTimeout) {
+			return conn
+		}
+
+		conn.Close()
+	}
+
+	return nil
+}
+
+func (peer *peerPool) pushIdle(conn *pooledConn, maxIdle int) bool {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	if len(peer.idle) >= maxIdle {
+		return false
+	}
+
+	conn.lastUsed = time.Now()
+	peer.idle = append(peer.idle, conn)
+
+	return true
+}
+
+// checkIdle closes the idle connections that timed out or that were closed
+// by the peer. They are checked out of the pool, for it to be usable
+// meanwhile.
+func (peer *peerPool) checkIdle(idleTimeout time.Duration, maxIdle int) {
+	peer.mutex.Lock()
+	idle := peer.idle
+	peer.idle = nil
+	peer.mutex.Unlock()
+
+	var healthy []*pooledConn
+
+	for _, conn := range idle {
+		if !conn.expired(idleTimeout) && conn.alive() {
+			healthy = append(healthy, conn)
+			continue
+		}
+
+		conn.Close()
+	}
+
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	// the connections given back meanwhile are the most recent ones
+	peer.idle = append(healthy, peer.idle...)
+	for len(peer.idle) > maxIdle {
+		peer.idle[0].Close()
+		peer.idle = peer.idle[1:]
+	}
+}
+
+func (conn *pooledConn) expired(idleTimeout time.Duration) bool {
+	return idleTimeout != 0 && time.Since(conn.lastUsed) >= idleTimeout
+}
+
+// alive tells if the connection was not closed by the peer. An idle
+// connection should have nothing to read: anything else than a timeout
+// means that it can not be used anymore.
+func (conn *pooledConn) alive() bool {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, err := conn.reader.Peek(1)
+	netErr, isNetErr := err.(net.Error)
+
+	return isNetErr && netErr.Timeout()
+}
+
+// startHealthCheckRoutine periodically checks the idle connections, unless
+// they never time out.
+func (pool *connPool) startHealthCheckRoutine() {
+	if pool.config.IdleTimeout == 0 {
+		return
+	}
+
+	interval := pool.config.IdleTimeout / 2
+	if interval < minHealthCheckInterval {
+		interval = minHealthCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+
+	pool.routine.Add(1)
+	go func() {
+		defer pool.routine.Done()
+
+		for {
+			select {
+			case <-ticker.C:
+				for _, peer := range pool.snapshotPeers() {
+					peer.checkIdle(pool.config.IdleTimeout, pool.config.MaxIdle)
+				}
+			case <-pool.stop:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (pool *connPool) snapshotPeers() []*peerPool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	peers := make([]*peerPool, 0, len(pool.peers))
+	for _, peer := range pool.peers {
+		peers = append(peers, peer)
+	}
+
+	return peers
+}
+
+func (pool *connPool) Stats() PoolStats {
+	stats := PoolStats{
+		Dials:    atomic.LoadUint64(&pool.dials),
+		Reuses:   atomic.LoadUint64(&pool.reuses),
+		Waits:    atomic.LoadUint64(&pool.waits),
+		WaitTime: time.Duration(atomic.LoadInt64(&pool.waitTime)),
+		Errors:   atomic.LoadUint64(&pool.errors),
+	}
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for _, peer := range pool.peers {
+		peer.mutex.Lock()
+		stats.Idle += len(peer.idle)
+		stats.Active += pool.config.MaxActive - len(peer.slots)
+		peer.mutex.Unlock()
+	}
+
+	return stats
+}
+
+func (pool *connPool) Close() {
+	close(pool.stop)
+	// the connections being checked are not in the pool
+	pool.routine.Wait()
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for _, peer := range pool.peers {
+		peer.mutex.Lock()
+		for _, conn := range peer.idle {
+			conn.Close()
+		}
+		peer.idle = nil
+		peer.mutex.Unlock()
+	}
+}
+
+func newConnPool(config PoolConfig, handshake func(conn *pooledConn) error) *connPool {
+	pool := &connPool{
+		config:    config,
+		handshake: handshake,
+		peers:     make(map[string]*peerPool),
+		stop:      make(chan struct{}),
+	}
+
+	pool.startHealthCheckRoutine()
+
+	return pool
+}
@@ -0,0 +1,186 @@
+package gostore
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"net"
+	"testing"
+	"time"
+)
+
+type poolTestSuite struct {
+	suite.Suite
+
+	listener net.Listener
+	pool     *connPool
+}
+
+func (suite *poolTestSuite) SetupTest() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	suite.Require().NoError(err)
+
+	// accept connections and keep them open
+	go func() {
+		for {
+			if _, err := listener.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	suite.listener = listener
+	suite.pool = newConnPool(PoolConfig{
+		MaxIdle:     1,
+		MaxActive:   2,
+		WaitTimeout: 50 * time.Millisecond,
+		DialTimeout: time.Second,
+		IdleTimeout: time.Minute,
+	}, nil)
+}
+
+func (suite *poolTestSuite) TearDownTest() {
+	suite.pool.Close()
+	suite.listener.Close()
+}
+
+func TestPoolTestSuite(t *testing.T) {
+	suite.Run(t, new(poolTestSuite))
+}
+
+func (suite *poolTestSuite) TestConnectionsAreReused() {
+	require := suite.Require()
+	address := suite.listener.Addr().String()
+
+	conn, err := suite.pool.get(address)
+	require.NoError(err)
+	suite.pool.put(conn, true)
+
+	reused, err := suite.pool.get(address)
+	require.NoError(err)
+	require.True(conn == reused, "The idle connection should have been reused")
+	suite.pool.put(reused, true)
+
+	stats := suite.pool.Stats()
+	require.Equal(uint64(1), stats.Dials)
+	require.Equal(uint64(1), stats.Reuses)
+	require.Equal(1, stats.Idle)
+	require.Equal(0, stats.Active)
+}
+
+func (suite *poolTestSuite) TestUnhealthyConnectionsAreNotReused() {
+	require := suite.Require()
+	address := suite.listener.Addr().String()
+
+	conn, err := suite.pool.get(address)
+	require.NoError(err)
+	suite.pool.put(conn, false)
+
+	other, err := suite.pool.get(address)
+	require.NoError(err)
+	require.False(conn == other, "The unhealthy connection should not have been reused")
+	suite.pool.put(other, true)
+
+	stats := suite.pool.Stats()
+	require.Equal(uint64(2), stats.Dials)
+	require.Equal(uint64(1), stats.Errors)
+}
+
+func (suite *poolTestSuite) TestTheNumberOfActiveConnectionsIsBounded() {
+	require := suite.Require()
+	address := suite.listener.Addr().String()
+
+	first, err := suite.pool.get(address)
+	require.NoError(err)
+	second, err := suite.pool.get(address)
+	require.NoError(err)
+
+	require.Equal(2, suite.pool.Stats().Active)
+
+	_, err = suite.pool.get(address)
+	require.Error(err, "No connection should be available")
+
+	// a connection given back can be used by whoever waits for it
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		suite.pool.put(first, true)
+	}()
+
+	third, err := suite.pool.get(address)
+	require.NoError(err)
+	require.True(first == third)
+
+	suite.pool.put(second, true)
+	suite.pool.put(third, true)
+
+	stats := suite.pool.Stats()
+	require.Equal(uint64(2), stats.Waits)
+	require.Equal(1, stats.Idle, "Only MaxIdle connections are kept")
+}
+
+func (suite *poolTestSuite) TestConnectionsClosedByThePeerAreDetected() {
+	require := suite.Require()
+
+	// a peer closing every connection right away
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	conn, err := suite.pool.get(listener.Addr().String())
+	require.NoError(err)
+	suite.pool.put(conn, true)
+
+	time.Sleep(10 * time.Millisecond)
+
+	require.False(conn.alive())
+
+	suite.pool.peer(listener.Addr().String()).checkIdle(time.Minute, 1)
+	require.Equal(0, suite.pool.Stats().Idle)
+}
+
+func (suite *poolTestSuite) TestIdleConnectionsCanBeKeptWithoutTimeout() {
+	require := suite.Require()
+	address := suite.listener.Addr().String()
+
+	pool := newConnPool(PoolConfig{MaxIdle: 1, MaxActive: 1, DialTimeout: time.Second}, nil)
+	defer pool.Close()
+
+	conn, err := pool.get(address)
+	require.NoError(err)
+	pool.put(conn, true)
+
+	reused, err := pool.get(address)
+	require.NoError(err)
+	require.True(conn == reused, "The idle connection should have been reused")
+	pool.put(reused, true)
+
+	// timeouts too short to be halved are checked at the minimum interval
+	pool = newConnPool(PoolConfig{MaxIdle: 1, MaxActive: 1, DialTimeout: time.Second, IdleTimeout: time.Nanosecond}, nil)
+	pool.Close()
+}
+
+func TestInvalidPoolConfigurationsAreRejected(t *testing.T) {
+	valid := DefaultConfig().RelayPool
+	require.NoError(t, valid.validate())
+
+	for _, update := range []func(config *PoolConfig){
+		func(config *PoolConfig) { config.MaxActive = 0 },
+		func(config *PoolConfig) { config.MaxIdle = -1 },
+		func(config *PoolConfig) { config.IdleTimeout = -time.Second },
+		func(config *PoolConfig) { config.WaitTimeout = -time.Second },
+	} {
+		config := valid
+		update(&config)
+
+		require.Error(t, config.validate())
+	}
+}
@@ -1,62 +1,165 @@
 package gostore
 
 import (
+	"fmt"
 	"github.com/dgryski/go-farm"
+	"sort"
 	"sync"
 )
 
+type routedNode struct {
+	node Node
+	hash uint64
+	// hash of the address nodes predating ID routing place keys with
+	legacyHash uint64
+}
+
 type Router struct {
-	nodes map[Node]uint64
+	// nodes are indexed by their ID, which is also what we hash to compute
+	// their score: a node changing address keeps the same keys.
+	nodes map[string]routedNode
+
+	// as long as some nodes predate ID routing, keys are placed the way they
+	// do it, on the addresses of the nodes: disagreeing with them on the
+	// owner of the keys would make commands bounce between nodes
+	idRouting bool
+
+	// epoch identifies the current topology: two routers with the same epoch
+	// route keys identically.
+	epoch uint64
 
 	mutex sync.RWMutex
 }
 
 func NewRouter() Router {
 	return Router{
-		nodes: make(map[Node]uint64),
+		nodes: make(map[string]routedNode),
 	}
 }
 
 func (router *Router) AddNode(node Node) {
 	router.mutex.Lock()
-	router.nodes[node] = router.hash(node.Address())
+	router.nodes[node.ID()] = routedNode{
+		node:       node,
+		hash:       router.hash(node.ID()),
+		legacyHash: router.hash(node.LegacyAddress()),
+	}
+	router.updateEpoch()
 	router.mutex.Unlock()
 }
 
 func (router *Router) RemoveNode(node Node) {
 	router.mutex.Lock()
-	delete(router.nodes, node)
+	delete(router.nodes, node.ID())
+	router.updateEpoch()
 	router.mutex.Unlock()
 }
 
+// IDRouting tells if keys are placed on the IDs of the nodes, which is the
+// case once every node supports it.
+func (router *Router) IDRouting() bool {
+	router.mutex.RLock()
+	defer router.mutex.RUnlock()
+
+	return router.idRouting
+}
+
+func (router *Router) Epoch() uint64 {
+	router.mutex.RLock()
+	defer router.mutex.RUnlock()
+
+	return router.epoch
+}
+
+// updateEpoch must be called with the write lock held.
+func (router *Router) updateEpoch() {
+	var topology []string
+
+	router.idRouting = true
+
+	for id, routed := range router.nodes {
+		topology = append(topology, fmt.Sprintf("%s=%s", id, routed.node.Meta().State))
+
+		if !routed.node.Meta().supports(FeatureIDRouting) {
+			router.idRouting = false
+		}
+	}
+
+	sort.Strings(topology)
+
+	router.epoch = router.hash(fmt.Sprint(router.idRouting, topology))
+}
+
+// ResponsibleNode returns the node owning the given key, chosen among the
+// nodes in which keys can be placed. If there are none, all known nodes are
+// considered.
 func (router *Router) ResponsibleNode(key string) Node {
 	router.mutex.RLock()
 	defer router.mutex.RUnlock()
 
+	candidate := router.pick(key, NodeState.placeable)
+	if candidate == nil {
+		candidate = router.pick(key, func(NodeState) bool { return true })
+	}
+
+	return candidate
+}
+
+// PreviousNode returns the node owning the given key, chosen among the nodes
+// that were settled before the latest topology changes. It returns nil if
+// there are none.
+func (router *Router) PreviousNode(key string) Node {
+	router.mutex.RLock()
+	defer router.mutex.RUnlock()
+
+	return router.pick(key, NodeState.settled)
+}
+
+func (router *Router) pick(key string, eligible func(state NodeState) bool) Node {
 	var candidate Node
 	maxScore := uint64(0)
 
 	keyHash := router.hash(key)
 
-	// fixme: bug if two nodes have the save score (iterating over a map doesn't guarantee the order, so two servers
-	//  	  could choose different nodes)
-	for node, nodeHash := range router.nodes {
+	for _, routed := range router.nodes {
+		if !eligible(routed.node.Meta().State) {
+			continue
+		}
+
+		nodeHash := routed.hash
+		if !router.idRouting {
+			nodeHash = routed.legacyHash
+		}
+
 		score := router.mergeHash(nodeHash, keyHash)
 
-		if score > maxScore {
+		// ties are broken on the ID: iterating over a map doesn't guarantee
+		// the order, and every router (nodes and clients alike) must choose
+		// the same node
+		if candidate == nil || score > maxScore || (score == maxScore && router.before(routed.node, candidate)) {
 			maxScore = score
-			candidate = node
+			candidate = routed.node
 		}
 	}
 
 	return candidate
 }
 
-func (router Router) hash(key string) uint64 {
+// before breaks the ties between two nodes, on what keys are placed with.
+// It must be called with the lock held.
+func (router *Router) before(node, other Node) bool {
+	if router.idRouting {
+		return node.ID() < other.ID()
+	}
+
+	return node.LegacyAddress() < other.LegacyAddress()
+}
+
+func (router *Router) hash(key string) uint64 {
 	return farm.Hash64([]byte(key))
 }
 
-func (router Router) mergeHash(serverHash, keyHash uint64) uint64 {
+func (router *Router) mergeHash(serverHash, keyHash uint64) uint64 {
 	a := uint64(1103515245)
 	b := uint64(12345)
 
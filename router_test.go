@@ -1,10 +1,14 @@
 package gostore
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/suite"
 	"testing"
 )
 
+// the nodes of the tests place keys on IDs, unless said otherwise
+var idRouting = []Feature{FeatureIDRouting}
+
 type routerTestSuite struct {
 	suite.Suite
 
@@ -14,9 +18,9 @@ type routerTestSuite struct {
 func (suite *routerTestSuite) SetupTest() {
 	suite.router = NewRouter()
 
-	suite.router.AddNode(NodeRef{host: "192.168.1.20", port: 4242})
-	suite.router.AddNode(NodeRef{host: "192.168.1.30", port: 4242})
-	suite.router.AddNode(NodeRef{host: "192.168.1.40", port: 4242})
+	suite.router.AddNode(NodeRef{id: "node-a", host: "192.168.1.20", port: 4242, meta: NodeMeta{Features: idRouting}})
+	suite.router.AddNode(NodeRef{id: "node-b", host: "192.168.1.30", port: 4242, meta: NodeMeta{Features: idRouting}})
+	suite.router.AddNode(NodeRef{id: "node-c", host: "192.168.1.40", port: 4242, meta: NodeMeta{Features: idRouting}})
 }
 
 func TestRouterTestSuite(t *testing.T) {
@@ -30,19 +34,19 @@ func (suite *routerTestSuite) TestItRoutesKeysBetweenNodes() {
 	}{
 		{
 			"some-key",
-			"192.168.1.20:4242",
+			"node-a",
 		},
 		{
 			"some-other-key",
-			"192.168.1.30:4242",
+			"node-c",
 		},
 		{
 			"yet-another-key",
-			"192.168.1.30:4242",
+			"node-c",
 		},
 		{
 			"last-key-promise",
-			"192.168.1.40:4242",
+			"node-b",
 		},
 	}
 
@@ -51,17 +55,146 @@ func (suite *routerTestSuite) TestItRoutesKeysBetweenNodes() {
 	for _, tc := range tt {
 		node := suite.router.ResponsibleNode(tc.key)
 
-		require.Equal(tc.responsibleNode, node.Address(), tc.key)
+		require.Equal(tc.responsibleNode, node.ID(), tc.key)
 	}
 }
 
 func (suite *routerTestSuite) TestItDoesNotUseRemovedNodes() {
 	require := suite.Require()
 
-	suite.router.RemoveNode(NodeRef{host: "192.168.1.30", port: 4242})
+	suite.router.RemoveNode(NodeRef{id: "node-c", host: "192.168.1.40", port: 4242})
+
+	// this key should be routed to node-c
+	node := suite.router.ResponsibleNode("some-other-key")
+
+	require.Equal("node-a", node.ID())
+}
+
+func (suite *routerTestSuite) TestRoutingDoesNotDependOnAddresses() {
+	require := suite.Require()
+
+	before := suite.router.ResponsibleNode("some-key")
+
+	// node-a restarted with a new address
+	suite.router.RemoveNode(NodeRef{id: "node-a", host: "192.168.1.20", port: 4242})
+	suite.router.AddNode(NodeRef{id: "node-a", host: "192.168.1.50", port: 4343, meta: NodeMeta{Features: idRouting}})
+
+	after := suite.router.ResponsibleNode("some-key")
+
+	require.Equal(before.ID(), after.ID())
+	require.Equal("192.168.1.50:4343", after.Address())
+}
+
+func (suite *routerTestSuite) TestJoiningNodesOwnKeysButAreNotPreviousOwners() {
+	require := suite.Require()
+
+	router := NewRouter()
+	router.AddNode(NodeRef{id: "node-a", meta: NodeMeta{State: StateActive, Features: idRouting}})
+	router.AddNode(NodeRef{id: "node-b", meta: NodeMeta{State: StateActive, Features: idRouting}})
+	router.AddNode(NodeRef{id: "node-c", meta: NodeMeta{State: StateJoining, Features: idRouting}})
+
+	// "last-key-promise" is routed to node-b (see above) and "some-other-key"
+	// to node-c
+	require.Equal("node-b", router.ResponsibleNode("last-key-promise").ID())
+	require.Equal("node-b", router.PreviousNode("last-key-promise").ID())
+
+	require.Equal("node-c", router.ResponsibleNode("some-other-key").ID())
+	require.NotEqual("node-c", router.PreviousNode("some-other-key").ID())
+}
+
+func (suite *routerTestSuite) TestDrainingNodesDoNotOwnKeysButArePreviousOwners() {
+	require := suite.Require()
+
+	router := NewRouter()
+	router.AddNode(NodeRef{id: "node-a", meta: NodeMeta{State: StateActive, Features: idRouting}})
+	router.AddNode(NodeRef{id: "node-b", meta: NodeMeta{State: StateActive, Features: idRouting}})
+	router.AddNode(NodeRef{id: "node-c", meta: NodeMeta{State: StateDraining, Features: idRouting}})
+
+	require.NotEqual("node-c", router.ResponsibleNode("some-other-key").ID())
+	require.Equal("node-c", router.PreviousNode("some-other-key").ID())
+}
+
+func (suite *routerTestSuite) TestKeysAreStillRoutedWhenNoNodeCanOwnThem() {
+	require := suite.Require()
+
+	router := NewRouter()
+	router.AddNode(NodeRef{id: "node-a", meta: NodeMeta{State: StateDraining, Features: idRouting}})
+
+	require.Equal("node-a", router.ResponsibleNode("some-key").ID())
+}
+
+func (suite *routerTestSuite) TestTheEpochChangesWithTheTopology() {
+	require := suite.Require()
+
+	other := NewRouter()
+	other.AddNode(NodeRef{id: "node-c", host: "192.168.1.40", port: 4242, meta: NodeMeta{Features: idRouting}})
+	other.AddNode(NodeRef{id: "node-b", host: "192.168.1.30", port: 4242, meta: NodeMeta{Features: idRouting}})
+	other.AddNode(NodeRef{id: "node-a", host: "192.168.1.20", port: 4242, meta: NodeMeta{Features: idRouting}})
+
+	require.Equal(suite.router.Epoch(), other.Epoch(), "Routers knowing the same nodes share the same epoch")
+
+	other.AddNode(NodeRef{id: "node-a", host: "192.168.1.20", port: 4242, meta: NodeMeta{State: StateDraining, Features: idRouting}})
+	require.NotEqual(suite.router.Epoch(), other.Epoch(), "State changes are topology changes")
+
+	other.RemoveNode(NodeRef{id: "node-a"})
+	require.NotEqual(suite.router.Epoch(), other.Epoch(), "Removed nodes are topology changes")
+}
+
+func (suite *routerTestSuite) TestEveryRouterPicksTheSameNodes() {
+	require := suite.Require()
+
+	other := NewRouter()
+	other.AddNode(NodeRef{id: "node-c", host: "192.168.1.40", port: 4242, meta: NodeMeta{Features: idRouting}})
+	other.AddNode(NodeRef{id: "node-b", host: "192.168.1.30", port: 4242, meta: NodeMeta{Features: idRouting}})
+	other.AddNode(NodeRef{id: "node-a", host: "192.168.1.20", port: 4242, meta: NodeMeta{Features: idRouting}})
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("some-key-%d", i)
+
+		require.Equal(suite.router.ResponsibleNode(key).ID(), other.ResponsibleNode(key).ID(), key)
+	}
+}
+
+func (suite *routerTestSuite) TestKeysArePlacedOnAddressesWhileSomeNodesPredateIDRouting() {
+	require := suite.Require()
+
+	nodes := []NodeRef{
+		{id: "node-a", host: "192.168.1.20", port: 4242, meta: NodeMeta{Features: idRouting}, legacyAddress: "192.168.1.20:4243"},
+		{id: "node-b", host: "192.168.1.30", port: 4242, meta: NodeMeta{Features: idRouting}, legacyAddress: "192.168.1.30:4243"},
+		// an older node
+		{id: "node-c", host: "192.168.1.40", port: 4242, legacyAddress: "192.168.1.40:4243"},
+	}
+
+	router := NewRouter()
+	for _, node := range nodes {
+		router.AddNode(node)
+	}
+
+	require.False(router.IDRouting())
+
+	// older nodes pick the node whose address gets the best score
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("some-key-%d", i)
+
+		var expected NodeRef
+		maxScore := uint64(0)
+		for _, node := range nodes {
+			score := router.mergeHash(router.hash(node.legacyAddress), router.hash(key))
+			if score > maxScore || (score == maxScore && node.legacyAddress < expected.legacyAddress) {
+				maxScore = score
+				expected = node
+			}
+		}
+
+		require.Equal(expected.ID(), router.ResponsibleNode(key).ID(), key)
+	}
+
+	epoch := router.Epoch()
 
-	// this key should be routed to 192.168.1.30:4242
-	node := suite.router.ResponsibleNode("some-key")
+	// the older node is upgraded
+	nodes[2].meta.Features = idRouting
+	router.AddNode(nodes[2])
 
-	require.Equal("192.168.1.20:4242", node.Address())
+	require.True(router.IDRouting())
+	require.NotEqual(epoch, router.Epoch(), "Switching to ID routing moves keys")
 }
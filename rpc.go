@@ -0,0 +1,197 @@
+package gostore
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/K-Phoen/gostore/internal/rpc"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"time"
+)
+
+// toRPCRequest converts a command relayed to another node to the
+// corresponding RPC message.
+func toRPCRequest(cmd Command, epoch uint64) (rpc.Message, error) {
+	switch cmd := cmd.(type) {
+	case *StoreCmd:
+		return &rpc.Set{Epoch: epoch, Key: cmd.key, Value: []byte(cmd.value)}, nil
+	case *StoreExpiringCmd:
+		return &rpc.Set{Epoch: epoch, Key: cmd.key, Value: []byte(cmd.value), TTL: rpcTTL(cmd.lifetime)}, nil
+	case *FetchCmd:
+		return &rpc.Get{Epoch: epoch, Key: cmd.key}, nil
+	case *DelCmd:
+		return &rpc.Delete{Epoch: epoch, Key: cmd.key}, nil
+	case *NodeFetchCmd:
+		return &rpc.Get{Local: true, Key: cmd.key}, nil
+	case *NodeDelCmd:
+		return &rpc.Delete{Local: true, Key: cmd.key}, nil
+	case *NodeHandoffCmd:
+		return &rpc.Transfer{Key: cmd.key, Value: []byte(cmd.value), TTL: rpcTTL(cmd.lifetime)}, nil
+	case *NodeStatsCmd:
+		return &rpc.Stats{}, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("command %q can not be relayed", cmd))
+	}
+}
+
+// fromRPCRequest converts an RPC message received from another node to the
+// command to execute. Routed requests are executed as relayed commands.
+func fromRPCRequest(message rpc.Message) (Command, error) {
+	switch message := message.(type) {
+	case *rpc.Get:
+		if message.Local {
+			return &NodeFetchCmd{key: message.Key}, nil
+		}
+
+		return &RelayedCmd{epoch: message.Epoch, cmd: &FetchCmd{key: message.Key}}, nil
+	case *rpc.Set:
+		if message.TTL == 0 {
+			return &RelayedCmd{epoch: message.Epoch, cmd: &StoreCmd{key: message.Key, value: string(message.Value)}}, nil
+		}
+
+		return &RelayedCmd{epoch: message.Epoch, cmd: &StoreExpiringCmd{key: message.Key, value: string(message.Value), lifetime: message.TTL}}, nil
+	case *rpc.Delete:
+		if message.Local {
+			return &NodeDelCmd{key: message.Key}, nil
+		}
+
+		return &RelayedCmd{epoch: message.Epoch, cmd: &DelCmd{key: message.Key}}, nil
+	case *rpc.Transfer:
+		return &NodeHandoffCmd{key: message.Key, value: string(message.Value), lifetime: message.TTL}, nil
+	case *rpc.Stats:
+		return &NodeStatsCmd{}, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unexpected message of type %d", message.Type()))
+	}
+}
+
+func toRPCResponse(result Result, err error) *rpc.Response {
+	if err != nil {
+		return &rpc.Response{Error: err.Error()}
+	}
+
+	switch result := result.(type) {
+	case PayloadResult:
+		return &rpc.Response{Payload: []byte(result.data), Expiration: result.expiration}
+	case ErrorResult:
+		return &rpc.Response{Error: result.err.Error()}
+	default:
+		return &rpc.Response{}
+	}
+}
+
+// fromRPCResponse converts the response of another node to a result. Errors
+// returned by the node are results too: they are meant for the client.
+func fromRPCResponse(message rpc.Message) (Result, error) {
+	response, ok := message.(*rpc.Response)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unexpected message of type %d in response", message.Type()))
+	}
+
+	if response.Error != "" {
+		return ErrorResult{err: errors.New(response.Error)}, nil
+	}
+
+	return PayloadResult{data: string(response.Payload), expiration: response.Expiration}, nil
+}
+
+// rpcTTL rounds lifetimes up to the precision of the protocol (a
+// millisecond): truncating them would make keys expire early, or never for
+// the lifetimes shorter than a millisecond.
+func rpcTTL(lifetime time.Duration) time.Duration {
+	if lifetime <= 0 || lifetime%time.Millisecond == 0 {
+		return lifetime
+	}
+
+	return lifetime.Truncate(time.Millisecond) + time.Millisecond
+}
+
+// rpcHandshake opens the RPC connections to other nodes.
+func rpcHandshake(conn *pooledConn) error {
+	hello, err := rpc.Handshake(conn, conn.reader, featureNames(localFeatures))
+	if err != nil {
+		return err
+	}
+
+	conn.version = hello.Version
+
+	return nil
+}
+
+func (server *Server) handleRPCConnection(conn net.Conn, reader *bufio.Reader) {
+	magic := make([]byte, len(rpc.Magic))
+	if _, err := io.ReadFull(reader, magic); err != nil || !bytes.Equal(magic, rpc.Magic) {
+		server.logger.Warnf("Invalid RPC preamble received: %q", magic)
+		return
+	}
+
+	negotiated := false
+	// features supported by both nodes
+	var features []Feature
+
+	connections := &server.lifecycle.connections
+
+	for connections.idle(conn) {
+		conn.SetReadDeadline(time.Now().Add(server.config.IdleTimeout))
+
+		frame, err := rpc.ReadFrame(reader)
+		if !connections.busy(conn) {
+			return
+		}
+		if err != nil {
+			if err != io.EOF {
+				server.logger.Warnf("Invalid RPC frame received: %s", err)
+			}
+			return
+		}
+
+		var response rpc.Message
+
+		if hello, isHello := frame.Message.(*rpc.Hello); isHello {
+			response = server.negotiateRPC(hello)
+			if agreed, ok := response.(*rpc.Hello); ok {
+				negotiated = true
+				for _, name := range agreed.Features {
+					features = append(features, Feature(name))
+				}
+			}
+		} else if !negotiated {
+			response = &rpc.Response{Error: "expected a hello message first"}
+		} else {
+			response = server.handleRPCRequest(frame.Message, features)
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(server.config.WriteTimeout))
+
+		if err := rpc.WriteFrame(conn, rpc.Frame{RequestID: frame.RequestID, Message: response}); err != nil {
+			server.logger.Warnf("Could not send RPC response: %s", err)
+			return
+		}
+	}
+}
+
+func (server Server) negotiateRPC(hello *rpc.Hello) rpc.Message {
+	negotiated, err := rpc.Negotiate(hello, featureNames(localFeatures))
+	if err != nil {
+		return &rpc.Response{Error: err.Error()}
+	}
+
+	return negotiated
+}
+
+func (server Server) handleRPCRequest(message rpc.Message, features []Feature) rpc.Message {
+	cmd, err := fromRPCRequest(message)
+	if err != nil {
+		return toRPCResponse(nil, err)
+	}
+
+	response := toRPCResponse(cmd.execute(&server))
+	// older nodes reject the responses with trailing fields
+	if !hasFeature(features, FeatureFetchExpiration) {
+		response.Expiration = 0
+	}
+
+	return response
+}
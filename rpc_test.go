@@ -0,0 +1,25 @@
+package gostore
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestLifetimesAreRoundedUpToTheMillisecond(t *testing.T) {
+	require.Equal(t, time.Duration(0), rpcTTL(0))
+	require.Equal(t, time.Millisecond, rpcTTL(time.Nanosecond))
+	require.Equal(t, 250*time.Millisecond, rpcTTL(250*time.Millisecond))
+	require.Equal(t, 1501*time.Millisecond, rpcTTL(1500*time.Millisecond+time.Microsecond))
+}
+
+func TestExpiringWritesRoundTripThroughRPC(t *testing.T) {
+	cmd := &StoreExpiringCmd{key: "some-key", value: "some-value", lifetime: 250 * time.Millisecond}
+
+	message, err := toRPCRequest(cmd, 0)
+	require.NoError(t, err)
+
+	decoded, err := fromRPCRequest(message)
+	require.NoError(t, err)
+	require.Equal(t, cmd, decoded.(*RelayedCmd).cmd)
+}
@@ -1,43 +1,138 @@
 package gostore
 
 import (
-	"bytes"
+	"bufio"
 	"fmt"
+	"github.com/K-Phoen/gostore/engine"
+	"github.com/K-Phoen/gostore/internal/rpc"
 	"github.com/K-Phoen/gostore/internal/storage"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"net"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// handoffCheckInterval is how often joining nodes check whether their keys
+// were handed off to them.
+const handoffCheckInterval = 100 * time.Millisecond
+
 type Config struct {
+	// NodeID identifies the node in the cluster and is what keys are routed
+	// on. When empty, it is generated once and persisted in StoragePath.
+	NodeID string
+
 	Host string
 	Port int
 
+	// GossipPort is the port used by the cluster membership protocol. It
+	// defaults to the port following Port.
+	GossipPort int
+
+	// AdvertiseHost and AdvertisePort are the address other nodes use to
+	// reach this node, when it differs from the one it listens to (NAT,
+	// port mappings, ...). They default to the detected IP and to Port.
+	AdvertiseHost string
+	AdvertisePort int
+
+	// Weight and Zone are gossiped to the rest of the cluster along with the
+	// node's version and storage engine. Zones can not contain spaces.
+	Weight int
+	Zone   string
+
+	// StoragePath selects the storage engine, as a URI whose scheme is the
+	// name of a registered engine (see the engine package), such as
+	// "memory://?maxmemory=2g" or "badger:///var/lib/gostore?sync=true".
+	// "memory" and plain paths are short for the in-memory engine and for
+	// badger directories. The options of the built-in engines that the URI
+	// does not set are taken from the fields below.
 	StoragePath string
 
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
+	// IdleTimeout is how long a connection opened with a hello is kept open
+	// waiting for the next command
+	IdleTimeout time.Duration
+
+	// RelayPool configures the connections used to relay commands to the
+	// other nodes
+	RelayPool PoolConfig
+	// RelayReadTimeout is how long to wait for the response of a relayed
+	// command
+	RelayReadTimeout time.Duration
+	// RelayRetries is how many times idempotent commands are retried when
+	// relaying them fails, waiting RelayRetryBackoff (doubled each time)
+	// between two attempts
+	RelayRetries      int
+	RelayRetryBackoff time.Duration
 
 	StabilizeInterval time.Duration
-	// percentage of keys in the store to stabilize per batch
+	// percentage of keys in the store to stabilize per batch (at least one
+	// key is)
 	StabilizeBatchSize int
 
-	EvictionInterval time.Duration
-	// percentage of keys in the store to evict per batch
-	EvictionBatchSize int
+	// HandoffDelay is how long topology changes are left to settle before
+	// handing keys off, for bursts of changes to be handled at once. Failed
+	// handoffs are retried after the same delay.
+	HandoffDelay time.Duration
+	// HandoffConcurrency is how many keys are handed off at once
+	HandoffConcurrency int
+
+	// JoinWarmup is how long a node stays in the "joining" state after
+	// joining a cluster when some of its members can not tell that they
+	// handed its keys off to it. Otherwise, it becomes active as soon as
+	// they did.
+	JoinWarmup time.Duration
+
+	// InvalidationHeartbeat is how often clients subscribed to invalidations
+	// are sent a heartbeat when no key changes
+	InvalidationHeartbeat time.Duration
+
+	// MaxMemory is the approximate number of bytes the in-memory engine can
+	// use, zero meaning no limit. It is split evenly between the shards of
+	// the engine (16 unless configured otherwise in StoragePath), and writes
+	// larger than the share of a shard are rejected. Once it is reached,
+	// MaxMemoryPolicy picks the keys to evict: "allkeys-lru", "allkeys-lfu",
+	// "allkeys-random", their "volatile-" variants only evicting keys with a
+	// lifetime, or "noeviction" to reject the writes.
+	MaxMemory       int64
+	MaxMemoryPolicy string
+
+	// AppendOnlyPath is the file the writes of the in-memory engine are
+	// logged to, and replayed from at startup. The in-memory engine is not
+	// persisted when empty. AppendOnlyFsync tells when the log is synced to
+	// the disk: "always", "everysec" or "no".
+	AppendOnlyPath  string
+	AppendOnlyFsync string
+
+	// SnapshotPath is the file snapshots of the in-memory engine are written
+	// to, by the "node snapshot" command or every SnapshotInterval (zero to
+	// only snapshot on demand). The snapshot is loaded at startup, unless
+	// the append-only log is enabled.
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+
+	// Badger tunes the disk-backed engine
+	Badger storage.BadgerConfig
 }
 
 type Server struct {
 	config Config
 
 	logger  *log.Logger
-	store   storage.Store
+	store   engine.Store
 	cluster *Cluster
+	relays  *connPool
+	metrics *metrics
+
+	invalidations *invalidationHub
 
-	listener net.Listener
-	stopped  bool
+	lifecycle *lifecycle
 }
 
 func DefaultConfig() Config {
@@ -45,31 +140,114 @@ func DefaultConfig() Config {
 		Host: "0.0.0.0",
 		Port: 4224,
 
+		Weight: 1,
+
 		StoragePath: "memory",
 
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
+		IdleTimeout:  time.Minute,
+
+		RelayPool: PoolConfig{
+			MaxIdle:     8,
+			MaxActive:   64,
+			WaitTimeout: time.Second,
+			DialTimeout: time.Second,
+			IdleTimeout: 30 * time.Second,
+		},
+		RelayReadTimeout:  5 * time.Second,
+		RelayRetries:      2,
+		RelayRetryBackoff: 50 * time.Millisecond,
 
 		StabilizeInterval:  5 * time.Minute,
 		StabilizeBatchSize: 5, // percent
+
+		HandoffDelay:       500 * time.Millisecond,
+		HandoffConcurrency: 16,
+
+		JoinWarmup: 30 * time.Second,
+
+		InvalidationHeartbeat: 5 * time.Second,
+
+		MaxMemoryPolicy: storage.AllKeysLRU,
+
+		AppendOnlyFsync: storage.FsyncEverySecond,
+
+		Badger: storage.DefaultBadgerConfig(),
 	}
 }
 
-func (server Server) handleConnection(conn net.Conn) {
-	defer conn.Close()
+// gossipPort is the port used by the cluster membership protocol.
+func (config Config) gossipPort() int {
+	if config.GossipPort != 0 {
+		return config.GossipPort
+	}
 
-	conn.SetReadDeadline(time.Now().Add(server.config.ReadTimeout))
-	conn.SetWriteDeadline(time.Now().Add(server.config.WriteTimeout))
+	return config.Port + 1
+}
 
-	cmd, err := parseCommand(conn)
-	if err != nil {
-		server.logger.Warnf("Invalid command received: %s", err)
-		io.Copy(conn, strings.NewReader(fmt.Sprintf("-%d\n%s", len(err.Error()), err)))
+func (server *Server) handleConnection(conn net.Conn) {
+	connections := &server.lifecycle.connections
+	if !connections.add(conn) {
 		return
 	}
+	defer connections.remove(conn)
+
+	reader := bufio.NewReader(conn)
+
+	// connections are closed after a single command, as older nodes relaying
+	// commands read their result until then. Clients opening them with a
+	// hello can reuse them.
+	keepAlive := false
+
+	for connections.idle(conn) {
+		conn.SetReadDeadline(time.Now().Add(server.config.IdleTimeout))
+
+		first, err := reader.Peek(1)
+		if err != nil || !connections.busy(conn) {
+			return
+		}
+
+		// other nodes talk to us using a dedicated binary protocol
+		if first[0] == rpc.Magic[0] {
+			server.handleRPCConnection(conn, reader)
+			return
+		}
+
+		conn.SetReadDeadline(time.Now().Add(server.config.ReadTimeout))
+		conn.SetWriteDeadline(time.Now().Add(server.config.WriteTimeout))
+
+		cmd, err := parseCommand(reader)
+		if err != nil {
+			server.logger.Warnf("Invalid command received: %s", err)
+			server.respond(conn, ErrorResult{err: err})
+			return
+		}
+
+		// the connection is dedicated to invalidations from now on: as it
+		// waits for them, it is closed as soon as the server stops
+		if _, subscribing := cmd.(*NodeInvalidationsCmd); subscribing {
+			if connections.idle(conn) {
+				server.streamInvalidations(conn, reader)
+			}
+			return
+		}
+
+		server.handleCommand(conn, cmd)
+
+		if _, hello := cmd.(*HelloCmd); hello {
+			keepAlive = true
+		}
+
+		if !keepAlive {
+			return
+		}
+	}
+}
 
+func (server Server) handleCommand(dest net.Conn, cmd Command) {
 	if !cmd.distributed() {
-		server.execute(conn, cmd)
+		server.execute(dest, cmd)
 		return
 	}
 
@@ -77,49 +255,293 @@ func (server Server) handleConnection(conn net.Conn) {
 
 	// distributed command, but we happen to be the node responsible for it
 	if server.cluster.LocalNode().SameAs(responsibleNode) {
-		server.execute(conn, cmd)
+		server.execute(dest, cmd)
 		return
 	}
 
-	server.relayCommand(conn, cmd, responsibleNode)
+	// older nodes only send commands to the node they think owns them:
+	// relaying them again could make them bounce between nodes. As they are
+	// told apart by their host, so are the clients sharing it.
+	if server.cluster.FromLegacyNode(dest.RemoteAddr()) {
+		server.execute(dest, cmd)
+		return
+	}
+
+	result, err := server.relay(cmd, responsibleNode)
+	if err != nil {
+		server.logger.Errorf("Could not relay command: %s", err)
+		result = ErrorResult{err: err}
+	}
+
+	server.respond(dest, result)
+}
+
+// relay sends a command to another node and returns its response.
+// Idempotent commands are retried with an exponential backoff.
+func (server Server) relay(cmd Command, remote Node) (Result, error) {
+	attempts := 1
+	if cmd.idempotent() {
+		attempts += server.config.RelayRetries
+	}
+
+	var result Result
+	var err error
+
+	backoff := server.config.RelayRetryBackoff
+
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt != 0 {
+			server.metrics.relayRetried()
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		result, err = server.relayOnce(cmd, remote)
+		if err == nil {
+			return result, nil
+		}
+
+		server.logger.Warnf("Could not relay command to node %s (attempt %d/%d): %s", remote.Address(), attempt+1, attempts, err)
+	}
+
+	server.metrics.relayFailed()
+
+	return nil, errors.Wrap(err, fmt.Sprintf("could not reach node %s (%s)", remote.ID(), remote.Address()))
 }
 
-func (server Server) relayCommand(dest io.Writer, cmd Command, remote Node) {
-	remoteConn, err := net.Dial("tcp", remote.Address())
+func (server Server) relayOnce(cmd Command, remote Node) (Result, error) {
+	// nodes predating the RPC protocol only understand text commands
+	if !remote.Meta().supports(FeatureRPC) {
+		return server.relayText(cmd, remote)
+	}
+
+	request, err := toRPCRequest(cmd, server.cluster.Epoch())
 	if err != nil {
-		server.logger.Errorf("Could not connect to node: %s", remote.Address())
-		return
+		return nil, err
+	}
+
+	redialed := false
+
+	for {
+		remoteConn, err := server.relays.get(remote.Address())
+		if err != nil {
+			return nil, err
+		}
+
+		remoteConn.SetDeadline(time.Now().Add(server.config.RelayReadTimeout))
+		remoteConn.requestID++
+
+		response, err := rpc.Call(remoteConn, remoteConn.reader, remoteConn.requestID, request)
+		server.relays.put(remoteConn, err == nil)
+
+		// a reused connection might have been closed by the node while idle
+		// (when it restarted, ...), in which case the command was not
+		// executed: it can be sent again on a new connection
+		if err != nil && remoteConn.reused && errors.Cause(err) == io.EOF && !redialed {
+			server.relays.dropIdle(remote.Address())
+			redialed = true
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return fromRPCResponse(response)
 	}
-	defer remoteConn.Close()
+}
 
-	_, err = fmt.Fprintf(remoteConn, "%s\n", cmd)
+// relayText relays a command to a node that does not speak the RPC protocol.
+// Such nodes are only expected during rolling upgrades: connections to them
+// are not pooled.
+func (server Server) relayText(cmd Command, remote Node) (Result, error) {
+	request, err := textRequest(cmd, remote.Meta(), server.cluster.Epoch())
 	if err != nil {
-		server.logger.Errorf("Could not relay command to node: %s", remote.Address())
-		return
+		return nil, errors.Wrap(err, fmt.Sprintf("can not relay to node %s", remote.ID()))
+	}
+
+	conn, err := net.DialTimeout("tcp", remote.Address(), server.config.RelayPool.DialTimeout)
+	if err != nil {
+		return nil, err
 	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(server.config.RelayReadTimeout))
 
-	io.Copy(dest, remoteConn)
+	if _, err := io.WriteString(conn, request+"\n"); err != nil {
+		return nil, err
+	}
+
+	raw, err := readResult(bufio.NewReader(conn))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseResult(raw), nil
+}
+
+// textRequest renders a command in the text protocol, in a form the given
+// node understands.
+func textRequest(cmd Command, meta NodeMeta, epoch uint64) (string, error) {
+	switch cmd.(type) {
+	case *NodeFetchCmd, *NodeDelCmd, *NodeHandoffCmd:
+		if !meta.supports(FeatureNodeCommands) {
+			return "", errors.New("node commands are not supported")
+		}
+	}
+
+	request := cmd.String()
+	if cmd.distributed() && meta.supports(FeatureRelayMarker) {
+		request = RelayedCmd{epoch: epoch, cmd: cmd}.String()
+	}
+
+	// the text protocol is line-based
+	if strings.ContainsRune(request, '\n') {
+		return "", errors.New("values spanning several lines are not supported")
+	}
+
+	return request, nil
+}
+
+// previousOwner returns the node that might still hold the given key
+// while the cluster is transitioning, if it is not us.
+func (server Server) previousOwner(key string) (Node, bool) {
+	previous := server.cluster.PreviousNode(key)
+	if previous == nil || server.cluster.LocalNode().SameAs(previous) {
+		return nil, false
+	}
+
+	// older nodes can not be asked about the keys they still hold
+	if !previous.Meta().supports(FeatureNodeCommands) {
+		return nil, false
+	}
+
+	return previous, true
 }
 
 func (server Server) execute(dest io.Writer, cmd Command) {
 	res, err := cmd.execute(&server)
 	if err != nil {
 		server.logger.Warnf("Error while executing command: %s", err)
-		io.Copy(dest, strings.NewReader(fmt.Sprintf("-%d\n%s", len(err.Error()), err)))
-		return
+		res = ErrorResult{err: err}
 	}
 
-	_, err = io.Copy(dest, strings.NewReader(res.String()))
+	server.respond(dest, res)
+}
+
+func (server Server) respond(dest io.Writer, res Result) {
+	_, err := io.WriteString(dest, res.String())
 	if err != nil {
 		server.logger.Warnf("Could not send response: %s", err)
 	}
 }
 
 func (server Server) JoinCluster(member string) {
-	err := server.cluster.Join(member)
+	// we will be responsible for keys that we do not have yet: until they are
+	// handed off to us, misses are proxied to their previous owners
+	err := server.cluster.SetState(StateJoining)
+	if err != nil {
+		server.logger.Fatalf("Failed to switch to joining state: %s", err)
+	}
+
+	err = server.cluster.Join(member)
 	if err != nil {
 		server.logger.Fatalf("Failed to join cluster: %s", err)
 	}
+
+	server.lifecycle.routines.Add(1)
+	go server.activateOnceHandedOff()
+}
+
+// activateOnceHandedOff switches the node to the active state once the other
+// nodes handed its keys off to it.
+func (server Server) activateOnceHandedOff() {
+	defer server.lifecycle.routines.Done()
+
+	ticker := time.NewTicker(handoffCheckInterval)
+	defer ticker.Stop()
+
+	warmup := time.NewTimer(server.config.JoinWarmup)
+	defer warmup.Stop()
+
+	warmedUp := false
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-warmup.C:
+			warmedUp = true
+		case <-server.lifecycle.stopping:
+			return
+		}
+
+		if server.cluster.State() != StateJoining {
+			return
+		}
+
+		if !server.handedOff(warmedUp) {
+			continue
+		}
+
+		if err := server.cluster.SetState(StateActive); err != nil {
+			server.logger.Errorf("Failed to switch to active state: %s", err)
+		}
+
+		return
+	}
+}
+
+// handedOff tells whether the nodes that held keys before the current
+// topology handed off the ones they are not responsible for anymore. The
+// nodes that can not tell are trusted to have done so once warmed up.
+func (server Server) handedOff(warmedUp bool) bool {
+	epoch := server.cluster.Epoch()
+	localNode := server.cluster.LocalNode()
+
+	for _, member := range server.cluster.Members() {
+		meta := member.Meta()
+
+		if localNode.SameAs(member) || !meta.State.settled() {
+			continue
+		}
+
+		if !meta.supports(FeatureHandoffProgress) {
+			if !warmedUp {
+				return false
+			}
+			continue
+		}
+
+		if meta.HandedOff != epoch {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Drain hands all the keys of the node off to the rest of the cluster, then
+// leaves it. Reads are still served while the keys are being handed off.
+func (server *Server) Drain() {
+	server.logger.Info("Draining node...")
+
+	err := server.cluster.SetState(StateDraining)
+	if err != nil {
+		server.logger.Errorf("Failed to switch to draining state: %s", err)
+		return
+	}
+
+	if _, failed := server.moveKeys(-1); failed != 0 {
+		server.logger.Errorf("Failed to hand %d keys off", failed)
+	}
+
+	err = server.cluster.Leave()
+	if err != nil {
+		server.logger.Errorf("Failed to leave the cluster: %s", err)
+		return
+	}
+
+	server.logger.Info("Node drained")
 }
 
 func (server *Server) Start() {
@@ -128,17 +550,23 @@ func (server *Server) Start() {
 		server.logger.Fatalf("Could not listen to %s:%d. %s", server.config.Host, server.config.Port, err)
 	}
 
-	server.listener = listener
+	if !server.lifecycle.listen(listener) {
+		return
+	}
+
 	server.logger.Infof("Listening to %s:%d", server.config.Host, server.config.Port)
 
 	server.startStabilizationRoutine()
+	server.startHandoffRoutine()
 
 	for {
-		if server.stopped {
-			break
-		}
-
 		conn, err := listener.Accept()
+		if server.lifecycle.stopped() {
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
 		if err != nil {
 			server.logger.Errorf("Could not accept connection: %s", err)
 			continue
@@ -152,119 +580,399 @@ func (server *Server) startStabilizationRoutine() {
 	// this could be triggered by "node joined" events instead of periodically
 	ticker := time.NewTicker(server.config.StabilizeInterval)
 
+	server.lifecycle.routines.Add(1)
+
 	go func() {
-		for range ticker.C {
-			if server.stopped {
-				ticker.Stop()
-				break
+		defer server.lifecycle.routines.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				server.stabilize()
+			case <-server.lifecycle.stopping:
+				return
 			}
+		}
+	}()
+}
+
+// startHandoffRoutine moves keys to their new owners as soon as the
+// topology changes, instead of waiting for the next stabilization.
+func (server *Server) startHandoffRoutine() {
+	server.lifecycle.routines.Add(1)
+
+	go func() {
+		defer server.lifecycle.routines.Done()
+
+		// failed handoffs are retried, even if the topology does not change
+		var retry <-chan time.Time
+
+		for {
+			select {
+			case <-server.cluster.Changes():
+			case <-retry:
+			case <-server.lifecycle.stopping:
+				return
+			}
+
+			if !server.settle() {
+				return
+			}
+
+			epoch := server.cluster.Epoch()
 
-			server.stabilize()
+			server.logger.Debug("Topology changed, handing keys off")
+
+			if _, failed := server.moveKeys(-1); failed != 0 {
+				server.logger.Warnf("Failed to hand %d keys off, retrying in %s", failed, server.config.HandoffDelay)
+				retry = time.After(server.config.HandoffDelay)
+				continue
+			}
+
+			retry = nil
+
+			if err := server.cluster.SetHandedOff(epoch); err != nil {
+				server.logger.Errorf("Failed to gossip the handoff: %s", err)
+			}
 		}
 	}()
 }
 
+// settle waits for the topology not to have changed for HandoffDelay. It
+// returns false if the server stopped meanwhile.
+func (server *Server) settle() bool {
+	timer := time.NewTimer(server.config.HandoffDelay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-server.cluster.Changes():
+			timer.Reset(server.config.HandoffDelay)
+		case <-timer.C:
+			return true
+		case <-server.lifecycle.stopping:
+			return false
+		}
+	}
+}
+
 func (server *Server) stabilize() {
 	server.logger.Debug("Starting stabilization routine")
 
+	batchSize := int(float64(server.store.Len()) * float64(server.config.StabilizeBatchSize) / 100.0)
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	server.moveKeys(batchSize)
+}
+
+// moveKeys sends up to limit keys (or all of them if limit is negative) that
+// we are not responsible for to their owner, HandoffConcurrency at a time.
+// It returns once they are moved, with how many were and how many could not
+// be.
+func (server *Server) moveKeys(limit int) (int, int) {
 	if len(server.cluster.Members()) < 2 {
 		server.logger.Debug("Not enough nodes in the cluster for a stabilization to be needed")
-		return
+		return 0, 0
+	}
+
+	type move struct {
+		key    string
+		remote Node
+	}
+
+	moves := make(chan move)
+	failedKeys := int64(0)
+
+	workers := server.config.HandoffConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for move := range moves {
+				if !server.stabilizeKey(move.key, move.remote) {
+					atomic.AddInt64(&failedKeys, 1)
+				}
+			}
+		}()
 	}
 
 	localNode := server.cluster.LocalNode()
-	batchSize := int(float64(server.store.Len()) * float64(server.config.StabilizeBatchSize) / 100.0)
-	stabilizedKeys := 0
+	movedKeys := 0
 
 	server.store.Keys(func(key string) bool {
+		if (limit >= 0 && movedKeys >= limit) || server.lifecycle.stopped() {
+			return false
+		}
+
 		responsibleNode := server.cluster.ResponsibleNode(key)
 
 		if !localNode.SameAs(responsibleNode) {
-			go server.stabilizeKey(key, responsibleNode)
-
-			stabilizedKeys++
+			moves <- move{key: key, remote: responsibleNode}
+			movedKeys++
 		}
 
-		return stabilizedKeys < batchSize
+		return true
 	})
 
-	server.logger.Debugf("Stabilized %d keys (maximum batch size: %d)", stabilizedKeys, batchSize)
+	close(moves)
+	wg.Wait()
+
+	failed := int(atomic.LoadInt64(&failedKeys))
+
+	server.logger.Debugf("Stabilized %d keys, %d failed (maximum batch size: %d)", movedKeys-failed, failed, limit)
+
+	return movedKeys - failed, failed
 }
 
-func (server *Server) stabilizeKey(key string, remote Node) {
+// stabilizeKey hands a key off to its owner. It returns false if the key
+// could not be.
+func (server *Server) stabilizeKey(key string, remote Node) bool {
 	value, lifetime, err := server.store.Get(key)
 	if err != nil {
-		return
+		// deleted or expired meanwhile
+		return true
 	}
 
-	var storeCmd Command
-	if lifetime == 0 {
-		storeCmd = &StoreCmd{
-			key:   key,
-			value: value,
+	var remaining time.Duration
+	if lifetime != 0 {
+		remaining = time.Until(time.UnixMilli(int64(lifetime)))
+
+		// expired while being handed off
+		if remaining <= 0 {
+			return true
 		}
-	} else {
-		storeCmd = &StoreExpiringCmd{
-			key:      key,
-			value:    value,
-			lifetime: time.Until(time.Unix(int64(lifetime), 0)),
+	}
+
+	var storeCmd Command = &NodeHandoffCmd{
+		key:      key,
+		value:    value,
+		lifetime: remaining,
+	}
+
+	// older nodes do not know about handoffs: a plain write is the closest
+	// command they understand
+	if !remote.Meta().supports(FeatureNodeCommands) {
+		if remaining == 0 {
+			storeCmd = &StoreCmd{key: key, value: value}
+		} else {
+			storeCmd = &StoreExpiringCmd{key: key, value: value, lifetime: remaining}
 		}
 	}
 
-	delCmd := DelCmd{key: key}
+	delCmd := NodeDelCmd{key: key}
 
 	// send the key-value pair to the remote server
-	storeBuffer := bytes.NewBufferString("")
-	server.relayCommand(storeBuffer, storeCmd, remote)
-
-	result, err := storeBuffer.ReadByte()
-	if err != nil || result != '+' {
+	result, err := server.relay(storeCmd, remote)
+	if _, failed := result.(ErrorResult); err != nil || failed {
 		server.logger.Errorf("Could not stabilize key %q to node %q", key, remote)
-		return
+		return false
 	}
 
 	// delete our own copy of it
 	_, err = delCmd.execute(server)
 	if err != nil {
 		server.logger.Errorf("Could not delete local copy of stabilized key %q: %s", key, err)
+		return false
 	}
+
+	return true
 }
 
+// Stop stops accepting connections and closes the idle ones, then waits for
+// the commands being handled and the keys being handed off before closing the
+// storage engine.
 func (server *Server) Stop() {
+	stopping, err := server.lifecycle.stop()
+	if !stopping {
+		return
+	}
+
 	server.logger.Info("Stopping server...")
 
-	server.stopped = true
+	if err != nil {
+		server.logger.Errorf("Error while stopping server: %s", err)
+	}
 
-	err := server.cluster.Shutdown()
+	// the subscribers are waiting for invalidations on idle connections,
+	// which are closed by now
+	server.invalidations.Close()
+
+	// the routines might be gossiping their progress
+	server.lifecycle.connections.wait()
+	server.lifecycle.routines.Wait()
+
+	err = server.cluster.Shutdown()
 	if err != nil {
 		server.logger.Errorf("Error while stopping cluster management: %s", err)
 	}
 
-	err = server.listener.Close()
+	server.relays.Close()
+
+	// nothing uses the store anymore: the writes can be flushed
+	err = server.store.Close()
 	if err != nil {
-		server.logger.Errorf("Error while stopping server: %s", err)
+		server.logger.Errorf("Error while stopping storage engine: %s", err)
 	}
 
 	server.logger.Info("Server stopped!")
 }
 
-func NewServer(logger *log.Logger, config Config) Server {
-	var store storage.Store
-	var err error
-
-	if config.StoragePath == "memory" {
-		store = storage.NewSyncMap(newPrefixedLogger(logger, "[syncMap] "))
-	} else {
-		store, err = storage.NewBadgerDb(newPrefixedLogger(logger, "[badger] "), config.StoragePath)
+// storageURI resolves the storage path of the configuration to the URI of
+// an engine, completed with the configured options of the built-in engines.
+func storageURI(config Config) (*url.URL, error) {
+	var uri *url.URL
+
+	switch {
+	case config.StoragePath == "memory":
+		uri = &url.URL{Scheme: "memory"}
+	case !strings.Contains(config.StoragePath, "://"):
+		uri = &url.URL{Scheme: "badger", Path: config.StoragePath}
+	default:
+		parsed, err := url.Parse(config.StoragePath)
 		if err != nil {
-			logger.Fatalf("Could not start storage engine: %s", err)
+			return nil, errors.Wrap(err, fmt.Sprintf("invalid storage URI %q", config.StoragePath))
 		}
+		uri = parsed
+	}
+
+	var defaults map[string]string
+
+	switch uri.Scheme {
+	case "memory":
+		defaults = map[string]string{
+			"maxmemory":         strconv.FormatInt(config.MaxMemory, 10),
+			"maxmemory-policy":  config.MaxMemoryPolicy,
+			"appendonly":        config.AppendOnlyPath,
+			"appendfsync":       config.AppendOnlyFsync,
+			"snapshot":          config.SnapshotPath,
+			"snapshot-interval": config.SnapshotInterval.String(),
+		}
+	case "badger":
+		defaults = map[string]string{
+			"sync":                strconv.FormatBool(config.Badger.SyncWrites),
+			"max-table-size":      strconv.FormatInt(config.Badger.MaxTableSize, 10),
+			"level-one-size":      strconv.FormatInt(config.Badger.LevelOneSize, 10),
+			"memtables":           strconv.Itoa(config.Badger.NumMemtables),
+			"tables-in-ram":       strconv.FormatBool(config.Badger.LoadTablesToRAM),
+			"value-threshold":     strconv.Itoa(config.Badger.ValueThreshold),
+			"value-log-file-size": strconv.FormatInt(config.Badger.ValueLogFileSize, 10),
+			"gc-interval":         config.Badger.GCInterval.String(),
+			"gc-discard-ratio":    strconv.FormatFloat(config.Badger.GCDiscardRatio, 'g', -1, 64),
+		}
+	}
+
+	query := uri.Query()
+	for name, value := range defaults {
+		if _, set := query[name]; !set && value != "" {
+			query.Set(name, value)
+		}
+	}
+	uri.RawQuery = query.Encode()
+
+	return uri, nil
+}
+
+// storageEngine is the name of the storage engine, gossiped to the cluster.
+func storageEngine(config Config) string {
+	uri, err := storageURI(config)
+	if err != nil {
+		return ""
+	}
+
+	return uri.Scheme
+}
+
+// memoryStats describes the memory used by the storage engine, when it is
+// bounded.
+func (server *Server) memoryStats() (engine.MemoryStats, bool) {
+	store := server.store
+	if notifying, ok := store.(notifyingStore); ok {
+		store = notifying.Store
+	}
+
+	bounded, ok := store.(engine.MemoryBounded)
+	if !ok {
+		return engine.MemoryStats{}, false
+	}
+
+	return bounded.MemoryStats(), true
+}
+
+// snapshot writes a snapshot of the storage engine, if it supports them.
+func (server *Server) snapshot() error {
+	store := server.store
+	if notifying, ok := store.(notifyingStore); ok {
+		store = notifying.Store
+	}
+
+	snapshotter, ok := store.(engine.Snapshotter)
+	if !ok {
+		return errors.New("The storage engine does not support snapshots")
+	}
+
+	return snapshotter.Snapshot()
+}
+
+// storageStats describes the storage engine, as reported by the "node stats"
+// command.
+func (server *Server) storageStats() string {
+	stats := fmt.Sprintf("Keys: %d", server.store.Len())
+
+	if memory, ok := server.memoryStats(); ok {
+		stats += fmt.Sprintf("\nMemory: used=%d max=%d evictions=%d rejections=%d", memory.Used, memory.Max, memory.Evictions, memory.Rejections)
+	}
+
+	return stats
+}
+
+func NewServer(logger *log.Logger, config Config) Server {
+	if err := validateZone(config.Zone); err != nil {
+		logger.Fatalf("Invalid configuration: %s", err)
+	}
+
+	if err := config.RelayPool.validate(); err != nil {
+		logger.Fatalf("Invalid relay pool configuration: %s", err)
+	}
+
+	nodeID, err := resolveNodeID(config)
+	if err != nil {
+		logger.Fatalf("Could not determine node ID: %s", err)
+	}
+
+	invalidations := newInvalidationHub()
+
+	uri, err := storageURI(config)
+	if err != nil {
+		logger.Fatalf("Could not start storage engine: %s", err)
+	}
+
+	store, err := engine.OpenURL(uri, engine.Options{
+		Logger: newPrefixedLogger(logger, fmt.Sprintf("[%s] ", uri.Scheme)),
+		// clients caching evicted keys must forget them too
+		OnEvict: invalidations.invalidate,
+	})
+	if err != nil {
+		logger.Fatalf("Could not start storage engine: %s", err)
 	}
 
 	return Server{
 		logger:  newPrefixedLogger(logger, "[gostore] "),
 		config:  config,
-		store:   store,
-		cluster: NewCluster(newPrefixedLogger(logger, "[cluster] "), config.Port+1),
+		store:   notifyingStore{Store: store, hub: invalidations},
+		cluster: NewCluster(newPrefixedLogger(logger, "[cluster] "), nodeID, config),
+		relays:  newConnPool(config.RelayPool, rpcHandshake),
+		metrics: &metrics{},
+
+		invalidations: invalidations,
+		lifecycle:     newLifecycle(),
 	}
 }
@@ -3,12 +3,18 @@ package gostore
 import (
 	"bufio"
 	"fmt"
+	"github.com/K-Phoen/gostore/internal/rpc"
+	"github.com/hashicorp/memberlist"
 	"github.com/sirupsen/logrus"
 	logging "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"io"
 	"io/ioutil"
+	"log"
 	"net"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -29,6 +35,7 @@ func (suite *serverTestSuite) SetupSuite() {
 	suite.port = config.Port
 
 	go server.Start()
+	waitForServer(suite.Require(), config.Port)
 }
 
 func (suite *serverTestSuite) TearDownSuite() {
@@ -39,6 +46,20 @@ func TestServerTestSuite(t *testing.T) {
 	suite.Run(t, new(serverTestSuite))
 }
 
+func waitForServer(require *require.Assertions, port int) {
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+		if err == nil {
+			conn.Close()
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.FailNow("server did not start", "port %d", port)
+}
+
 func sendRequest(require *require.Assertions, port int, payload []byte) []byte {
 	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
 	require.NoError(err, "could not connect to test server")
@@ -61,41 +82,57 @@ func (suite *serverTestSuite) itHandlesRequestsCorrectly(port int) {
 		test    string
 		payload []byte
 		want    []byte
+		// only check that the response contains what we want (for responses
+		// that are not fully predictable)
+		partial bool
 	}{
 		{
 			"Data can be stored",
 			[]byte("store key some-value\n"),
 			[]byte("+0\n"),
+			false,
 		},
 		{
 			"Data can be fetched",
 			[]byte("fetch key\n"),
 			[]byte("+10\nsome-value"),
+			false,
 		},
 		{
 			"Data can be fetched",
 			[]byte("fetch unknown-key\n"),
 			[]byte("+0\n"),
+			false,
 		},
 		{
 			"Data can be deleted",
 			[]byte("del key\n"),
 			[]byte("+0\n"),
+			false,
 		},
 		{
 			"Data can be deleted twice",
 			[]byte("del key\n"),
 			[]byte("+0\n"),
+			false,
 		},
 		{
 			"A local command can be executed",
 			[]byte("node stats\n"),
-			[]byte("+7\nKeys: 0"),
+			[]byte("Keys: 0\nMemory: used=0 max=0 evictions=0 rejections=0\nRelay pool: "),
+			true,
+		},
+		{
+			"Snapshots must be enabled",
+			[]byte("node snapshot\n"),
+			[]byte("Could not write the snapshot: snapshots are not enabled"),
+			true,
 		},
 		{
 			"Invalid requests do not crash the server",
 			[]byte("store key \n"),
 			[]byte("-14\nNo value given"),
+			false,
 		},
 	}
 
@@ -105,6 +142,11 @@ func (suite *serverTestSuite) itHandlesRequestsCorrectly(port int) {
 		suite.Run(tc.test, func() {
 			response := sendRequest(test, port, tc.payload)
 
+			if tc.partial {
+				test.Contains(string(response), string(tc.want))
+				return
+			}
+
 			test.Equal(tc.want, response)
 		})
 	}
@@ -114,6 +156,32 @@ func (suite *serverTestSuite) TestASingleNodeHandlesRequests() {
 	suite.itHandlesRequestsCorrectly(suite.port)
 }
 
+func (suite *serverTestSuite) TestConnectionsOpenedWithAHelloCanBeReused() {
+	test := suite.Require()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", suite.port))
+	test.NoError(err, "could not connect to test server")
+	defer conn.Close()
+
+	test.NoError(conn.SetDeadline(time.Now().Add(time.Second)))
+
+	reader := bufio.NewReader(conn)
+
+	for _, tc := range []struct{ request, response string }{
+		{"hello 1 node-commands\n", "+32\nversion=1 features=node-commands"},
+		{"store reused-key some-value\n", "+0\n"},
+		{"fetch reused-key\n", "+10\nsome-value"},
+		{"del reused-key\n", "+0\n"},
+	} {
+		_, err = conn.Write([]byte(tc.request))
+		test.NoError(err)
+
+		response, err := readResult(reader)
+		test.NoError(err)
+		test.Equal(tc.response, response)
+	}
+}
+
 func (suite *serverTestSuite) TestItHandlesExpiringKeys() {
 	test := suite.Require()
 
@@ -123,15 +191,119 @@ func (suite *serverTestSuite) TestItHandlesExpiringKeys() {
 	response = sendRequest(test, suite.port, []byte("fetch expiring-key\n"))
 	test.Equal([]byte("+10\nsome-value"), response)
 
-	time.Sleep(time.Second)
+	time.Sleep(time.Second + 10*time.Millisecond)
 
 	response = sendRequest(test, suite.port, []byte("fetch expiring-key\n"))
 	test.Equal([]byte("+0\n"), response)
 }
 
+func (suite *serverTestSuite) TestLifetimesAreAccurateToTheMillisecond() {
+	test := suite.Require()
+
+	response := sendRequest(test, suite.port, []byte("storex short-lived-key 300ms some-value\n"))
+	test.Equal([]byte("+0\n"), response)
+
+	time.Sleep(150 * time.Millisecond)
+
+	response = sendRequest(test, suite.port, []byte("fetch short-lived-key\n"))
+	test.Equal([]byte("+10\nsome-value"), response)
+
+	time.Sleep(200 * time.Millisecond)
+
+	response = sendRequest(test, suite.port, []byte("fetch short-lived-key\n"))
+	test.Equal([]byte("+0\n"), response)
+}
+
+func (suite *serverTestSuite) TestSnapshotsCanBeRequested() {
+	test := suite.Require()
+
+	config := DefaultConfig()
+	config.Port = 9250
+	config.GossipPort = 9251
+	config.SnapshotPath = filepath.Join(suite.T().TempDir(), "gostore.snapshot")
+
+	logger, _ := logging.NewNullLogger()
+
+	node := NewServer(logger, config)
+	go node.Start()
+	waitForServer(test, config.Port)
+
+	sendRequest(test, config.Port, []byte("store some-key some-value\n"))
+
+	response := sendRequest(test, config.Port, []byte("node snapshot\n"))
+	test.Equal("+0\n", string(response))
+
+	node.Stop()
+
+	// the snapshot is loaded when the node restarts
+	config.Port = 9252
+	config.GossipPort = 9253
+
+	restarted := NewServer(logger, config)
+	go restarted.Start()
+	defer restarted.Stop()
+	waitForServer(test, config.Port)
+
+	response = sendRequest(test, config.Port, []byte("fetch some-key\n"))
+	test.Equal("+10\nsome-value", string(response))
+}
+
+func (suite *serverTestSuite) TestStoppingClosesIdleConnections() {
+	test := suite.Require()
+
+	config := DefaultConfig()
+	config.Port = 9264
+	config.GossipPort = 9265
+
+	logger, _ := logging.NewNullLogger()
+
+	node := NewServer(logger, config)
+
+	started := make(chan struct{})
+	go func() {
+		node.Start()
+		close(started)
+	}()
+	waitForServer(test, config.Port)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", config.Port))
+	test.NoError(err)
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(conn)
+
+	_, err = conn.Write([]byte("hello 1\nstore some-key some-value\n"))
+	test.NoError(err)
+	_, err = readResult(reader)
+	test.NoError(err)
+	response, err := readResult(reader)
+	test.NoError(err)
+	test.Equal("+0\n", response)
+
+	// the connection is kept open, waiting for another command
+	node.Stop()
+
+	_, err = reader.ReadByte()
+	test.Equal(io.EOF, err, "Idle connections should be closed")
+
+	node.lifecycle.connections.mutex.Lock()
+	test.Empty(node.lifecycle.connections.conns, "Stopping should wait for the connections to be handled")
+	node.lifecycle.connections.mutex.Unlock()
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		test.FailNow("the server still accepts connections")
+	}
+
+	node.Stop()
+}
+
 func (suite *serverTestSuite) TestWithATwoNodesCluster() {
 	config := DefaultConfig()
 	config.Port = 5225
+	config.GossipPort = 5226
 
 	logger, _ := logging.NewNullLogger()
 
@@ -139,8 +311,9 @@ func (suite *serverTestSuite) TestWithATwoNodesCluster() {
 
 	go secondNode.Start()
 	defer secondNode.Stop()
+	waitForServer(suite.Require(), config.Port)
 
-	secondNode.JoinCluster(fmt.Sprintf("127.0.0.1:%d", suite.port+1))
+	secondNode.JoinCluster(fmt.Sprintf("127.0.0.1:%d", suite.server.config.gossipPort()))
 
 	// it should behave the same from both nodes
 	suite.itHandlesRequestsCorrectly(suite.port)
@@ -159,12 +332,15 @@ func (suite *serverTestSuite) TestWithATwoNodesCluster() {
 func (suite *serverTestSuite) TestKeyStabilization() {
 	configA := DefaultConfig()
 	configA.Port = 6226
+	configA.GossipPort = 6227
 	configA.StabilizeBatchSize = 100
 	configB := DefaultConfig()
 	configB.Port = 7227
+	configB.GossipPort = 7228
 	configB.StabilizeBatchSize = 100
 	configC := DefaultConfig()
 	configC.Port = 8228
+	configC.GossipPort = 8229
 	configC.StabilizeBatchSize = 100
 
 	logger, _ := logging.NewNullLogger()
@@ -179,11 +355,14 @@ func (suite *serverTestSuite) TestKeyStabilization() {
 	defer nodeA.Stop()
 	defer nodeB.Stop()
 	defer nodeC.Stop()
+	waitForServer(suite.Require(), configA.Port)
+	waitForServer(suite.Require(), configB.Port)
+	waitForServer(suite.Require(), configC.Port)
 
 	// stabilizing a node which is not part of a cluster (yet) does not fail
 	nodeA.stabilize()
 
-	nodeA.JoinCluster(fmt.Sprintf("127.0.0.1:%d", configB.Port+1))
+	nodeA.JoinCluster(fmt.Sprintf("127.0.0.1:%d", configB.GossipPort))
 
 	test := suite.Require()
 
@@ -198,17 +377,588 @@ func (suite *serverTestSuite) TestKeyStabilization() {
 
 	// make the last node join the cluster (we join explicitely the two nodes to
 	// avoid having to wait for the cluster discovery to happen)
-	nodeC.JoinCluster(fmt.Sprintf("127.0.0.1:%d", configB.Port+1))
-	nodeC.JoinCluster(fmt.Sprintf("127.0.0.1:%d", configA.Port+1))
+	nodeC.JoinCluster(fmt.Sprintf("127.0.0.1:%d", configB.GossipPort))
+	nodeC.JoinCluster(fmt.Sprintf("127.0.0.1:%d", configA.GossipPort))
 
 	// force stabilization routine to run on older nodes
 	nodeA.stabilize()
 	nodeB.stabilize()
 
-	// each key is stabilized in its goroutine, so let's wait for them to complete
-	time.Sleep(300 * time.Millisecond)
-
 	test.NotEqual(0, nodeA.store.Len(), "The first node should have at least some keys")
 	test.NotEqual(0, nodeB.store.Len(), "The second node should have at least some keys")
 	test.NotEqual(0, nodeC.store.Len(), "The last node should have data after the stabilization process")
 }
+
+func (suite *serverTestSuite) TestJoiningNodesProxyMissesToPreviousOwners() {
+	configA := DefaultConfig()
+	configA.Port = 9230
+	configA.GossipPort = 9231
+	// the keys are never handed off, for misses to be proxied
+	configA.HandoffDelay = time.Hour
+	configJ := DefaultConfig()
+	configJ.Port = 9232
+	configJ.GossipPort = 9233
+
+	logger, _ := logging.NewNullLogger()
+	nodeA := NewServer(logger, configA)
+	nodeJ := NewServer(logger, configJ)
+
+	go nodeA.Start()
+	go nodeJ.Start()
+	defer nodeA.Stop()
+	defer nodeJ.Stop()
+	waitForServer(suite.Require(), configA.Port)
+	waitForServer(suite.Require(), configJ.Port)
+
+	nodeJ.JoinCluster(fmt.Sprintf("127.0.0.1:%d", configA.GossipPort))
+
+	test := suite.Require()
+	test.Equal(StateJoining, nodeJ.cluster.State())
+
+	// let the topology changes settle, then simulate keys that were not
+	// handed off yet
+	time.Sleep(100 * time.Millisecond)
+
+	var key string
+	for i := 0; key == ""; i++ {
+		candidate := fmt.Sprintf("some-key-%d", i)
+		if nodeA.cluster.ResponsibleNode(candidate).ID() == nodeJ.cluster.LocalNode().ID() {
+			key = candidate
+		}
+	}
+
+	test.NoError(nodeA.store.Set(key, "some-value"))
+
+	response := sendRequest(test, configJ.Port, []byte(fmt.Sprintf("fetch %s\n", key)))
+	test.Equal([]byte("+10\nsome-value"), response, "A miss should be proxied to the previous owner")
+
+	response = sendRequest(test, configA.Port, []byte(fmt.Sprintf("fetch %s\n", key)))
+	test.Equal([]byte("+10\nsome-value"), response, "A miss should be proxied to the previous owner")
+
+	response = sendRequest(test, configJ.Port, []byte(fmt.Sprintf("del %s\n", key)))
+	test.Equal([]byte("+0\n"), response)
+
+	_, _, err := nodeA.store.Get(key)
+	test.Error(err, "Deletes should also be applied to the previous owner")
+
+	subscriber := nodeJ.invalidations.subscribe()
+	defer nodeJ.invalidations.unsubscribe(subscriber)
+
+	test.NoError(nodeA.store.SetExpiring(key, "some-value", 50*time.Millisecond))
+
+	response = sendRequest(test, configJ.Port, []byte(fmt.Sprintf("fetch %s\n", key)))
+	test.Equal([]byte("+10\nsome-value"), response)
+
+	select {
+	case invalidated := <-subscriber:
+		test.Equal(key, invalidated, "The expiration of values fetched from the previous owner should be announced")
+	case <-time.After(time.Second):
+		test.Fail("The expiration of values fetched from the previous owner should be announced")
+	}
+}
+
+func (suite *serverTestSuite) TestJoiningNodesBecomeActiveOnceHandedOff() {
+	configA := DefaultConfig()
+	configA.Port = 9266
+	configA.GossipPort = 9267
+	configA.HandoffDelay = 10 * time.Millisecond
+	configJ := DefaultConfig()
+	configJ.Port = 9268
+	configJ.GossipPort = 9269
+
+	logger, _ := logging.NewNullLogger()
+	nodeA := NewServer(logger, configA)
+	nodeJ := NewServer(logger, configJ)
+
+	go nodeA.Start()
+	go nodeJ.Start()
+	defer nodeA.Stop()
+	defer nodeJ.Stop()
+	waitForServer(suite.Require(), configA.Port)
+	waitForServer(suite.Require(), configJ.Port)
+
+	test := suite.Require()
+
+	for i := 0; i < 30; i++ {
+		test.NoError(nodeA.store.Set(fmt.Sprintf("some-key-%d", i), "some-value"))
+	}
+
+	nodeJ.JoinCluster(fmt.Sprintf("127.0.0.1:%d", configA.GossipPort))
+	test.Equal(StateJoining, nodeJ.cluster.State())
+
+	// well before the warmup ends
+	for i := 0; i < 100 && nodeJ.cluster.State() == StateJoining; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	test.Equal(StateActive, nodeJ.cluster.State(), "The node should be active once its keys were handed off")
+	test.NotEqual(0, nodeJ.store.Len(), "The keys should have been handed off before")
+	test.Equal(30, nodeA.store.Len()+nodeJ.store.Len())
+}
+
+func (suite *serverTestSuite) TestDrainedNodesHandTheirKeysOff() {
+	configA := DefaultConfig()
+	configA.Port = 9240
+	configA.GossipPort = 9241
+	configD := DefaultConfig()
+	configD.Port = 9242
+	configD.GossipPort = 9243
+
+	logger, _ := logging.NewNullLogger()
+	nodeA := NewServer(logger, configA)
+	nodeD := NewServer(logger, configD)
+
+	go nodeA.Start()
+	go nodeD.Start()
+	defer nodeA.Stop()
+	defer nodeD.Stop()
+	waitForServer(suite.Require(), configA.Port)
+	waitForServer(suite.Require(), configD.Port)
+
+	test := suite.Require()
+
+	for i := 0; i < 30; i++ {
+		test.NoError(nodeD.store.Set(fmt.Sprintf("some-key-%d", i), "some-value"))
+	}
+
+	nodeD.JoinCluster(fmt.Sprintf("127.0.0.1:%d", configA.GossipPort))
+
+	nodeD.Drain()
+
+	test.Equal(0, nodeD.store.Len(), "A drained node should not have any key left")
+	test.Equal(30, nodeA.store.Len(), "The keys should have been handed off")
+
+	response := sendRequest(test, configA.Port, []byte("fetch some-key-12\n"))
+	test.Equal([]byte("+10\nsome-value"), response)
+}
+
+func (suite *serverTestSuite) TestRelayedCommandsAreNeverRelayedAgain() {
+	configA := DefaultConfig()
+	configA.Port = 9250
+	configA.GossipPort = 9251
+	configB := DefaultConfig()
+	configB.Port = 9252
+	configB.GossipPort = 9253
+
+	logger, _ := logging.NewNullLogger()
+	nodeA := NewServer(logger, configA)
+	nodeB := NewServer(logger, configB)
+
+	go nodeA.Start()
+	go nodeB.Start()
+	defer nodeA.Stop()
+	defer nodeB.Stop()
+	waitForServer(suite.Require(), configA.Port)
+	waitForServer(suite.Require(), configB.Port)
+
+	nodeB.JoinCluster(fmt.Sprintf("127.0.0.1:%d", configA.GossipPort))
+
+	// find a key owned by A
+	var key string
+	for i := 0; key == ""; i++ {
+		candidate := fmt.Sprintf("some-key-%d", i)
+		if nodeB.cluster.ResponsibleNode(candidate).ID() == nodeA.cluster.LocalNode().ID() {
+			key = candidate
+		}
+	}
+
+	test := suite.Require()
+
+	// B doesn't have the same view of the topology as the sender
+	response := sendRequest(test, configB.Port, []byte(fmt.Sprintf("relay 2a store %s some-value\n", key)))
+	test.Contains(string(response), TopologyChangedMessage)
+	test.Equal(0, nodeB.store.Len())
+	test.Equal(0, nodeA.store.Len(), "The command should not have been relayed again")
+
+	// B has the same view of the topology as the sender: it trusts it
+	response = sendRequest(test, configB.Port, []byte(fmt.Sprintf("relay %x store %s some-value\n", nodeB.cluster.Epoch(), key)))
+	test.Equal([]byte("+0\n"), response)
+	test.Equal(1, nodeB.store.Len())
+	test.Equal(0, nodeA.store.Len(), "The command should not have been relayed again")
+}
+
+func (suite *serverTestSuite) TestUnreachableOwnersAreReportedToClients() {
+	configA := DefaultConfig()
+	configA.Port = 9260
+	configA.GossipPort = 9261
+	configA.RelayRetries = 2
+	configA.RelayRetryBackoff = time.Millisecond
+	configB := DefaultConfig()
+	configB.Port = 9262
+	configB.GossipPort = 9263
+
+	logger, _ := logging.NewNullLogger()
+	nodeA := NewServer(logger, configA)
+	nodeB := NewServer(logger, configB)
+
+	go nodeA.Start()
+	go nodeB.Start()
+	defer nodeA.Stop()
+	waitForServer(suite.Require(), configA.Port)
+	waitForServer(suite.Require(), configB.Port)
+
+	nodeB.JoinCluster(fmt.Sprintf("127.0.0.1:%d", configA.GossipPort))
+
+	// find a key owned by B
+	var key string
+	for i := 0; key == ""; i++ {
+		candidate := fmt.Sprintf("some-key-%d", i)
+		if nodeA.cluster.ResponsibleNode(candidate).ID() == nodeB.cluster.LocalNode().ID() {
+			key = candidate
+		}
+	}
+
+	// B crashes: A still considers it as the owner of the key
+	nodeB.Stop()
+
+	test := suite.Require()
+
+	response := string(sendRequest(test, configA.Port, []byte(fmt.Sprintf("fetch %s\n", key))))
+	test.True(strings.HasPrefix(response, "-"), "An error should be returned")
+	test.Contains(response, fmt.Sprintf("could not reach node %s", nodeB.cluster.LocalNode().ID()))
+	test.Equal(uint64(2), nodeA.metrics.relayRetries, "Idempotent commands should be retried")
+	test.Equal(uint64(1), nodeA.metrics.relayFailures)
+
+	response = string(sendRequest(test, configA.Port, []byte(fmt.Sprintf("store %s some-value\n", key))))
+	test.True(strings.HasPrefix(response, "-"), "An error should be returned")
+	test.Equal(uint64(2), nodeA.metrics.relayRetries, "Non-idempotent commands should not be retried")
+	test.Equal(uint64(2), nodeA.metrics.relayFailures)
+}
+
+func (suite *serverTestSuite) TestNodesTalkToEachOtherUsingRPC() {
+	test := suite.Require()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", suite.port))
+	test.NoError(err, "could not connect to test server")
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	reader := bufio.NewReader(conn)
+
+	hello, err := rpc.Handshake(conn, reader, []string{"rpc", "unknown-feature"})
+	test.NoError(err)
+	test.Equal(&rpc.Hello{Version: rpc.Version, Features: []string{"rpc"}}, hello)
+
+	// values are not limited to what fits on a line anymore
+	value := []byte("some value\nspanning lines")
+
+	response, err := rpc.Call(conn, reader, 1, &rpc.Transfer{Key: "rpc-key", Value: value})
+	test.NoError(err)
+	test.Equal(&rpc.Response{}, response)
+
+	response, err = rpc.Call(conn, reader, 2, &rpc.Get{Local: true, Key: "rpc-key"})
+	test.NoError(err)
+	test.Equal(&rpc.Response{Payload: value}, response)
+
+	response, err = rpc.Call(conn, reader, 3, &rpc.Delete{Epoch: suite.server.cluster.Epoch(), Key: "rpc-key"})
+	test.NoError(err)
+	test.Empty(response.(*rpc.Response).Error)
+
+	response, err = rpc.Call(conn, reader, 4, &rpc.Get{Local: true, Key: "rpc-key"})
+	test.NoError(err)
+	test.Equal(&rpc.Response{}, response)
+}
+
+func (suite *serverTestSuite) TestRPCConnectionsMustStartWithAHello() {
+	test := suite.Require()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", suite.port))
+	test.NoError(err, "could not connect to test server")
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	_, err = conn.Write(rpc.Magic)
+	test.NoError(err)
+
+	response, err := rpc.Call(conn, bufio.NewReader(conn), 1, &rpc.Stats{})
+	test.NoError(err)
+	test.NotEmpty(response.(*rpc.Response).Error)
+}
+
+func (suite *serverTestSuite) TestOtherConnectionsAreClosedAfterACommand() {
+	test := suite.Require()
+
+	// older nodes relaying commands read their result until the connection
+	// is closed
+	response := sendRequest(test, suite.port, []byte("del closed-key\nfetch closed-key\n"))
+	test.Equal("+0\n", string(response))
+}
+
+func (suite *serverTestSuite) TestClientsCanNegotiateTheProtocol() {
+	test := suite.Require()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", suite.port))
+	test.NoError(err, "could not connect to test server")
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	reader := bufio.NewReader(conn)
+
+	hello := func(request string) string {
+		_, err := conn.Write([]byte(request))
+		test.NoError(err)
+
+		response, err := readResult(reader)
+		test.NoError(err)
+
+		return response
+	}
+
+	test.Equal("+108\nversion=1 features=rpc,relay-marker,node-commands,invalidations,handoff-progress,id-routing,fetch-expiration", hello("hello 1\n"))
+	test.Equal("+32\nversion=1 features=node-commands", hello("hello 42 node-commands,unknown-feature\n"))
+	test.True(strings.HasPrefix(hello("hello 0\n"), "-"), "Unsupported versions should be refused")
+}
+
+func (suite *serverTestSuite) TestCommandsAreRelayedToRestartedNodes() {
+	test := suite.Require()
+
+	config := DefaultConfig()
+	config.Port = 9270
+	config.GossipPort = 9271
+
+	logger, _ := logging.NewNullLogger()
+
+	node := NewServer(logger, config)
+	go node.Start()
+	waitForServer(test, config.Port)
+
+	_, err := suite.server.relay(&StoreCmd{key: "some-key", value: "some-value"}, node.cluster.LocalNode())
+	test.NoError(err)
+
+	// the pooled connection to the node is closed while idle
+	node.Stop()
+
+	restarted := NewServer(logger, config)
+	go restarted.Start()
+	defer restarted.Stop()
+	waitForServer(test, config.Port)
+
+	_, err = suite.server.relay(&StoreCmd{key: "some-key", value: "some-other-value"}, restarted.cluster.LocalNode())
+	test.NoError(err, "Commands that were not sent should be sent again")
+
+	value, _, err := restarted.store.Get("some-key")
+	test.NoError(err)
+	test.Equal("some-other-value", value)
+}
+
+func (suite *serverTestSuite) TestNodesLoggingTheirWritesKeepTheirIDAcrossRestarts() {
+	test := suite.Require()
+
+	config := DefaultConfig()
+	config.Port = 9276
+	config.GossipPort = 9277
+	config.AppendOnlyPath = filepath.Join(suite.T().TempDir(), "gostore.aof")
+
+	logger, _ := logging.NewNullLogger()
+
+	node := NewServer(logger, config)
+	go node.Start()
+	waitForServer(test, config.Port)
+	id := node.cluster.LocalNode().ID()
+	node.Stop()
+
+	restarted := NewServer(logger, config)
+	go restarted.Start()
+	defer restarted.Stop()
+	waitForServer(test, config.Port)
+
+	test.Equal(id, restarted.cluster.LocalNode().ID(), "The node ID should survive restarts")
+}
+
+func (suite *serverTestSuite) TestCommandsFromOlderNodesAreNotRelayedAgain() {
+	test := suite.Require()
+
+	config := DefaultConfig()
+	config.Port = 9272
+	config.GossipPort = 9273
+
+	logger, _ := logging.NewNullLogger()
+
+	node := NewServer(logger, config)
+	go node.Start()
+	defer node.Stop()
+	waitForServer(test, config.Port)
+
+	// a node predating gossiped metadata, serving on the port preceding its
+	// gossip port
+	listener, err := net.Listen("tcp", "127.0.0.1:9274")
+	test.NoError(err)
+	defer listener.Close()
+
+	relayed := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		relayed <- line
+		conn.Write([]byte("+0\n"))
+	}()
+
+	memberConfig := memberlist.DefaultLocalConfig()
+	memberConfig.Name = "older-node"
+	memberConfig.BindAddr = "127.0.0.1"
+	memberConfig.BindPort = 9275
+	memberConfig.AdvertisePort = 9275
+	memberConfig.Logger = log.New(ioutil.Discard, "", 0)
+
+	olderNode, err := memberlist.Create(memberConfig)
+	test.NoError(err)
+	defer olderNode.Shutdown()
+
+	_, err = olderNode.Join([]string{fmt.Sprintf("127.0.0.1:%d", config.GossipPort)})
+	test.NoError(err)
+
+	for i := 0; i < 100 && len(node.cluster.Members()) != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Len(node.cluster.Members(), 2)
+
+	test.False(node.cluster.router.IDRouting(), "Keys should be placed the way older nodes do")
+
+	var key string
+	for i := 0; key == ""; i++ {
+		candidate := fmt.Sprintf("some-key-%d", i)
+		if node.cluster.ResponsibleNode(candidate).ID() == "older-node" {
+			key = candidate
+		}
+	}
+
+	// the older node shares our host: for all we know, it sent the command
+	// because it thinks that we own the key
+	response := sendRequest(test, config.Port, []byte(fmt.Sprintf("store %s some-value\n", key)))
+	test.Equal("+0\n", string(response))
+
+	value, _, err := node.store.Get(key)
+	test.NoError(err)
+	test.Equal("some-value", value, "The command should have been executed locally")
+
+	select {
+	case line := <-relayed:
+		test.Failf("the command was relayed back", "relayed %q", line)
+	default:
+	}
+}
+
+func (suite *serverTestSuite) TestOlderNodesOnlyReceiveWhatTheyCanParse() {
+	test := suite.Require()
+
+	// a node predating the RPC protocol
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	test.NoError(err)
+	defer listener.Close()
+
+	requests := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		requests <- line
+		conn.Write([]byte("+10\nsome-value"))
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	olderNode := NodeRef{id: "older-node", host: "127.0.0.1", port: uint16(port), meta: NodeMeta{Port: port}}
+
+	result, err := suite.server.relay(&FetchCmd{key: "some-key"}, olderNode)
+	test.NoError(err)
+	test.Equal(PayloadResult{data: "some-value"}, result)
+	test.Equal("fetch some-key\n", <-requests, "Neither the RPC protocol nor the relay marker should be used")
+
+	_, err = suite.server.relay(&NodeFetchCmd{key: "some-key"}, olderNode)
+	test.Error(err, "Node commands should not be sent to nodes that do not know them")
+
+	_, err = suite.server.relay(&StoreCmd{key: "some-key", value: "some\nvalue"}, olderNode)
+	test.Error(err, "Multi-line values can not be sent using the text protocol")
+}
+
+func (suite *serverTestSuite) TestClientsAreToldAboutChangedKeys() {
+	test := suite.Require()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", suite.port))
+	test.NoError(err, "could not connect to test server")
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+
+	_, err = conn.Write([]byte("node invalidations\n"))
+	test.NoError(err)
+
+	ack, err := readResult(reader)
+	test.NoError(err)
+	test.Equal("+0\n", ack, "The subscription should be acknowledged")
+
+	sendRequest(test, suite.port, []byte("store invalidated-key some-value\n"))
+	sendRequest(test, suite.port, []byte("del invalidated-key\n"))
+	sendRequest(test, suite.port, []byte("storex expiring-key 1s some-value\n"))
+
+	expected := []string{"invalidated-key", "invalidated-key", "expiring-key", "expiring-key"}
+
+	for _, key := range expected {
+		result, err := readResult(reader)
+		test.NoError(err)
+
+		// heartbeats
+		for result == "+0\n" {
+			result, err = readResult(reader)
+			test.NoError(err)
+		}
+
+		test.Equal(PayloadResult{data: key}.String(), result)
+	}
+}
+
+func TestStoragePathsAreResolvedToURIs(t *testing.T) {
+	tt := []struct {
+		storagePath string
+		scheme      string
+		path        string
+	}{
+		{"memory", "memory", ""},
+		{"/var/lib/gostore", "badger", "/var/lib/gostore"},
+		{"memory://?maxmemory=2g", "memory", ""},
+		{"badger:///var/lib/gostore?sync=true", "badger", "/var/lib/gostore"},
+		{"custom://some-host", "custom", ""},
+	}
+
+	for _, tc := range tt {
+		config := DefaultConfig()
+		config.StoragePath = tc.storagePath
+
+		uri, err := storageURI(config)
+		require.NoError(t, err, tc.storagePath)
+		require.Equal(t, tc.scheme, uri.Scheme, tc.storagePath)
+		require.Equal(t, tc.path, uri.Path, tc.storagePath)
+		require.Equal(t, tc.scheme, storageEngine(config))
+	}
+}
+
+func TestStorageURIsOverrideTheConfiguredOptions(t *testing.T) {
+	config := DefaultConfig()
+	config.StoragePath = "memory://?maxmemory=2g"
+	config.MaxMemory = 1024
+	config.AppendOnlyPath = "/var/lib/gostore.aof"
+
+	uri, err := storageURI(config)
+	require.NoError(t, err)
+
+	query := uri.Query()
+	require.Equal(t, "2g", query.Get("maxmemory"))
+	require.Equal(t, "/var/lib/gostore.aof", query.Get("appendonly"))
+	require.Equal(t, DefaultConfig().MaxMemoryPolicy, query.Get("maxmemory-policy"))
+
+	// the options of the built-in engines are not given to other engines
+	config.StoragePath = "custom://some-host"
+
+	uri, err = storageURI(config)
+	require.NoError(t, err)
+	require.Empty(t, uri.RawQuery)
+}
@@ -0,0 +1,7 @@
+package gostore
+
+// Version of the node, gossiped to the rest of the cluster. It is meant to be
+// overridden at build time:
+//
+//	go build -ldflags "-X github.com/K-Phoen/gostore.Version=1.2.3"
+var Version = "dev"